@@ -0,0 +1,186 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package v1alpha1 contains the configuration file of the manager.
+// +kubebuilder:object:generate=true
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	GroupName = "config.natpmp.jkoelker.github.io"
+	Version   = "v1alpha1"
+	Kind      = "ManagerConfig"
+)
+
+// APIVersion is the apiVersion of the configuration file.
+const APIVersion = GroupName + "/" + Version
+
+// Metrics configures the metrics endpoint.
+type Metrics struct {
+	// BindAddress is the address the metric endpoint binds to.
+	// +optional
+	BindAddress string `json:"bindAddress,omitempty"`
+}
+
+// Health configures the health probe endpoint.
+type Health struct {
+	// BindAddress is the address the probe endpoint binds to.
+	// +optional
+	BindAddress string `json:"bindAddress,omitempty"`
+
+	// StallTimeout is how long the reconciles in flight may go without one
+	// returning before the liveness probe fails.
+	// +optional
+	StallTimeout metav1.Duration `json:"stallTimeout,omitempty"`
+}
+
+// Debug configures the debug endpoint listing the mappings held by the
+// manager.
+type Debug struct {
+	// BindAddress is the address the debug endpoint binds to, empty or "0"
+	// disables it.
+	// +optional
+	BindAddress string `json:"bindAddress,omitempty"`
+
+	// TokenFile is the file holding the bearer token required to renew or
+	// release a mapping, and to read the endpoint. Without it the endpoint
+	// is read only and open to anyone who can reach it.
+	// +optional
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// LeaderElection configures the leader election of the manager.
+type LeaderElection struct {
+	// LeaderElect ensures there is only one active manager.
+	// +optional
+	LeaderElect *bool `json:"leaderElect,omitempty"`
+
+	// ResourceName is the name of the lease used for the election.
+	// +optional
+	ResourceName string `json:"resourceName,omitempty"`
+}
+
+// Controller configures the NatPMP controller.
+type Controller struct {
+	// MaxConcurrentReconciles is the number of NatPMPs reconciled at once.
+	// +optional
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+
+	// Namespaces are the namespaces whose NatPMPs are reconciled, all
+	// namespaces when empty.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Selector is the label selector of the NatPMPs that are reconciled,
+	// all NatPMPs when empty.
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
+	// Gateways are the gateways whose NatPMPs are reconciled, as
+	// addresses, CIDRs or NatPMPGateway names, all gateways when empty.
+	// Each set of gateways elects its own leader, so managers serving
+	// different sites run side by side.
+	// +optional
+	Gateways []string `json:"gateways,omitempty"`
+
+	// Namespaced only reads namespaced resources so the manager runs with
+	// Roles instead of ClusterRoles. NatPMPGateways, NatPMPPolicies and
+	// node targets are unavailable, and Namespaces must be set.
+	// +optional
+	Namespaced bool `json:"namespaced,omitempty"`
+}
+
+// Defaults are used for the fields a NatPMP leaves unset.
+type Defaults struct {
+	// Gateway is the address of the gateway of NatPMPs that set neither
+	// gateway nor gatewayRef.
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+
+	// Lifetime is the lifetime in seconds of NatPMPs that set none.
+	// +optional
+	Lifetime int `json:"lifetime,omitempty"`
+}
+
+// Gateway configures the requests to the gateways.
+type Gateway struct {
+	// RequestTimeout bounds each request to a gateway that does not set
+	// its own, zero uses the protocol's own retries.
+	// +optional
+	RequestTimeout metav1.Duration `json:"requestTimeout,omitempty"`
+
+	// RenewalFraction is the fraction of the lifetime of a mapping after
+	// which it is renewed.
+	// +optional
+	RenewalFraction float64 `json:"renewalFraction,omitempty"`
+}
+
+// Templates configures how the templated objects are applied.
+type Templates struct {
+	// ForceOwnership takes over the fields of templated objects that other
+	// managers own.
+	// +optional
+	ForceOwnership *bool `json:"forceOwnership,omitempty"`
+
+	// AllowedKinds are the kinds templates may create, as Kind.group, all
+	// kinds when empty.
+	// +optional
+	AllowedKinds []string `json:"allowedKinds,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ManagerConfig is the configuration file of the manager. Metrics, Health,
+// Debug, LeaderElection and Controller are read at start, the rest is
+// reloaded when the file changes.
+type ManagerConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Metrics configures the metrics endpoint.
+	// +optional
+	Metrics Metrics `json:"metrics,omitempty"`
+
+	// Health configures the health probe endpoint.
+	// +optional
+	Health Health `json:"health,omitempty"`
+
+	// Debug configures the debug endpoint.
+	// +optional
+	Debug Debug `json:"debug,omitempty"`
+
+	// LeaderElection configures the leader election of the manager.
+	// +optional
+	LeaderElection LeaderElection `json:"leaderElection,omitempty"`
+
+	// Controller configures the NatPMP controller.
+	// +optional
+	Controller Controller `json:"controller,omitempty"`
+
+	// Defaults are used for the fields a NatPMP leaves unset.
+	// +optional
+	Defaults Defaults `json:"defaults,omitempty"`
+
+	// Gateway configures the requests to the gateways.
+	// +optional
+	Gateway Gateway `json:"gateway,omitempty"`
+
+	// Templates configures how the templated objects are applied.
+	// +optional
+	Templates Templates `json:"templates,omitempty"`
+}
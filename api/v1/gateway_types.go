@@ -0,0 +1,191 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Backends of a NatPMPGateway.
+const (
+	// BackendAuto uses NAT-PMP for IPv4, falling back to PCP for third
+	// party mappings, and PCP for IPv6.
+	BackendAuto = "Auto"
+
+	// BackendNatPMP only uses NAT-PMP.
+	BackendNatPMP = "NatPMP"
+
+	// BackendPCP only uses PCP.
+	BackendPCP = "PCP"
+)
+
+// Condition types and reasons for NatPMPGateway status conditions.
+const (
+	// ConditionReachable is true when the gateway answered the last probe.
+	ConditionReachable = "Reachable"
+
+	// ReasonProbeSucceeded is set when the gateway answered the probe.
+	ReasonProbeSucceeded = "ProbeSucceeded"
+
+	// ReasonProbeFailed is set when the gateway did not answer the probe.
+	ReasonProbeFailed = "ProbeFailed"
+
+	// ReasonGatewayUnavailable is set on a NatPMP when its gateway cannot
+	// be resolved.
+	ReasonGatewayUnavailable = "GatewayUnavailable"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	// Start is the first port of the range.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Start int `json:"start"`
+
+	// End is the last port of the range, defaults to Start.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	End int `json:"end,omitempty"`
+}
+
+// RateLimit limits the requests sent to a gateway.
+type RateLimit struct {
+	// RequestsPerSecond is the sustained rate of requests.
+	// +kubebuilder:validation:Minimum=1
+	RequestsPerSecond int `json:"requestsPerSecond"`
+
+	// Burst is the number of requests that may be sent at once, defaults
+	// to RequestsPerSecond.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Burst int `json:"burst,omitempty"`
+}
+
+// NatPMPGatewaySpec defines the desired state of NatPMPGateway.
+type NatPMPGatewaySpec struct {
+	// Address is the IP address of the gateway. When unset the default
+	// gateway of the host the controller runs on is used.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Backend is the protocol spoken to the gateway.
+	// +kubebuilder:validation:Enum=Auto;NatPMP;PCP
+	// +kubebuilder:default=Auto
+	// +optional
+	Backend string `json:"backend,omitempty"`
+
+	// RequestTimeout bounds each request to the gateway, including
+	// retransmissions.
+	// +optional
+	RequestTimeout *metav1.Duration `json:"requestTimeout,omitempty"`
+
+	// ProbeInterval is how often the gateway is probed for its status.
+	// +optional
+	ProbeInterval *metav1.Duration `json:"probeInterval,omitempty"`
+
+	// RateLimit limits the requests sent to the gateway.
+	// +optional
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+
+	// AllowedPortRanges are the external ports NatPMPs may request through
+	// the gateway. All ports are allowed when empty.
+	// +optional
+	AllowedPortRanges []PortRange `json:"allowedPortRanges,omitempty"`
+}
+
+// GatewayMapping is a port mapping held through a NatPMPGateway.
+type GatewayMapping struct {
+	// Namespace is the namespace of the NatPMP.
+	Namespace string `json:"namespace"`
+
+	// Name is the name of the NatPMP.
+	Name string `json:"name"`
+
+	// Protocol is the protocol of the mapping.
+	Protocol string `json:"protocol"`
+
+	// ExternalIP is the external address of the mapping.
+	// +optional
+	ExternalIP string `json:"externalIP,omitempty"`
+
+	// ExternalPort is the external port of the mapping.
+	ExternalPort int `json:"externalPort"`
+
+	// InternalIP is the internal address of the mapping.
+	// +optional
+	InternalIP string `json:"internalIP,omitempty"`
+
+	// InternalPort is the internal port of the mapping.
+	InternalPort int `json:"internalPort"`
+}
+
+// NatPMPGatewayStatus defines the observed state of NatPMPGateway.
+type NatPMPGatewayStatus struct {
+	// Address is the address of the gateway that was probed.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Reachable is true when the gateway answered the last probe.
+	Reachable bool `json:"reachable"`
+
+	// ExternalIP is the external address of the gateway.
+	// +optional
+	ExternalIP string `json:"externalIP,omitempty"`
+
+	// SecondsSinceStartOfEpoch is the gateway's epoch time at the last
+	// contact.
+	// +optional
+	SecondsSinceStartOfEpoch int `json:"secondsSinceStartOfEpoch,omitempty"`
+
+	// LastContact is when the gateway last answered a probe.
+	// +optional
+	LastContact *metav1.Time `json:"lastContact,omitempty"`
+
+	// Mappings are the port mappings currently held through the gateway.
+	// +optional
+	Mappings []GatewayMapping `json:"mappings,omitempty"`
+
+	// Conditions represent the latest available observations of the
+	// resource's state.
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Address",type=string,JSONPath=`.status.address`
+//+kubebuilder:printcolumn:name="External IP",type=string,JSONPath=`.status.externalIP`
+//+kubebuilder:printcolumn:name="Reachable",type=boolean,JSONPath=`.status.reachable`
+
+// NatPMPGateway is the Schema for the natpmpgateways API.
+type NatPMPGateway struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NatPMPGatewaySpec   `json:"spec,omitempty"`
+	Status NatPMPGatewayStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NatPMPGatewayList contains a list of NatPMPGateway.
+type NatPMPGatewayList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NatPMPGateway `json:"items"`
+}
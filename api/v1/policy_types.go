@@ -0,0 +1,84 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReasonPolicyViolation is set on a NatPMP when a NatPMPPolicy forbids it.
+const ReasonPolicyViolation = "PolicyViolation"
+
+// NatPMPPolicySpec defines the limits a NatPMPPolicy places on NatPMPs. Every
+// policy that applies to a NatPMP must allow it.
+type NatPMPPolicySpec struct {
+	// Namespaces are the namespaces the policy applies to, all namespaces
+	// when empty.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// AllowedPortRanges are the external ports that may be mapped, all
+	// ports when empty.
+	// +optional
+	AllowedPortRanges []PortRange `json:"allowedPortRanges,omitempty"`
+
+	// DeniedPortRanges are the external ports that may not be mapped, even
+	// if allowed.
+	// +optional
+	DeniedPortRanges []PortRange `json:"deniedPortRanges,omitempty"`
+
+	// AllowedProtocols are the protocols that may be mapped, all protocols
+	// when empty.
+	// +optional
+	AllowedProtocols []string `json:"allowedProtocols,omitempty"`
+
+	// MaxLifetime is the longest lifetime in seconds a NatPMP may request,
+	// unlimited when zero.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxLifetime int `json:"maxLifetime,omitempty"`
+
+	// MaxMappingsPerNamespace is the most NatPMPs a namespace may hold,
+	// unlimited when zero. The oldest NatPMPs are allowed first.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxMappingsPerNamespace int `json:"maxMappingsPerNamespace,omitempty"`
+
+	// RequiredLabels are the label keys every NatPMP must carry.
+	// +optional
+	RequiredLabels []string `json:"requiredLabels,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// NatPMPPolicy is the Schema for the natpmppolicies API.
+type NatPMPPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec NatPMPPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NatPMPPolicyList contains a list of NatPMPPolicy.
+type NatPMPPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NatPMPPolicy `json:"items"`
+}
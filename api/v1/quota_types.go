@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReasonQuotaExceeded is set on a NatPMP when it would exceed a NatPMPQuota
+// of its namespace.
+const ReasonQuotaExceeded = "QuotaExceeded"
+
+// QuotaUsage counts what the NatPMPs of a namespace use.
+type QuotaUsage struct {
+	// Mappings are the gateway mappings, one for each IP family of every
+	// NatPMP.
+	// +optional
+	Mappings int `json:"mappings"`
+
+	// ExternalPorts are the distinct external ports, a NatPMP that has yet
+	// to be allocated a port counts as one.
+	// +optional
+	ExternalPorts int `json:"externalPorts"`
+}
+
+// NatPMPQuotaSpec defines the limits of a NatPMPQuota.
+type NatPMPQuotaSpec struct {
+	// Mappings is the most gateway mappings the namespace may hold,
+	// unlimited when zero.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Mappings int `json:"mappings,omitempty"`
+
+	// ExternalPorts is the most external ports the namespace may hold,
+	// unlimited when zero.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	ExternalPorts int `json:"externalPorts,omitempty"`
+}
+
+// NatPMPQuotaStatus defines the observed state of NatPMPQuota.
+type NatPMPQuotaStatus struct {
+	// Used is what the NatPMPs of the namespace use.
+	// +optional
+	Used QuotaUsage `json:"used"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:path=natpmpquotas
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Mappings",type=integer,JSONPath=`.status.used.mappings`
+//+kubebuilder:printcolumn:name="Max Mappings",type=integer,JSONPath=`.spec.mappings`
+//+kubebuilder:printcolumn:name="Ports",type=integer,JSONPath=`.status.used.externalPorts`
+//+kubebuilder:printcolumn:name="Max Ports",type=integer,JSONPath=`.spec.externalPorts`
+
+// NatPMPQuota is the Schema for the natpmpquotas API. It limits the NatPMPs
+// of its namespace, the oldest NatPMPs are allowed first.
+type NatPMPQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NatPMPQuotaSpec   `json:"spec,omitempty"`
+	Status NatPMPQuotaStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// NatPMPQuotaList contains a list of NatPMPQuota.
+type NatPMPQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NatPMPQuota `json:"items"`
+}
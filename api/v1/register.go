@@ -28,6 +28,10 @@ const (
 	GroupName = "network.natpmp.jkoelker.github.io"
 	VersionV1 = "v1"
 	Kind      = "NatPMP"
+
+	GatewayKind = "NatPMPGateway"
+	PolicyKind  = "NatPMPPolicy"
+	QuotaKind   = "NatPMPQuota"
 )
 
 // GroupVersion returns the GroupVersion for the natpmp API.
@@ -48,6 +52,12 @@ func AddToScheme(scheme *runtime.Scheme) error {
 		groupVersion,
 		&NatPMP{},
 		&NatPMPList{},
+		&NatPMPGateway{},
+		&NatPMPGatewayList{},
+		&NatPMPPolicy{},
+		&NatPMPPolicyList{},
+		&NatPMPQuota{},
+		&NatPMPQuotaList{},
 	)
 
 	scheme.AddKnownTypes(
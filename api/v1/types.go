@@ -17,27 +17,348 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// Condition types and reasons for NatPMP status conditions.
+const (
+	// ConditionReady is true when the port mapping is held on the gateway.
+	ConditionReady = "Ready"
+
+	// ReasonMapped is set when the port mapping was made.
+	ReasonMapped = "Mapped"
+
+	// ReasonMappingFailed is set when the gateway rejected the mapping.
+	ReasonMappingFailed = "MappingFailed"
+
+	// ReasonTargetUnavailable is set when the target has no address.
+	ReasonTargetUnavailable = "TargetUnavailable"
+
+	// ReasonThirdPartyUnsupported is set when the target is not the
+	// requesting host and the gateway cannot map to other hosts.
+	ReasonThirdPartyUnsupported = "ThirdPartyUnsupported"
+
+	// ReasonWaitingForAgent is set when the mapping is assigned to a node
+	// whose agent does not yet hold it.
+	ReasonWaitingForAgent = "WaitingForAgent"
+
+	// ConditionDNSUpdated indicates the RFC 2136 nameserver holds the
+	// hostnames for the external addresses in DNSAddresses.
+	ConditionDNSUpdated = "DNSUpdated"
+
+	// ReasonUpdated is set when the nameserver accepted the update.
+	ReasonUpdated = "Updated"
+
+	// ReasonUpdateFailed is set when the nameserver update failed.
+	ReasonUpdateFailed = "UpdateFailed"
+
+	// ReasonPortConflict is set when the external port is claimed by
+	// another NatPMP on the same gateway, or no port is free to allocate.
+	ReasonPortConflict = "PortConflict"
+
+	// ReasonPortMismatch is set when the gateway mapped another external
+	// port than requested and the port policy is exact.
+	ReasonPortMismatch = "PortMismatch"
+
+	// ReasonOutsideSchedule is set when the port mapping was released
+	// because no window of the schedule is open.
+	ReasonOutsideSchedule = "OutsideSchedule"
+
+	// ConditionExpired is true once the NatPMP passed its expiry and the
+	// port mapping was released.
+	ConditionExpired = "Expired"
+
+	// ReasonExpired is set when the port mapping was released because the
+	// NatPMP expired.
+	ReasonExpired = "Expired"
+
+	// ConditionSuspended is true while the NatPMP is suspended and its
+	// port mapping released.
+	ConditionSuspended = "Suspended"
+
+	// ReasonSuspended is set when the port mapping was released because
+	// the NatPMP is suspended.
+	ReasonSuspended = "Suspended"
+
+	// ReasonResumed is set when a suspended NatPMP is mapped again.
+	ReasonResumed = "Resumed"
+
+	// ReasonLedgerFailed is set on the warning event recorded when the
+	// port mapping could not be recorded in the ledger.
+	ReasonLedgerFailed = "LedgerFailed"
+)
+
+// AnnotationOnShutdown overrides for a NatPMP what the controller does with
+// its port mappings when the controller shuts down, retain or release.
+const AnnotationOnShutdown = "natpmp.jkoelker.github.io/on-shutdown"
+
+// AnnotationSuspended is set on the templated objects of a suspended
+// NatPMP.
+const AnnotationSuspended = "natpmp.jkoelker.github.io/suspended"
+
+// Shutdown policies of the port mappings.
+const (
+	// OnShutdownRetain leaves the port mappings to expire on the gateway.
+	OnShutdownRetain = "retain"
+
+	// OnShutdownRelease deletes the port mappings from the gateway.
+	OnShutdownRelease = "release"
+)
+
+// Port policies of a NatPMP.
+const (
+	// PortPolicyExact only accepts the requested external port.
+	PortPolicyExact = "exact"
+
+	// PortPolicyPreferred accepts another port while retrying for the
+	// requested one.
+	PortPolicyPreferred = "preferred"
+
+	// PortPolicyAny accepts any port the gateway assigns.
+	PortPolicyAny = "any"
+)
+
+// Target selects the internal host a port mapping points at. Exactly one
+// field may be set.
+type Target struct {
+	// NodeName maps to the internal address of the node.
+	// +optional
+	NodeName string `json:"nodeName,omitempty"`
+
+	// PodSelector maps to the address of a ready pod in the namespace
+	// matching the selector.
+	// +optional
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+
+	// ServiceName maps to the address of a ready endpoint of the Service
+	// in the namespace.
+	// +optional
+	ServiceName string `json:"serviceName,omitempty"`
+
+	// InternalIP maps to the address.
+	// +optional
+	InternalIP string `json:"internalIP,omitempty"`
+
+	// HysteresisSeconds is how long the node a PodSelector or ServiceName
+	// mapping points at may go without a ready backend before the mapping
+	// moves to another node. Zero moves it immediately.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	HysteresisSeconds int `json:"hysteresisSeconds,omitempty"`
+}
+
+// AddressTarget is an Ingress or Gateway in the namespace of the NatPMP whose
+// status publishes the external address of the mapping.
+type AddressTarget struct {
+	// Kind is the kind of the object, Ingress or Gateway.
+	// +kubebuilder:validation:Enum=Ingress;Gateway
+	Kind string `json:"kind"`
+
+	// Name is the name of the object.
+	Name string `json:"name"`
+}
+
+// DNS are the hostnames pointed at the external address of the mapping.
+type DNS struct {
+	// Hostnames are the fully qualified names to publish.
+	// +kubebuilder:validation:MinItems=1
+	Hostnames []string `json:"hostnames"`
+
+	// TTL is the time to live of the records in seconds.
+	// +kubebuilder:default=300
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	TTL int64 `json:"ttl,omitempty"`
+
+	// RFC2136 updates the records on a nameserver directly with dynamic
+	// updates. The records are removed again when the mapping is released
+	// or the NatPMP is deleted. When unset an ExternalDNS DNSEndpoint is
+	// created instead.
+	// +optional
+	RFC2136 *RFC2136 `json:"rfc2136,omitempty"`
+}
+
+// RFC2136 is a nameserver accepting dynamic updates.
+type RFC2136 struct {
+	// Server is the address of the nameserver, as host:port.
+	Server string `json:"server"`
+
+	// Zone is the zone the hostnames are updated in.
+	Zone string `json:"zone"`
+
+	// TSIGKeyName is the name of the key updates are signed with.
+	// +optional
+	TSIGKeyName string `json:"tsigKeyName,omitempty"`
+
+	// TSIGAlgorithm is the HMAC algorithm of the key.
+	// +kubebuilder:validation:Enum=hmac-sha1;hmac-sha224;hmac-sha256;hmac-sha384;hmac-sha512
+	// +kubebuilder:default=hmac-sha256
+	// +optional
+	TSIGAlgorithm string `json:"tsigAlgorithm,omitempty"`
+
+	// TSIGSecretRef is the key in a Secret in the namespace of the NatPMP
+	// holding the base64 encoded TSIG secret.
+	// +optional
+	TSIGSecretRef *corev1.SecretKeySelector `json:"tsigSecretRef,omitempty"`
+}
+
+// Window opens the mapping on the given weekdays between two times of day.
+type Window struct {
+	// Days are the weekdays the window opens on, every day if empty.
+	// +optional
+	Days []Weekday `json:"days,omitempty"`
+
+	// Start is the time of day the window opens, as HH:MM.
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	Start string `json:"start"`
+
+	// End is the time of day the window closes, as HH:MM. An end at or
+	// before the start closes the window the next day.
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	End string `json:"end"`
+}
+
+// Weekday is a day of the week.
+// +kubebuilder:validation:Enum=Sunday;Monday;Tuesday;Wednesday;Thursday;Friday;Saturday
+type Weekday string
+
+// CronWindow opens the mapping at each time matched by a cron expression.
+type CronWindow struct {
+	// Open is the standard five field cron expression the window opens
+	// at, or a descriptor such as @daily.
+	Open string `json:"open"`
+
+	// Duration is how long the window stays open.
+	Duration metav1.Duration `json:"duration"`
+}
+
+// Schedule limits the mapping to time windows. The mapping is open while any
+// window is.
+type Schedule struct {
+	// TimeZone is the IANA time zone the windows are in, UTC if empty.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Windows are the weekday time windows.
+	// +optional
+	Windows []Window `json:"windows,omitempty"`
+
+	// Cron are the windows opened by cron expressions.
+	// +optional
+	Cron []CronWindow `json:"cron,omitempty"`
+}
+
 // NatPMPSpec defines the desired state of NatPMP.
 type NatPMPSpec struct {
-	// ExternalPort is the requested external port number to map.
+	// ExternalPort is the requested external port number to map. Zero
+	// allocates a free port from ExternalPortRange, the allowed ports of
+	// the NatPMPGateway, or the unprivileged ports, in that order.
 	ExternalPort int `json:"externalPort"`
 
+	// PortPolicy is how a mapping on another external port than requested
+	// is handled. With exact the mapping is released and retried, with
+	// preferred it is kept while the requested port is asked for on every
+	// renewal, and with any it is kept.
+	// +kubebuilder:validation:Enum=exact;preferred;any
+	// +kubebuilder:default=any
+	// +optional
+	PortPolicy string `json:"portPolicy,omitempty"`
+
+	// ExternalPortRange is the range a port is allocated from when
+	// ExternalPort is zero.
+	// +optional
+	ExternalPortRange *PortRange `json:"externalPortRange,omitempty"`
+
 	// InternalPort is the internal port number that the external port maps to.
 	InternalPort int `json:"internalPort"`
 
 	// Lifetime is the duration in seconds for which the port mapping should
-	// be active.
-	Lifetime int `json:"lifetime"`
+	// be active. Zero uses the default lifetime of the manager.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Lifetime int `json:"lifetime,omitempty"`
+
+	// ExpiresAt is when the port mapping is closed for good. Each requested
+	// lifetime is capped so the mapping never outlives it.
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// TTL closes the port mapping this long after the NatPMP was created.
+	// The earlier of ExpiresAt and TTL applies.
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
 
-	// Gateway is the address or identifier of the NAT-PMP gateway.
-	Gateway string `json:"gateway"`
+	// DeleteOnExpiry deletes the NatPMP, and with it the templated
+	// objects, once it expires.
+	// +optional
+	DeleteOnExpiry bool `json:"deleteOnExpiry,omitempty"`
+
+	// Gateway is the address or identifier of the NAT-PMP gateway. Exactly
+	// one of Gateway and GatewayRef must be set, unless the manager has a
+	// default gateway.
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+
+	// GatewayRef is the name of the NatPMPGateway to map the port through.
+	// +optional
+	GatewayRef string `json:"gatewayRef,omitempty"`
 
 	// Protocol is the protocol for the port mapping (TCP/UDP).
 	Protocol string `json:"protocol"`
 
+	// IPFamilies are the address families to map the port for. IPv4
+	// mappings are made with NAT-PMP and IPv6 mappings open a firewall
+	// pinhole with PCP, where the external address is the internal address
+	// of the host. Defaults to IPv4.
+	// +optional
+	// +kubebuilder:validation:MaxItems=2
+	IPFamilies []corev1.IPFamily `json:"ipFamilies,omitempty"`
+
+	// IPv6Gateway is the address of the PCP server used for IPv6 mappings.
+	// Defaults to Gateway when it is an IPv6 address.
+	// +optional
+	IPv6Gateway string `json:"ipv6Gateway,omitempty"`
+
+	// Target is the internal host the port is mapped to. Mappings to hosts
+	// other than the one the controller runs on use the PCP THIRD_PARTY
+	// option. Defaults to the host the controller runs on.
+	// +optional
+	Target *Target `json:"target,omitempty"`
+
+	// PublishAddressTo are the Ingresses and Gateways whose status gets the
+	// external address of the mapping alongside the addresses written by
+	// their controller, when the controller is run with address publishing
+	// enabled. The address is removed again once the mapping is released.
+	// +optional
+	PublishAddressTo []AddressTarget `json:"publishAddressTo,omitempty"`
+
+	// DNS publishes hostnames for the external address of the mapping.
+	// +optional
+	DNS *DNS `json:"dns,omitempty"`
+
+	// AllowedSourceCIDRs limits the clients that may reach the mapped
+	// port. The controller manages a NetworkPolicy selecting the backend
+	// pods of a PodSelector or ServiceName target, and sets
+	// loadBalancerSourceRanges and the Local external traffic policy on a
+	// NodePort or LoadBalancer ServiceName target. The NetworkPolicy only
+	// limits the internal port, though it denies the pods ingress of
+	// protocols without ports, such as ICMP, from outside the cluster. The
+	// Service fields are not set when its owner set them to other values.
+	// +optional
+	AllowedSourceCIDRs []string `json:"allowedSourceCIDRs,omitempty"`
+
+	// Schedule only holds the port mapping inside its windows, releasing
+	// it outside of them.
+	// +optional
+	Schedule *Schedule `json:"schedule,omitempty"`
+
+	// Suspend releases the port mapping and stops renewing it while true,
+	// keeping the external port claimed and the templated objects in
+	// place.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
 	// Templates is the raw templates that will be used to create or update
 	// resources via server-side apply. Each template must be a valid
 	// Kubernetes YAML or JSON document. The templates will be applied in
@@ -48,7 +369,10 @@ type NatPMPSpec struct {
 	//   * .Spec.Protocol
 	//   * .Spec.Gateway
 	//   * .Spec.Lifetime
+	//   * .Spec.Suspend
 	//   * .Status.ExternalIP
+	//   * .Status.ExternalIPv4
+	//   * .Status.ExternalIPv6
 	//   * .Status.MappedInternalPort
 	//   * .Status.MappedExternalPort
 	//   * .Status.MappedLifetime
@@ -56,7 +380,52 @@ type NatPMPSpec struct {
 	Templates []string `json:"templates"`
 }
 
-// NatPMPStatus defines the observed state of NatPMP.
+// MappingStatus is the observed state of the port mapping for an IP family.
+type MappingStatus struct {
+	// IPFamily is the address family of the mapping.
+	IPFamily corev1.IPFamily `json:"ipFamily"`
+
+	// ExternalIP is the external IP address of the mapping.
+	ExternalIP string `json:"externalIP,omitempty"`
+
+	// InternalIP is the internal IP address of the mapping, if known.
+	InternalIP string `json:"internalIP,omitempty"`
+
+	// MappedInternalPort is the internal port number that the external port maps to.
+	MappedInternalPort int `json:"mappedInternalPort,omitempty"`
+
+	// MappedExternalPort is the external port number that was successfully
+	// mapped.
+	MappedExternalPort int `json:"mappedExternalPort,omitempty"`
+
+	// MappedLifetime is the duration in seconds for which the port mapping
+	// will be active.
+	MappedLifetime int `json:"mappedLifetime,omitempty"`
+
+	// SecondsSinceStartOfEpoch is the number of seconds since the start of
+	// the epoch.
+	SecondsSinceStartOfEpoch int `json:"secondsSinceStartOfEpoch,omitempty"`
+}
+
+// DNSStatus is the RFC 2136 nameserver and the hostnames updated on it.
+type DNSStatus struct {
+	// RFC2136 is the nameserver the hostnames were updated on.
+	RFC2136 RFC2136 `json:"rfc2136"`
+
+	// Hostnames are the hostnames pointed at DNSAddresses.
+	Hostnames []string `json:"hostnames"`
+}
+
+// PublishedAddresses are the addresses published to an AddressTarget.
+type PublishedAddresses struct {
+	AddressTarget `json:",inline"`
+
+	// Addresses are the addresses written into the status of the object.
+	Addresses []string `json:"addresses"`
+}
+
+// NatPMPStatus defines the observed state of NatPMP. The top level mapping
+// fields mirror the first entry of Mappings.
 type NatPMPStatus struct {
 	// ExternalIP is the external IP address of the gateway.
 	ExternalIP string `json:"externalIP,omitempty"`
@@ -76,6 +445,73 @@ type NatPMPStatus struct {
 	// the epoch.
 	SecondsSinceStartOfEpoch int `json:"secondsSinceStartOfEpoch,omitempty"`
 
+	// RenewedAt is when the port mapping was last requested from the
+	// gateway.
+	// +optional
+	RenewedAt *metav1.Time `json:"renewedAt,omitempty"`
+
+	// ExpiresAt is when the port mapping expires on the gateway unless it
+	// is renewed.
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// NextOpen is when the schedule next opens the port mapping.
+	// +optional
+	NextOpen *metav1.Time `json:"nextOpen,omitempty"`
+
+	// NextClose is when the schedule next closes the port mapping.
+	// +optional
+	NextClose *metav1.Time `json:"nextClose,omitempty"`
+
+	// AllocatedExternalPort is the external port allocated to the NatPMP
+	// when ExternalPort is zero. It is kept across restarts so the port
+	// stays stable.
+	// +optional
+	AllocatedExternalPort int `json:"allocatedExternalPort,omitempty"`
+
+	// Nonce is the hex encoded PCP mapping nonce. It is generated before
+	// the first request and kept for the lifetime of the NatPMP, since PCP
+	// gateways only renew or delete a mapping with the nonce it was
+	// created with.
+	// +optional
+	Nonce string `json:"nonce,omitempty"`
+
+	// ActiveNode is the node of the backend the port mapping points at.
+	// When mappings are delegated to node agents, the agent on this node
+	// should hold the port mapping.
+	// +optional
+	ActiveNode string `json:"activeNode,omitempty"`
+
+	// ActiveNodeUnreadySince is when the active node lost its last ready
+	// backend, unset while it has one.
+	// +optional
+	ActiveNodeUnreadySince *metav1.Time `json:"activeNodeUnreadySince,omitempty"`
+
+	// MappedNode is the node whose agent holds the port mapping.
+	// +optional
+	MappedNode string `json:"mappedNode,omitempty"`
+
+	// Mappings are the port mappings for each IP family.
+	// +optional
+	// +listType=map
+	// +listMapKey=ipFamily
+	Mappings []MappingStatus `json:"mappings,omitempty"`
+
+	// DNSAddresses are the addresses last sent to the RFC 2136 nameserver.
+	// +optional
+	DNSAddresses []string `json:"dnsAddresses,omitempty"`
+
+	// DNS is the RFC 2136 nameserver and hostnames last updated, so their
+	// records can be removed once they are dropped from the spec or the
+	// mapping is released.
+	// +optional
+	DNS *DNSStatus `json:"dns,omitempty"`
+
+	// Published are the addresses last written into the status of the
+	// PublishAddressTo objects, so they can be removed again.
+	// +optional
+	Published []PublishedAddresses `json:"published,omitempty"`
+
 	// Conditions represent the latest available observations of the
 	// resource's state.
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
@@ -0,0 +1,187 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/controller"
+	"github.com/jkoelker/natpmp-controller/pkg/settings"
+)
+
+// agentFlags are the command line flags of the agent.
+type agentFlags struct {
+	nodeName    string
+	metricsAddr string
+	probeAddr   string
+	onShutdown  string
+	configFile  string
+}
+
+// parseAgentFlags parses the command line flags of the agent and sets up the
+// logger.
+func parseAgentFlags(args []string) *agentFlags {
+	var agentFlags agentFlags
+
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+
+	flags.StringVar(
+		&agentFlags.nodeName,
+		"node-name",
+		os.Getenv("NODE_NAME"),
+		"The name of the node the agent runs on.",
+	)
+
+	flags.StringVar(
+		&agentFlags.metricsAddr,
+		"metrics-bind-address",
+		"0",
+		"The address the metric endpoint binds to.",
+	)
+
+	flags.StringVar(
+		&agentFlags.probeAddr,
+		"health-probe-bind-address",
+		":8091",
+		"The address the probe endpoint binds to.",
+	)
+
+	flags.StringVar(
+		&agentFlags.onShutdown,
+		"on-shutdown",
+		networkv1.OnShutdownRetain,
+		"What to do with the held port mappings on shutdown, retain to let them "+
+			"expire or release to delete them. NatPMPs may override it with the "+
+			networkv1.AnnotationOnShutdown+" annotation.",
+	)
+
+	flags.StringVar(
+		&agentFlags.configFile,
+		"config",
+		"",
+		"The configuration file of the manager, for the defaults, gateway and "+
+			"templates options.",
+	)
+
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(flags)
+
+	// ExitOnError handles parse failures.
+	_ = flags.Parse(args)
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	return &agentFlags
+}
+
+// setupAgent registers the agent reconciler, its shutdown release and its
+// probes with the manager.
+func setupAgent(mgr ctrl.Manager, flags *agentFlags, store *settings.Store, progress *controller.Progress) error {
+	agentReconciler := &controller.AgentReconciler{
+		NatPMPReconciler: controller.NatPMPReconciler{
+			Client:     mgr.GetClient(),
+			Scheme:     mgr.GetScheme(),
+			APIReader:  mgr.GetAPIReader(),
+			Recorder:   mgr.GetEventRecorderFor("natpmp-agent"),
+			OnShutdown: flags.onShutdown,
+			Settings:   store,
+			Progress:   progress,
+		},
+		NodeName: flags.nodeName,
+	}
+
+	if err := agentReconciler.SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create Agent controller: %w", err)
+	}
+
+	if err := mgr.Add(agentReconciler.ShutdownReleaser()); err != nil {
+		return fmt.Errorf("unable to set up shutdown release: %w", err)
+	}
+
+	if err := mgr.AddHealthzCheck("reconcile", progress.Check); err != nil {
+		return fmt.Errorf("unable to set up health check: %w", err)
+	}
+
+	if err := mgr.AddReadyzCheck("informers", controller.CacheSynced(mgr.GetCache())); err != nil {
+		return fmt.Errorf("unable to set up ready check: %w", err)
+	}
+
+	return nil
+}
+
+// agent runs the node-local agent that holds the mappings the manager
+// assigns to the node. It must run on the host network so that requests
+// originate from the node's address.
+func agent(args []string) {
+	setupLog := ctrl.Log.WithName("setup")
+	flags := parseAgentFlags(args)
+
+	if err := controller.ValidateOnShutdown(flags.onShutdown); err != nil {
+		setupLog.Error(err, "invalid --on-shutdown")
+		os.Exit(1)
+	}
+
+	if flags.nodeName == "" {
+		setupLog.Info("--node-name or NODE_NAME must be set")
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig(flags.configFile)
+	if err != nil {
+		setupLog.Error(err, "unable to load configuration")
+		os.Exit(1)
+	}
+
+	store := settings.NewStore(flags.configFile, cfg)
+	progress := &controller.Progress{Timeout: cfg.Health.StallTimeout.Duration}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:                 newScheme(),
+		Metrics:                metricsserver.Options{BindAddress: flags.metricsAddr},
+		HealthProbeBindAddress: flags.probeAddr,
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to start agent")
+		os.Exit(1)
+	}
+
+	if err = mgr.Add(store); err != nil {
+		setupLog.Error(err, "unable to set up configuration reload")
+		os.Exit(1)
+	}
+
+	if err = setupAgent(mgr, flags, store, progress); err != nil {
+		setupLog.Error(err, "unable to set up agent")
+		os.Exit(1)
+	}
+
+	setupLog.Info("starting agent", "node", flags.nodeName)
+
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		setupLog.Error(err, "problem running agent")
+		os.Exit(1)
+	}
+}
@@ -18,60 +18,377 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"strings"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
+	configv1alpha1 "github.com/jkoelker/natpmp-controller/api/config/v1alpha1"
 	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
 	"github.com/jkoelker/natpmp-controller/pkg/controller"
+	"github.com/jkoelker/natpmp-controller/pkg/settings"
 )
 
-const (
-	LeaderElectionID = "6ebc5733.natpmp.jkoelker.github.io"
-)
-
-func main() {
+func newScheme() *runtime.Scheme {
 	scheme := runtime.NewScheme()
-	setupLog := ctrl.Log.WithName("setup")
 
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(networkv1.AddToScheme(scheme))
 
-	var metricsAddr string
+	return scheme
+}
+
+// splitList returns the non-empty items of a comma separated list.
+func splitList(list string) []string {
+	var items []string
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// managerFlags are the command line flags of the manager.
+type managerFlags struct {
+	configFile           string
+	metricsAddr          string
+	probeAddr            string
+	debugAddr            string
+	debugTokenFile       string
+	enableLeaderElection bool
+	leaderElectionID     string
+	watchNamespaces      string
+	selector             string
+	gateways             string
+	namespaced           bool
+	delegateToAgents     bool
+	publishAddresses     bool
+	onShutdown           string
+	ledgerNamespace      string
+}
 
+// bindServerFlags binds the flags of the configuration file, the endpoints
+// and leader election.
+func bindServerFlags(flags *managerFlags) {
 	flag.StringVar(
-		&metricsAddr,
+		&flags.configFile,
+		"config",
+		"",
+		"The configuration file of the manager. Flags set on the command line "+
+			"override the file.",
+	)
+
+	flag.StringVar(
+		&flags.metricsAddr,
 		"metrics-bind-address",
-		":8080",
+		settings.DefaultMetricsBindAddress,
 		"The address the metric endpoint binds to.",
 	)
 
-	var probeAddr string
-
 	flag.StringVar(
-		&probeAddr,
+		&flags.probeAddr,
 		"health-probe-bind-address",
-		":8081",
+		settings.DefaultHealthBindAddress,
 		"The address the probe endpoint binds to.",
 	)
 
-	var enableLeaderElection bool
+	flag.StringVar(
+		&flags.debugAddr,
+		"debug-bind-address",
+		"",
+		"The address the debug endpoint listing the held mappings binds to, "+
+			"disabled when empty.",
+	)
+
+	flag.StringVar(
+		&flags.debugTokenFile,
+		"debug-token-file",
+		"",
+		"The file holding the bearer token required by the debug endpoint. "+
+			"Without it the endpoint is read only and open.",
+	)
 
 	flag.BoolVar(
-		&enableLeaderElection,
+		&flags.enableLeaderElection,
 		"leader-elect",
 		false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.",
 	)
 
+	flag.StringVar(
+		&flags.leaderElectionID,
+		"leader-election-id",
+		settings.DefaultLeaderElectionID,
+		"The name of the leader election lease. Managers handling different "+
+			"NatPMPs in the same namespace need different IDs.",
+	)
+}
+
+// bindControllerFlags binds the flags of the NatPMP controller.
+func bindControllerFlags(flags *managerFlags) {
+	flag.StringVar(
+		&flags.watchNamespaces,
+		"watch-namespaces",
+		"",
+		"A comma separated list of the namespaces whose NatPMPs are reconciled, "+
+			"all namespaces when empty.",
+	)
+
+	flag.StringVar(
+		&flags.selector,
+		"selector",
+		"",
+		"The label selector of the NatPMPs that are reconciled, all NatPMPs when empty.",
+	)
+
+	flag.StringVar(
+		&flags.gateways,
+		"gateways",
+		"",
+		"A comma separated list of the gateways whose NatPMPs are reconciled, as "+
+			"addresses, CIDRs or NatPMPGateway names, all gateways when empty. Each "+
+			"set of gateways elects its own leader.",
+	)
+
+	flag.BoolVar(
+		&flags.namespaced,
+		"namespaced",
+		false,
+		"Only read namespaced resources so the manager runs with Roles instead of "+
+			"ClusterRoles. NatPMPGateways, NatPMPPolicies and node targets are "+
+			"unavailable, and --watch-namespaces must be set.",
+	)
+
+	flag.BoolVar(
+		&flags.delegateToAgents,
+		"delegate-to-agents",
+		false,
+		"Assign mappings with a target on a node to the agent running on that node "+
+			"instead of requesting them from the manager's node.",
+	)
+
+	flag.BoolVar(
+		&flags.publishAddresses,
+		"publish-addresses",
+		false,
+		"Write the external address of NatPMPs into the status of the Ingresses "+
+			"and Gateways they reference.",
+	)
+
+	flag.StringVar(
+		&flags.onShutdown,
+		"on-shutdown",
+		networkv1.OnShutdownRetain,
+		"What to do with the held port mappings on shutdown, retain to let them "+
+			"expire or release to delete them. NatPMPs may override it with the "+
+			networkv1.AnnotationOnShutdown+" annotation.",
+	)
+
+	flag.StringVar(
+		&flags.ledgerNamespace,
+		"ledger-namespace",
+		os.Getenv("POD_NAMESPACE"),
+		"The namespace of the ConfigMaps recording the port mappings held on each "+
+			"gateway, used to release mappings whose NatPMP was deleted. Empty disables the record.",
+	)
+}
+
+// loadConfig returns the configuration in the file, the defaults when the
+// path is empty.
+func loadConfig(path string) (*configv1alpha1.ManagerConfig, error) {
+	if path == "" {
+		return settings.Defaults(), nil
+	}
+
+	cfg, err := settings.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load configuration %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// managerConfig returns the configuration of the file with the flags set on
+// the command line applied over it.
+func managerConfig(flags *managerFlags) (*configv1alpha1.ManagerConfig, error) {
+	cfg, err := loadConfig(flags.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "metrics-bind-address":
+			cfg.Metrics.BindAddress = flags.metricsAddr
+		case "health-probe-bind-address":
+			cfg.Health.BindAddress = flags.probeAddr
+		case "debug-bind-address":
+			cfg.Debug.BindAddress = flags.debugAddr
+		case "debug-token-file":
+			cfg.Debug.TokenFile = flags.debugTokenFile
+		case "leader-elect":
+			cfg.LeaderElection.LeaderElect = &flags.enableLeaderElection
+		case "leader-election-id":
+			cfg.LeaderElection.ResourceName = flags.leaderElectionID
+		case "watch-namespaces":
+			cfg.Controller.Namespaces = splitList(flags.watchNamespaces)
+		case "selector":
+			cfg.Controller.Selector = flags.selector
+		case "gateways":
+			cfg.Controller.Gateways = splitList(flags.gateways)
+		case "namespaced":
+			cfg.Controller.Namespaced = flags.namespaced
+		}
+	})
+
+	if errs := settings.Validate(cfg); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration: %w", errs.ToAggregate())
+	}
+
+	return cfg, nil
+}
+
+// setupControllers registers the controllers, webhooks and runnables of the
+// manager, returning the NatPMP reconciler.
+func setupControllers(
+	mgr ctrl.Manager,
+	cfg *configv1alpha1.ManagerConfig,
+	flags *managerFlags,
+	store *settings.Store,
+	shard *settings.Shard,
+	progress *controller.Progress,
+	webhooks bool,
+) (*controller.NatPMPReconciler, error) {
+	var ledger *controller.Ledger
+
+	if flags.ledgerNamespace != "" {
+		ledger = &controller.Ledger{
+			Client:    mgr.GetClient(),
+			Namespace: flags.ledgerNamespace,
+			Reader:    mgr.GetAPIReader(),
+			Shard:     shard,
+		}
+
+		if err := ledger.SetupWithManager(mgr); err != nil {
+			return nil, fmt.Errorf("unable to set up ledger: %w", err)
+		}
+	}
+
+	natpmpReconciler := &controller.NatPMPReconciler{
+		Client:           mgr.GetClient(),
+		Scheme:           mgr.GetScheme(),
+		APIReader:        mgr.GetAPIReader(),
+		DelegateToAgents: flags.delegateToAgents,
+		Recorder:         mgr.GetEventRecorderFor("natpmp-controller"),
+		OnShutdown:       flags.onShutdown,
+		Ledger:           ledger,
+		Settings:         store,
+		Namespaced:       cfg.Controller.Namespaced,
+		Shard:            shard,
+		Progress:         progress,
+	}
+
+	if err := natpmpReconciler.SetupWithManager(mgr); err != nil {
+		return nil, fmt.Errorf("unable to create NatPMP controller: %w", err)
+	}
+
+	if err := mgr.Add(natpmpReconciler.ShutdownReleaser()); err != nil {
+		return nil, fmt.Errorf("unable to set up shutdown release: %w", err)
+	}
+
+	if webhooks {
+		validator := &controller.NatPMPValidator{Reader: mgr.GetClient(), Settings: store}
+		if err := validator.SetupWebhookWithManager(mgr); err != nil {
+			return nil, fmt.Errorf("unable to create NatPMP webhook: %w", err)
+		}
+	}
+
+	// NatPMPGateways are cluster-scoped.
+	if !cfg.Controller.Namespaced {
+		gatewayReconciler := &controller.NatPMPGatewayReconciler{Client: mgr.GetClient(), Shard: shard}
+		if err := gatewayReconciler.SetupWithManager(mgr); err != nil {
+			return nil, fmt.Errorf("unable to create NatPMPGateway controller: %w", err)
+		}
+	}
+
+	quotaReconciler := &controller.NatPMPQuotaReconciler{Client: mgr.GetClient()}
+	if err := quotaReconciler.SetupWithManager(mgr); err != nil {
+		return nil, fmt.Errorf("unable to create NatPMPQuota controller: %w", err)
+	}
+
+	if flags.publishAddresses {
+		publisher := &controller.AddressPublisher{Client: mgr.GetClient()}
+		if err := publisher.SetupWithManager(mgr); err != nil {
+			return nil, fmt.Errorf("unable to create AddressPublisher controller: %w", err)
+		}
+	}
+
+	err := mgr.Add(&controller.DebugServer{
+		Addr:       cfg.Debug.BindAddress,
+		TokenFile:  cfg.Debug.TokenFile,
+		Reconciler: natpmpReconciler,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up debug endpoint: %w", err)
+	}
+
+	return natpmpReconciler, nil
+}
+
+// newProbes returns the probe server of the manager. The probe server of
+// the manager only reports whether a check passed and does not start until
+// the caches sync, so the probes have their own.
+func newProbes(
+	mgr ctrl.Manager,
+	cfg *configv1alpha1.ManagerConfig,
+	natpmpReconciler *controller.NatPMPReconciler,
+	progress *controller.Progress,
+) (*controller.ProbeServer, error) {
+	gatewayHealth := &controller.GatewayHealth{Reconciler: natpmpReconciler}
+	if err := mgr.Add(gatewayHealth); err != nil {
+		return nil, fmt.Errorf("unable to set up gateway health: %w", err)
+	}
+
+	return &controller.ProbeServer{
+		Addr: cfg.Health.BindAddress,
+		Liveness: map[string]healthz.Checker{
+			"ping":      healthz.Ping,
+			"reconcile": progress.Check,
+		},
+		Readiness: map[string]healthz.Checker{
+			"informers": controller.CacheSynced(mgr.GetCache()),
+			"gateways":  gatewayHealth.Check,
+		},
+		Details: map[string]http.Handler{
+			"gateways": gatewayHealth,
+		},
+	}, nil
+}
+
+// parseFlags parses the command line flags of the manager and sets up the
+// logger.
+func parseFlags() *managerFlags {
+	var flags managerFlags
+
+	bindServerFlags(&flags)
+	bindControllerFlags(&flags)
+
 	opts := zap.Options{
 		Development: true,
 	}
@@ -81,40 +398,116 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:                        scheme,
-		Metrics:                       metricsserver.Options{BindAddress: metricsAddr},
-		HealthProbeBindAddress:        probeAddr,
-		LeaderElection:                enableLeaderElection,
-		LeaderElectionID:              LeaderElectionID,
+	return &flags
+}
+
+// managerOptions returns the options of the manager for the configuration.
+func managerOptions(
+	cfg *configv1alpha1.ManagerConfig,
+	cacheOpts cache.Options,
+	shard *settings.Shard,
+) ctrl.Options {
+	return ctrl.Options{
+		Scheme:                        newScheme(),
+		Metrics:                       metricsserver.Options{BindAddress: cfg.Metrics.BindAddress},
+		LeaderElection:                *cfg.LeaderElection.LeaderElect,
+		LeaderElectionID:              shard.LeaderElectionID(cfg.LeaderElection.ResourceName),
 		LeaderElectionReleaseOnCancel: true,
-	})
+		Cache:                         cacheOpts,
+		Client: client.Options{
+			Cache: &client.CacheOptions{
+				// The ledger is the only user of ConfigMaps, so do not
+				// cache every ConfigMap in the cluster for it.
+				DisableFor: []client.Object{&corev1.ConfigMap{}},
+			},
+		},
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		agent(os.Args[2:])
+
+		return
+	}
+
+	setupLog := ctrl.Log.WithName("setup")
+	flags := parseFlags()
+
+	if err := controller.ValidateOnShutdown(flags.onShutdown); err != nil {
+		setupLog.Error(err, "invalid --on-shutdown")
+		os.Exit(1)
+	}
+
+	cfg, err := managerConfig(flags)
+	if err != nil {
+		setupLog.Error(err, "unable to configure manager")
+		os.Exit(1)
+	}
+
+	webhooks := os.Getenv("ENABLE_WEBHOOKS") == "true"
+
+	if cfg.Controller.Namespaced && (flags.delegateToAgents || webhooks) {
+		setupLog.Info("a namespaced manager supports neither agents nor webhooks")
+		os.Exit(1)
+	}
+
+	// NatPMPPolicies are cluster-scoped, so a namespaced manager cannot
+	// read them.
+	if cfg.Controller.Namespaced {
+		setupLog.Info("NatPMPPolicies are not enforced by a namespaced manager")
+	}
+
+	cacheOpts, err := settings.CacheOptions(cfg)
+	if err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+
+	shard, err := settings.NewShard(cfg.Controller.Gateways)
+	if err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+
+	store := settings.NewStore(flags.configFile, cfg)
+	progress := &controller.Progress{Timeout: cfg.Health.StallTimeout.Duration}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), managerOptions(cfg, cacheOpts, shard))
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	if err = (&controller.NatPMPReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "NatPMP")
+	if err = mgr.Add(store); err != nil {
+		setupLog.Error(err, "unable to set up configuration reload")
 		os.Exit(1)
 	}
 
-	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
-		setupLog.Error(err, "unable to set up health check")
+	natpmpReconciler, err := setupControllers(mgr, cfg, flags, store, shard, progress, webhooks)
+	if err != nil {
+		setupLog.Error(err, "unable to set up controllers")
 		os.Exit(1)
 	}
 
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
-		setupLog.Error(err, "unable to set up ready check")
+	probes, err := newProbes(mgr, cfg, natpmpReconciler, progress)
+	if err != nil {
+		setupLog.Error(err, "unable to set up health probes")
 		os.Exit(1)
 	}
 
+	ctx := ctrl.SetupSignalHandler()
+
+	go func() {
+		if err := probes.Start(ctx); err != nil {
+			setupLog.Error(err, "problem running health probes")
+			os.Exit(1)
+		}
+	}()
+
 	setupLog.Info("starting manager")
 
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
@@ -0,0 +1,274 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+// agentFinalizer holds a NatPMP while an agent holds its port mapping, since
+// only the node that made a mapping can delete it on the gateway.
+const agentFinalizer = "natpmp.jkoelker.github.io/agent"
+
+// AgentReconciler holds the port mappings the manager assigned to the node it
+// runs on. Since the source address of a request decides the internal host of
+// a NAT-PMP mapping, the agent runs on the host network of every node.
+type AgentReconciler struct {
+	NatPMPReconciler
+
+	// NodeName is the node the agent runs on.
+	NodeName string
+}
+
+// Reconcile maps the port when the NatPMP is assigned to the node and
+// releases it when the mapping moves to another node or the NatPMP is
+// deleted. The NatPMP keeps the agent finalizer while the node holds the
+// mapping, so it is not deleted before the mapping is released.
+func (reconciler *AgentReconciler) Reconcile(
+	ctx context.Context,
+	req ctrl.Request,
+) (ctrl.Result, error) {
+	defer reconciler.Progress.Track()()
+
+	start := reconciler.now()
+
+	var natpmpCR networkv1.NatPMP
+	if err := reconciler.Get(ctx, req.NamespacedName, &natpmpCR); err != nil {
+		if errors.IsNotFound(err) {
+			reconciler.leases.Forget(req.NamespacedName)
+
+			return ctrl.Result{}, nil
+		}
+
+		return ctrl.Result{}, WrapError(ctx, err, "unable to fetch NatPMP")
+	}
+
+	config, err := reconciler.ResolveGateway(ctx, natpmpCR)
+	if err != nil {
+		return ctrl.Result{}, WrapError(ctx, err, "unable to resolve gateway")
+	}
+
+	addresses, protocol, errs := ValidateNatPMP(reconciler.Defaulted(natpmpCR), config)
+	if len(errs) > 0 {
+		gvk := networkv1.GroupVersionKind()
+		err := errors.NewInvalid(gvk.GroupKind(), natpmpCR.Name, errs)
+
+		return ctrl.Result{}, WrapError(ctx, err, "invalid NatPMP")
+	}
+
+	gateways := reconciler.gatewayClients(natpmpCR, addresses, config)
+
+	status := natpmpCR.Status
+
+	switch {
+	// Wait for the previous node to release the mapping before taking it.
+	case natpmpCR.DeletionTimestamp.IsZero() &&
+		!natpmpCR.Spec.Suspend && !Expired(natpmpCR, start) &&
+		status.ActiveNode == reconciler.NodeName &&
+		(status.MappedNode == "" || status.MappedNode == reconciler.NodeName):
+		return reconciler.hold(ctx, &natpmpCR, gateways, protocol, start)
+
+	case status.MappedNode == reconciler.NodeName:
+		return ctrl.Result{}, reconciler.release(ctx, &natpmpCR, gateways, protocol)
+
+	// No node holds the mapping, so nothing is left to release.
+	case status.MappedNode == "":
+		return ctrl.Result{}, reconciler.setAgentFinalizer(ctx, &natpmpCR, false)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+func (reconciler *AgentReconciler) hold(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+	start time.Time,
+) (ctrl.Result, error) {
+	name := client.ObjectKeyFromObject(natpmpCR)
+
+	// Hold the NatPMP before mapping, so it is not deleted with the mapping
+	// left on the gateway.
+	if err := reconciler.setAgentFinalizer(ctx, natpmpCR, true); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Adopt a mapping this node held before the agent restarted.
+	if natpmpCR.Status.MappedNode == reconciler.NodeName {
+		if lease, ok := RestoreLease(*natpmpCR, "", reconciler.renewalFraction(), start); ok {
+			reconciler.leases.Restore(name, lease)
+		}
+	}
+
+	renewAfter, leased := reconciler.leases.RenewIn(name, natpmpCR.Generation, "", start)
+	if leased {
+		return ctrl.Result{RequeueAfter: renewAfter}, nil
+	}
+
+	policies, err := reconciler.listPolicies(ctx, *natpmpCR)
+	if err != nil {
+		return ctrl.Result{}, WrapError(ctx, err, "unable to list policies")
+	}
+
+	mappings, err := reconciler.AddPortMapping(ctx, natpmpCR, gateways, protocol, nil)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	accepted, err := reconciler.ApplyPortPolicy(ctx, natpmpCR, gateways, protocol, mappings, policies)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !accepted {
+		return ctrl.Result{RequeueAfter: portRetryInterval}, nil
+	}
+
+	err = reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		SetMappings(natpmpCR, status, mappings, start)
+		SetResumed(natpmpCR, status)
+		ClearExpired(status)
+		status.MappedNode = reconciler.NodeName
+	})
+	if err != nil {
+		return ctrl.Result{}, WrapError(ctx, err, "unable to update NatPMP status")
+	}
+
+	renewAt := start.Add(renewIn(MappedLifetime(mappings), reconciler.renewalFraction()))
+	reconciler.leases.Set(name, Lease{
+		Generation: natpmpCR.Generation,
+		RenewAt:    renewAt,
+	})
+
+	renewAfter = renewAt.Sub(reconciler.now())
+	if renewAfter < 0 {
+		renewAfter = 0
+	}
+
+	return ctrl.Result{RequeueAfter: renewAfter}, nil
+}
+
+func (reconciler *AgentReconciler) release(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+) error {
+	if err := reconciler.ReleasePortMapping(ctx, natpmpCR, gateways, protocol); err != nil {
+		return err
+	}
+
+	reconciler.leases.Forget(client.ObjectKeyFromObject(natpmpCR))
+
+	// Drop the finalizer before clearing the node, so it is not removed
+	// after the agent on the next node adds it again.
+	if err := reconciler.setAgentFinalizer(ctx, natpmpCR, false); err != nil {
+		return err
+	}
+
+	err := reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		ClearMappings(status)
+		status.MappedNode = ""
+	})
+
+	// Removing the finalizer deletes a deleted NatPMP held by nothing else.
+	if err != nil && !errors.IsNotFound(err) {
+		return WrapError(ctx, err, "unable to update NatPMP status")
+	}
+
+	return nil
+}
+
+// setAgentFinalizer adds or removes the agent finalizer, so the NatPMP is
+// not deleted while an agent holds its port mapping.
+func (reconciler *NatPMPReconciler) setAgentFinalizer(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	add bool,
+) error {
+	if controllerutil.ContainsFinalizer(natpmpCR, agentFinalizer) == add {
+		return nil
+	}
+
+	patch := client.MergeFrom(natpmpCR.DeepCopy())
+
+	if add {
+		controllerutil.AddFinalizer(natpmpCR, agentFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(natpmpCR, agentFinalizer)
+	}
+
+	if err := reconciler.Patch(ctx, natpmpCR, patch); err != nil {
+		return WrapError(ctx, err, "unable to update NatPMP finalizers")
+	}
+
+	return nil
+}
+
+// nodeGone returns true if the node no longer exists.
+func (reconciler *NatPMPReconciler) nodeGone(ctx context.Context, nodeName string) (bool, error) {
+	var node corev1.Node
+
+	err := reconciler.Get(ctx, types.NamespacedName{Name: nodeName}, &node)
+	if err != nil && !errors.IsNotFound(err) {
+		return false, WrapError(ctx, err, "unable to fetch mapped node", "node", nodeName)
+	}
+
+	return errors.IsNotFound(err), nil
+}
+
+// onNode returns true if the NatPMP is assigned to or held by the node.
+func (reconciler *AgentReconciler) onNode(object client.Object) bool {
+	natpmpCR, ok := object.(*networkv1.NatPMP)
+	if !ok {
+		return false
+	}
+
+	return natpmpCR.Status.ActiveNode == reconciler.NodeName ||
+		natpmpCR.Status.MappedNode == reconciler.NodeName
+}
+
+// SetupWithManager sets up the agent with the Manager.
+func (reconciler *AgentReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := ctrl.NewControllerManagedBy(mgr).
+		Named("agent").
+		For(
+			&networkv1.NatPMP{},
+			builder.WithPredicates(predicate.NewPredicateFuncs(reconciler.onNode)),
+		).
+		Complete(reconciler)
+	if err != nil {
+		return fmt.Errorf("unable to complete agent: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// newTestAgent returns an agent on node-a sharing the client, clock and
+// gateway of the test reconciler.
+func newTestAgent(test *testReconciler) *AgentReconciler {
+	return &AgentReconciler{
+		NatPMPReconciler: NatPMPReconciler{
+			Client:           test.Client,
+			Scheme:           test.Scheme,
+			Clock:            test.clock,
+			NewGatewayClient: test.NewGatewayClient,
+		},
+		NodeName: "node-a",
+	}
+}
+
+// reconcileAgent reconciles the NatPMP on the agent and returns it as stored
+// afterwards.
+func reconcileAgent(
+	t *testing.T,
+	agent *AgentReconciler,
+	natpmpCR *networkv1.NatPMP,
+) (ctrl.Result, *networkv1.NatPMP) {
+	t.Helper()
+
+	result, err := agent.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: client.ObjectKeyFromObject(natpmpCR),
+	})
+	require.NoError(t, err)
+
+	var stored networkv1.NatPMP
+	require.NoError(t, agent.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+
+	return result, &stored
+}
+
+// setStatus updates the status of the stored NatPMP.
+func setStatus(
+	t *testing.T,
+	test *testReconciler,
+	natpmpCR *networkv1.NatPMP,
+	mutate func(*networkv1.NatPMPStatus),
+) {
+	t.Helper()
+
+	var stored networkv1.NatPMP
+	require.NoError(t, test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+
+	mutate(&stored.Status)
+	require.NoError(t, test.Status().Update(context.Background(), &stored))
+}
+
+func TestAgentHold(t *testing.T) {
+	natpmpCR := mapped()
+	test := newTestReconciler(t, natpmpCR)
+	agent := newTestAgent(test)
+
+	setStatus(t, test, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		status.ActiveNode = "node-a"
+	})
+
+	result, stored := reconcileAgent(t, agent, natpmpCR)
+	require.Equal(t, 45*time.Minute, result.RequeueAfter)
+	require.Equal(t, "node-a", stored.Status.MappedNode)
+	require.Equal(t, 2222, stored.Status.MappedExternalPort)
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 1)
+	require.Nil(t, requests[0].InternalIP, "the agent maps to its own host")
+	require.Equal(t, Nonce(*stored), requests[0].Nonce)
+
+	// The lease is held until it is due.
+	test.clock.Step(time.Minute)
+	result, _ = reconcileAgent(t, agent, natpmpCR)
+	require.Equal(t, 44*time.Minute, result.RequeueAfter)
+	require.Len(t, test.gateway.Requests(), 1)
+
+	// A restarted agent adopts the mapping it held.
+	restarted := newTestAgent(test)
+	_, _ = reconcileAgent(t, restarted, natpmpCR)
+	require.Len(t, test.gateway.Requests(), 1)
+}
+
+func TestAgentWaitsForPreviousNode(t *testing.T) {
+	natpmpCR := mapped()
+	test := newTestReconciler(t, natpmpCR)
+	agent := newTestAgent(test)
+
+	setStatus(t, test, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		status.ActiveNode = "node-a"
+		status.MappedNode = "node-b"
+	})
+
+	result, stored := reconcileAgent(t, agent, natpmpCR)
+	require.Zero(t, result.RequeueAfter)
+	require.Equal(t, "node-b", stored.Status.MappedNode)
+	require.Empty(t, test.gateway.Requests())
+}
+
+func TestAgentRelease(t *testing.T) {
+	natpmpCR := mapped()
+	test := newTestReconciler(t, natpmpCR)
+	agent := newTestAgent(test)
+
+	setStatus(t, test, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		status.ActiveNode = "node-a"
+	})
+
+	_, stored := reconcileAgent(t, agent, natpmpCR)
+	require.Equal(t, "node-a", stored.Status.MappedNode)
+
+	// The mapping moved to another node, so the agent deletes its own.
+	setStatus(t, test, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		status.ActiveNode = "node-b"
+	})
+
+	_, stored = reconcileAgent(t, agent, natpmpCR)
+	require.Empty(t, stored.Status.MappedNode)
+	require.Empty(t, stored.Status.Mappings)
+	require.NotContains(t, stored.Finalizers, agentFinalizer)
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Zero(t, requests[1].Lifetime, "a zero lifetime deletes the mapping")
+	require.Equal(t, requests[0].Nonce, requests[1].Nonce)
+
+	_, ok := agent.leases.Get(client.ObjectKeyFromObject(natpmpCR))
+	require.False(t, ok)
+
+	require.False(t, agent.onNode(stored))
+}
+
+func TestAgentFinalizer(t *testing.T) {
+	natpmpCR := mapped()
+	test := newTestReconciler(t, natpmpCR)
+	agent := newTestAgent(test)
+
+	setStatus(t, test, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		status.ActiveNode = "node-a"
+	})
+
+	_, stored := reconcileAgent(t, agent, natpmpCR)
+	require.Contains(t, stored.Finalizers, agentFinalizer)
+
+	// The NatPMP is held until the agent deletes the mapping.
+	require.NoError(t, test.Delete(context.Background(), stored))
+
+	_, err := agent.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: client.ObjectKeyFromObject(natpmpCR),
+	})
+	require.NoError(t, err)
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Zero(t, requests[1].Lifetime, "a zero lifetime deletes the mapping")
+
+	err = test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), stored)
+	require.True(t, apierrors.IsNotFound(err))
+}
+
+func TestAgentFinalizerNodeGone(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Finalizers = []string{agentFinalizer}
+	test := newTestReconciler(t, natpmpCR)
+
+	setStatus(t, test, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		status.ActiveNode = "node-a"
+		status.MappedNode = "node-a"
+	})
+
+	var stored networkv1.NatPMP
+	require.NoError(t, test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+	require.NoError(t, test.Delete(context.Background(), &stored))
+
+	// The agent of a node that is gone cannot release the NatPMP.
+	_, err := test.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: client.ObjectKeyFromObject(natpmpCR),
+	})
+	require.NoError(t, err)
+
+	err = test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored)
+	require.True(t, apierrors.IsNotFound(err))
+	require.Empty(t, test.gateway.Requests())
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+const (
+	// firstUnprivilegedPort is the first port allocated when neither the
+	// NatPMP nor its gateway restrict the range.
+	firstUnprivilegedPort = 1024
+
+	// lastPort is the highest port number.
+	lastPort = 65535
+)
+
+var (
+	// ErrPortClaimed is returned when the external port is claimed by
+	// another NatPMP on the same gateway.
+	ErrPortClaimed = errors.New("external port is claimed")
+
+	// ErrNoFreePort is returned when no port in the allocation ranges is
+	// free.
+	ErrNoFreePort = errors.New("no free external port")
+)
+
+// GatewayKeys resolves NatPMPs to the router they map through, so that
+// NatPMPs naming the same router by address, by NatPMPGateway or through the
+// default gateway share its external ports.
+type GatewayKeys struct {
+	// Addresses are the addresses of the NatPMPGateways by name.
+	Addresses map[string]string
+
+	// DefaultGateway is the gateway of NatPMPs that set neither Gateway
+	// nor GatewayRef.
+	DefaultGateway string
+}
+
+// ListGatewayKeys returns the GatewayKeys for the NatPMPGateways.
+func ListGatewayKeys(ctx context.Context, reader client.Reader, defaultGateway string) (GatewayKeys, error) {
+	var gateways networkv1.NatPMPGatewayList
+	if err := reader.List(ctx, &gateways); err != nil {
+		return GatewayKeys{}, fmt.Errorf("unable to list NatPMPGateways: %w", err)
+	}
+
+	keys := GatewayKeys{
+		Addresses:      make(map[string]string, len(gateways.Items)),
+		DefaultGateway: defaultGateway,
+	}
+
+	for _, natpmpGateway := range gateways.Items {
+		keys.Addresses[natpmpGateway.Name] = natpmpGateway.Spec.Address
+	}
+
+	return keys, nil
+}
+
+// Key identifies the router the NatPMP maps through. A NatPMPGateway that
+// is unknown or discovers its address is keyed by name.
+func (keys GatewayKeys) Key(natpmpCR networkv1.NatPMP) string {
+	address := natpmpCR.Spec.Gateway
+
+	switch ref := natpmpCR.Spec.GatewayRef; {
+	case ref != "":
+		address = keys.Addresses[ref]
+		if address == "" {
+			return "gatewayRef/" + ref
+		}
+	case address == "":
+		address = keys.DefaultGateway
+	}
+
+	if ip := net.ParseIP(address); ip != nil {
+		address = ip.String()
+	}
+
+	return "gateway/" + address
+}
+
+// gatewayKeys returns the GatewayKeys of the reconciler, without the
+// cluster-scoped NatPMPGateways when it is namespaced.
+func (reconciler *NatPMPReconciler) gatewayKeys(ctx context.Context) (GatewayKeys, error) {
+	defaultGateway := reconciler.Settings.Get().Defaults.Gateway
+
+	if reconciler.Namespaced {
+		return GatewayKeys{DefaultGateway: defaultGateway}, nil
+	}
+
+	return ListGatewayKeys(ctx, reconciler, defaultGateway)
+}
+
+// ExternalPort returns the external port to request for the NatPMP, the
+// port in the spec or the one allocated to it.
+func ExternalPort(natpmpCR networkv1.NatPMP) int {
+	if natpmpCR.Spec.ExternalPort != 0 {
+		return natpmpCR.Spec.ExternalPort
+	}
+
+	return natpmpCR.Status.AllocatedExternalPort
+}
+
+// claimsBefore returns true if the claim of left on a port takes precedence
+// over right, the oldest NatPMP wins. A NatPMP being created claims last.
+func claimsBefore(left, right networkv1.NatPMP) bool {
+	if left.CreationTimestamp.IsZero() != right.CreationTimestamp.IsZero() {
+		return right.CreationTimestamp.IsZero()
+	}
+
+	if !left.CreationTimestamp.Equal(&right.CreationTimestamp) {
+		return left.CreationTimestamp.Before(&right.CreationTimestamp)
+	}
+
+	if left.Namespace != right.Namespace {
+		return left.Namespace < right.Namespace
+	}
+
+	return left.Name < right.Name
+}
+
+// PortClaims returns the external ports claimed by the other NatPMPs that
+// share the gateway and protocol of the NatPMP, with the claimant of each.
+func PortClaims(
+	natpmpCR networkv1.NatPMP,
+	natpmps []networkv1.NatPMP,
+	keys GatewayKeys,
+) map[int]networkv1.NatPMP {
+	key := keys.Key(natpmpCR)
+	protocol := strings.ToLower(natpmpCR.Spec.Protocol)
+	claims := map[int]networkv1.NatPMP{}
+
+	for _, other := range natpmps {
+		if other.Namespace == natpmpCR.Namespace && other.Name == natpmpCR.Name {
+			continue
+		}
+
+		if keys.Key(other) != key || strings.ToLower(other.Spec.Protocol) != protocol {
+			continue
+		}
+
+		port := ExternalPort(other)
+		if port == 0 {
+			continue
+		}
+
+		if current, ok := claims[port]; !ok || claimsBefore(other, current) {
+			claims[port] = other
+		}
+	}
+
+	return claims
+}
+
+// AllocationRanges returns the ranges a port is allocated from for the
+// NatPMP.
+func AllocationRanges(natpmpCR networkv1.NatPMP, config *GatewayConfig) []networkv1.PortRange {
+	switch {
+	case natpmpCR.Spec.ExternalPortRange != nil:
+		return []networkv1.PortRange{*natpmpCR.Spec.ExternalPortRange}
+	case config != nil && len(config.AllowedPortRanges) > 0:
+		return config.AllowedPortRanges
+	default:
+		return []networkv1.PortRange{{Start: firstUnprivilegedPort, End: lastPort}}
+	}
+}
+
+// AllocatePort returns the external port to request for the NatPMP. A port
+// in the spec is returned unless an older NatPMP claims it. Otherwise the
+// port already allocated is kept while it is in range, unclaimed and
+// permitted by the policies, and a new one is the lowest port in the ranges
+// no other NatPMP claims and the policies permit.
+func AllocatePort(
+	natpmpCR networkv1.NatPMP,
+	config *GatewayConfig,
+	natpmps []networkv1.NatPMP,
+	keys GatewayKeys,
+	policies *Policies,
+) (int, error) {
+	claims := PortClaims(natpmpCR, natpmps, keys)
+
+	claimedBefore := func(port int) (types.NamespacedName, bool) {
+		other, ok := claims[port]
+		if !ok || !claimsBefore(other, natpmpCR) {
+			return types.NamespacedName{}, false
+		}
+
+		return types.NamespacedName{Namespace: other.Namespace, Name: other.Name}, true
+	}
+
+	if port := natpmpCR.Spec.ExternalPort; port != 0 {
+		if claimant, ok := claimedBefore(port); ok {
+			return 0, fmt.Errorf("%w: port %d is claimed by %s", ErrPortClaimed, port, claimant)
+		}
+
+		return port, nil
+	}
+
+	ranges := AllocationRanges(natpmpCR, config)
+
+	if port := natpmpCR.Status.AllocatedExternalPort; port != 0 &&
+		PortAllowed(port, ranges) && policies.PortPermitted(port) {
+		if _, ok := claimedBefore(port); !ok {
+			return port, nil
+		}
+	}
+
+	for _, portRange := range ranges {
+		end := portRange.End
+		if end == 0 {
+			end = portRange.Start
+		}
+
+		for port := portRange.Start; port <= end; port++ {
+			if _, ok := claims[port]; !ok && policies.PortPermitted(port) {
+				return port, nil
+			}
+		}
+	}
+
+	return 0, ErrNoFreePort
+}
+
+// ClaimPort allocates the external port of the NatPMP, recording it in the
+// status so that it is stable across restarts. Conflicts are recorded in the
+// NatPMP status.
+func (reconciler *NatPMPReconciler) ClaimPort(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	config *GatewayConfig,
+	policies *Policies,
+) error {
+	var natpmps networkv1.NatPMPList
+	if err := reconciler.List(ctx, &natpmps); err != nil {
+		return WrapError(ctx, err, "unable to list NatPMPs")
+	}
+
+	keys, err := reconciler.gatewayKeys(ctx)
+	if err != nil {
+		return WrapError(ctx, err, "unable to resolve gateways")
+	}
+
+	port, err := AllocatePort(*natpmpCR, config, natpmps.Items, keys, policies)
+	if err != nil {
+		return reconciler.MappingFailed(
+			ctx,
+			natpmpCR,
+			networkv1.ReasonPortConflict,
+			WrapError(ctx, err, "unable to allocate external port"),
+		)
+	}
+
+	allocated := 0
+	if natpmpCR.Spec.ExternalPort == 0 {
+		allocated = port
+	}
+
+	err = reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		status.AllocatedExternalPort = allocated
+	})
+	if err != nil {
+		return WrapError(ctx, err, "unable to update NatPMP status")
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// claiming returns a NatPMP created after created claiming the external port
+// on the gateway.
+func claiming(name string, after time.Duration, gateway string, externalPort int) *networkv1.NatPMP {
+	natpmpCR := mapped()
+	natpmpCR.Name = name
+	natpmpCR.CreationTimestamp = metav1.NewTime(created.Add(after))
+	natpmpCR.Spec.Gateway = gateway
+	natpmpCR.Spec.ExternalPort = externalPort
+
+	return natpmpCR
+}
+
+func TestGatewayKeys(t *testing.T) {
+	keys := GatewayKeys{
+		Addresses:      map[string]string{"home": "192.0.2.1", "discovered": ""},
+		DefaultGateway: "192.0.2.1",
+	}
+
+	byAddress := claiming("address", 0, "192.0.2.1", 2222)
+
+	byRef := claiming("ref", 0, "", 2222)
+	byRef.Spec.GatewayRef = "home"
+
+	byDefault := claiming("default", 0, "", 2222)
+
+	require.Equal(t, "gateway/192.0.2.1", keys.Key(*byAddress))
+	require.Equal(t, keys.Key(*byAddress), keys.Key(*byRef), "a reference resolves to its address")
+	require.Equal(t, keys.Key(*byAddress), keys.Key(*byDefault), "the default gateway resolves to its address")
+
+	discovered := claiming("discovered", 0, "", 2222)
+	discovered.Spec.GatewayRef = "discovered"
+	require.Equal(t, "gatewayRef/discovered", keys.Key(*discovered))
+
+	unknown := claiming("unknown", 0, "", 2222)
+	unknown.Spec.GatewayRef = "unknown"
+	require.Equal(t, "gatewayRef/unknown", keys.Key(*unknown))
+}
+
+func TestListGatewayKeys(t *testing.T) {
+	test := newTestReconciler(t, &networkv1.NatPMPGateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "home"},
+		Spec:       networkv1.NatPMPGatewaySpec{Address: "192.0.2.1"},
+	})
+
+	keys, err := test.gatewayKeys(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"home": "192.0.2.1"}, keys.Addresses)
+}
+
+func TestClaimsBefore(t *testing.T) {
+	older := claiming("b", 0, "192.0.2.1", 2222)
+	newer := claiming("a", time.Minute, "192.0.2.1", 2222)
+	tied := claiming("c", 0, "192.0.2.1", 2222)
+
+	pending := claiming("a", 0, "192.0.2.1", 2222)
+	pending.CreationTimestamp = metav1.Time{}
+
+	require.True(t, claimsBefore(*older, *newer))
+	require.False(t, claimsBefore(*newer, *older))
+	require.True(t, claimsBefore(*older, *tied), "ties are broken by name")
+	require.True(t, claimsBefore(*newer, *pending), "a NatPMP being created claims last")
+	require.False(t, claimsBefore(*pending, *newer))
+}
+
+func TestPortClaims(t *testing.T) {
+	natpmpCR := claiming("self", time.Minute, "192.0.2.1", 2222)
+
+	byRef := claiming("ref", 2*time.Minute, "", 2222)
+	byRef.Spec.GatewayRef = "home"
+
+	udp := claiming("udp", 0, "192.0.2.1", 2223)
+	udp.Spec.Protocol = "udp"
+
+	allocated := claiming("allocated", 0, "192.0.2.1", 0)
+	allocated.Status.AllocatedExternalPort = 2224
+
+	natpmps := []networkv1.NatPMP{
+		*natpmpCR,
+		*claiming("newer", 3*time.Minute, "192.0.2.1", 2222),
+		*byRef,
+		*udp,
+		*allocated,
+		*claiming("elsewhere", 0, "198.51.100.1", 2225),
+	}
+
+	claims := PortClaims(*natpmpCR, natpmps, GatewayKeys{Addresses: map[string]string{"home": "192.0.2.1"}})
+	require.Len(t, claims, 2)
+	require.Equal(t, "ref", claims[2222].Name, "the oldest claimant is kept")
+	require.Equal(t, "allocated", claims[2224].Name)
+}
+
+func TestAllocatePort(t *testing.T) {
+	keys := GatewayKeys{}
+	older := claiming("older", 0, "192.0.2.1", 2222)
+	newer := claiming("newer", 2*time.Minute, "192.0.2.1", 2222)
+
+	natpmpCR := claiming("self", time.Minute, "192.0.2.1", 2222)
+	natpmps := []networkv1.NatPMP{*natpmpCR, *newer}
+
+	port, err := AllocatePort(*natpmpCR, nil, natpmps, keys, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2222, port, "a newer claimant does not take the port")
+
+	_, err = AllocatePort(*natpmpCR, nil, append(natpmps, *older), keys, nil)
+	require.ErrorIs(t, err, ErrPortClaimed)
+
+	ranged := claiming("ranged", time.Minute, "192.0.2.1", 0)
+	ranged.Spec.ExternalPortRange = &networkv1.PortRange{Start: 2222, End: 2224}
+	natpmps = []networkv1.NatPMP{*older, *claiming("next", 0, "192.0.2.1", 2223)}
+
+	port, err = AllocatePort(*ranged, nil, natpmps, keys, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2224, port, "the lowest unclaimed port is allocated")
+
+	ranged.Status.AllocatedExternalPort = 2224
+	later := claiming("later", 2*time.Minute, "192.0.2.1", 2224)
+
+	port, err = AllocatePort(*ranged, nil, append(natpmps, *later), keys, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2224, port, "the allocated port is kept against newer claimants")
+
+	ranged.Spec.ExternalPortRange.End = 2223
+	ranged.Status.AllocatedExternalPort = 0
+	_, err = AllocatePort(*ranged, nil, natpmps, keys, nil)
+	require.ErrorIs(t, err, ErrNoFreePort)
+}
@@ -22,34 +22,93 @@ import (
 	"net"
 	"time"
 
-	natpmp "github.com/jackpal/go-nat-pmp"
-
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+	"github.com/jkoelker/natpmp-controller/pkg/settings"
 )
 
-const (
-	three = 3
-	four  = 4
-)
-
-func renewIn(lifetime int) time.Duration {
-	return three * (time.Duration(lifetime) * time.Second) / four
+// renewIn returns how long after a mapping is made it is renewed, the
+// fraction of its lifetime.
+func renewIn(lifetime int, fraction float64) time.Duration {
+	return time.Duration(fraction * float64(time.Duration(lifetime)*time.Second))
 }
 
 // NatPMPReconciler reconciles a NatPMP object.
 type NatPMPReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// APIReader reads from the API server instead of the cache, for the
+	// latest NatPMP after a conflict and for the TSIG Secrets. The client is
+	// used if nil.
+	APIReader client.Reader
+
+	// DelegateToAgents assigns mappings with a target on a node to the
+	// agent running on that node instead of requesting them directly.
+	DelegateToAgents bool
+
+	// Recorder records events on the NatPMPs, nil disables events.
+	Recorder record.EventRecorder
+
+	// Ledger records the port mappings held on each gateway, nil disables
+	// the record.
+	Ledger *Ledger
+
+	// Clock is the time source for renewals and expiry, the real clock if
+	// nil.
+	Clock clock.PassiveClock
+
+	// OnShutdown is what to do with the held port mappings when the
+	// manager stops, retain or release. NatPMPs may override it with the
+	// on-shutdown annotation.
+	OnShutdown string
+
+	// Settings hold the configuration of the manager, the defaults if nil.
+	Settings *settings.Store
+
+	// Namespaced only reads namespaced resources, so NatPMPGateways,
+	// NatPMPPolicies and nodes are unavailable.
+	Namespaced bool
+
+	// Shard is the set of gateways whose NatPMPs are reconciled, every
+	// gateway if nil.
+	Shard *settings.Shard
+
+	// Progress tracks the reconciles in flight for the liveness probe, nil
+	// tracks nothing.
+	Progress *Progress
+
+	// NewGatewayClient returns the client for a gateway,
+	// gateway.NewWithOptions if nil.
+	NewGatewayClient func(net.IP, gateway.Options) gateway.Client
+
+	leases   Leases
+	limiters Limiters
+	history  History
+	watcher  *Watcher
+	requests chan event.GenericEvent
 }
 
 //+kubebuilder:rbac:groups=network.natpmp.jkoelker.github.io,resources=natpmps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=network.natpmp.jkoelker.github.io,resources=natpmps/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=network.natpmp.jkoelker.github.io,resources=natpmps/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -57,7 +116,9 @@ func (reconciler *NatPMPReconciler) Reconcile(
 	ctx context.Context,
 	req ctrl.Request,
 ) (ctrl.Result, error) {
-	start := time.Now()
+	defer reconciler.Progress.Track()()
+
+	start := reconciler.now()
 
 	var natpmpCR networkv1.NatPMP
 	if err := reconciler.Get(ctx, req.NamespacedName, &natpmpCR); err != nil {
@@ -69,88 +130,501 @@ func (reconciler *NatPMPReconciler) Reconcile(
 				"name", req.NamespacedName.Name,
 			)
 
+			reconciler.leases.Forget(req.NamespacedName)
+
 			return ctrl.Result{}, nil
 		}
 
 		return ctrl.Result{}, WrapError(ctx, err, "unable to fetch NatPMP")
 	}
 
-	gateway, protocol, errs := ValidateNatPMP(natpmpCR)
+	// A deleted NatPMP is only held by its finalizers.
+	if !natpmpCR.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, reconciler.finalize(ctx, &natpmpCR)
+	}
+
+	pass, result, err := reconciler.admit(ctx, &natpmpCR, start)
+	if pass == nil || err != nil {
+		return result, err
+	}
+
+	if result, done, err := reconciler.gate(ctx, pass); done {
+		return result, err
+	}
+
+	target, failover, err := reconciler.ResolveTarget(ctx, natpmpCR, start)
+	if err != nil {
+		return ctrl.Result{}, reconciler.MappingFailed(
+			ctx,
+			&natpmpCR,
+			networkv1.ReasonTargetUnavailable,
+			WrapError(ctx, err, "unable to resolve target"),
+		)
+	}
+
+	if reconciler.DelegateToAgents && target != nil && target.NodeName != "" {
+		return reconciler.Delegate(ctx, &natpmpCR, target, failover, pass.schedule)
+	}
+
+	pass.target = target
+	pass.failover = failover
+
+	renewAfter, accepted, err := reconciler.renew(ctx, pass)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !accepted {
+		return ctrl.Result{RequeueAfter: portRetryInterval}, nil
+	}
+
+	return reconciler.publishMapping(ctx, pass, renewAfter)
+}
+
+// reconcilePass is the state of a NatPMP shared by the phases of a
+// reconcile.
+type reconcilePass struct {
+	natpmpCR  *networkv1.NatPMP
+	start     time.Time
+	config    *GatewayConfig
+	policies  *Policies
+	addresses map[corev1.IPFamily]net.IP
+	protocol  string
+	gateways  map[corev1.IPFamily]gateway.Client
+	schedule  *ScheduleState
+	target    *ResolvedTarget
+	failover  Failover
+}
+
+// admit resolves the gateway of the NatPMP and checks it against its
+// validation, the policies and the quotas, denying a NatPMP that violates a
+// policy or quota. It returns nil when the reconcile ends here.
+func (reconciler *NatPMPReconciler) admit(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	start time.Time,
+) (*reconcilePass, ctrl.Result, error) {
+	name := client.ObjectKeyFromObject(natpmpCR)
+
+	config, err := reconciler.ResolveGateway(ctx, *natpmpCR)
+	if err != nil {
+		return nil, ctrl.Result{}, reconciler.MappingFailed(
+			ctx,
+			natpmpCR,
+			networkv1.ReasonGatewayUnavailable,
+			WrapError(ctx, err, "unable to resolve gateway"),
+		)
+	}
+
+	defaulted := reconciler.Defaulted(*natpmpCR)
+
+	// Another manager serves the gateways of other shards.
+	if !reconciler.serves(defaulted, config) {
+		reconciler.leases.Forget(name)
+
+		return nil, ctrl.Result{}, nil
+	}
+
+	policies, err := reconciler.listPolicies(ctx, *natpmpCR)
+	if err != nil {
+		return nil, ctrl.Result{}, WrapError(ctx, err, "unable to list policies")
+	}
+
+	addresses, protocol, errs := ValidateNatPMP(defaulted, config)
 	if len(errs) > 0 {
 		gvk := networkv1.GroupVersionKind()
 		err := errors.NewInvalid(gvk.GroupKind(), natpmpCR.Name, errs)
 
-		return ctrl.Result{}, WrapError(ctx, err, "invalid NatPMP")
+		return nil, ctrl.Result{}, WrapError(ctx, err, "invalid NatPMP")
 	}
 
-	client := natpmp.NewClient(gateway)
+	pass := &reconcilePass{
+		natpmpCR:  natpmpCR,
+		start:     start,
+		config:    config,
+		policies:  policies,
+		addresses: addresses,
+		protocol:  protocol,
+		gateways:  reconciler.gatewayClients(*natpmpCR, addresses, config),
+	}
+
+	// A NatPMP that violates a policy releases its mapping and reports the
+	// violations, since the policy may change under it.
+	if violations := ValidatePolicies(defaulted, policies); len(violations) > 0 {
+		return nil, ctrl.Result{}, reconciler.Deny(
+			ctx,
+			natpmpCR,
+			pass.gateways,
+			protocol,
+			networkv1.ReasonPolicyViolation,
+			violations,
+		)
+	}
 
-	external, err := client.GetExternalAddress()
+	quotas, err := ListQuotas(ctx, reconciler, *natpmpCR)
 	if err != nil {
-		return ctrl.Result{}, WrapError(ctx, err, "unable to get external IP")
+		return nil, ctrl.Result{}, WrapError(ctx, err, "unable to list quotas")
 	}
 
-	response, err := client.AddPortMapping(
-		protocol,
-		natpmpCR.Spec.InternalPort,
-		natpmpCR.Spec.ExternalPort,
-		natpmpCR.Spec.Lifetime,
-	)
+	if exceeded := ValidateQuotas(*natpmpCR, quotas); len(exceeded) > 0 {
+		return nil, ctrl.Result{}, reconciler.Deny(
+			ctx,
+			natpmpCR,
+			pass.gateways,
+			protocol,
+			networkv1.ReasonQuotaExceeded,
+			exceeded,
+		)
+	}
+
+	return pass, ctrl.Result{}, nil
+}
+
+// gate releases the mapping of an expired or suspended NatPMP, or one
+// outside its schedule, and claims the external port otherwise. It returns
+// true when the reconcile ends here.
+func (reconciler *NatPMPReconciler) gate(
+	ctx context.Context,
+	pass *reconcilePass,
+) (ctrl.Result, bool, error) {
+	natpmpCR := pass.natpmpCR
+
+	if Expired(*natpmpCR, pass.start) {
+		return ctrl.Result{}, true, reconciler.Expire(ctx, natpmpCR, pass.gateways, pass.protocol)
+	}
+
+	if err := reconciler.ClaimPort(ctx, natpmpCR, pass.config, pass.policies); err != nil {
+		return ctrl.Result{}, true, err
+	}
+
+	if natpmpCR.Spec.Suspend {
+		return ctrl.Result{}, true, reconciler.Suspend(ctx, natpmpCR, pass.gateways, pass.protocol)
+	}
+
+	if natpmpCR.Spec.Schedule == nil {
+		return ctrl.Result{}, false, nil
+	}
+
+	state, err := ScheduleAt(*natpmpCR.Spec.Schedule, pass.start)
 	if err != nil {
-		return ctrl.Result{}, WrapError(ctx, err, "unable to add port mapping")
+		return ctrl.Result{}, true, WrapError(ctx, err, "unable to evaluate schedule")
 	}
 
-	externalIP := net.IP(external.ExternalIPAddress[:])
-	mappedLifetime := int(response.PortMappingLifetimeInSeconds)
+	if !state.Open {
+		result, err := reconciler.CloseSchedule(ctx, natpmpCR, pass.gateways, pass.protocol, state, pass.start)
 
-	natpmpCR.Status.ExternalIP = externalIP.String()
-	natpmpCR.Status.MappedExternalPort = int(response.MappedExternalPort)
-	natpmpCR.Status.MappedInternalPort = int(response.InternalPort)
-	natpmpCR.Status.MappedLifetime = mappedLifetime
-	natpmpCR.Status.SecondsSinceStartOfEpoch = int(response.SecondsSinceStartOfEpoc)
+		return result, true, err
+	}
 
-	if err := reconciler.Status().Update(ctx, &natpmpCR); err != nil {
-		return ctrl.Result{}, WrapError(ctx, err, "unable to update NatPMP status")
+	pass.schedule = &state
+
+	return ctrl.Result{}, false, nil
+}
+
+// renew maps the port toward the target unless the lease on it is still
+// held, returning how long until it is renewed. It returns false when the
+// port policy released the mapping, to be retried after portRetryInterval.
+func (reconciler *NatPMPReconciler) renew(
+	ctx context.Context,
+	pass *reconcilePass,
+) (time.Duration, bool, error) {
+	natpmpCR := pass.natpmpCR
+	name := client.ObjectKeyFromObject(natpmpCR)
+
+	// The lease is for the target and port, so moving either remaps.
+	leaseTarget := fmt.Sprintf("%s/%d", pass.target, ExternalPort(*natpmpCR))
+
+	// Adopt a mapping recorded by a previous leader instead of requesting
+	// it again.
+	if natpmpCR.Status.MappedNode == "" && !Moved(natpmpCR.Status, pass.target) {
+		if lease, ok := RestoreLease(*natpmpCR, leaseTarget, reconciler.renewalFraction(), pass.start); ok {
+			reconciler.leases.Restore(name, lease)
+		}
+	}
+
+	renewAfter, leased := reconciler.leases.RenewIn(name, natpmpCR.Generation, leaseTarget, pass.start)
+	if leased {
+		err := reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+			SetActiveNode(status, pass.target, pass.failover)
+			SetSchedule(status, pass.schedule)
+		})
+		if err != nil {
+			return 0, false, WrapError(ctx, err, "unable to update NatPMP status")
+		}
+
+		return renewAfter, true, nil
 	}
 
-	if err := reconciler.ApplyTemplates(ctx, natpmpCR); err != nil {
+	// Release the mapping toward the previous backend before moving it.
+	if Moved(natpmpCR.Status, pass.target) {
+		if err := reconciler.ReleasePortMapping(ctx, natpmpCR, pass.gateways, pass.protocol); err != nil {
+			Error(ctx, err, "unable to release previous port mapping")
+		}
+	}
+
+	mappings, err := reconciler.AddPortMapping(ctx, natpmpCR, pass.gateways, pass.protocol, pass.target)
+	if err != nil {
+		return 0, false, err
+	}
+
+	accepted, err := reconciler.ApplyPortPolicy(ctx, natpmpCR, pass.gateways, pass.protocol, mappings, pass.policies)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !accepted {
+		reconciler.leases.Forget(name)
+
+		return 0, false, nil
+	}
+
+	err = reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		SetMappings(natpmpCR, status, mappings, pass.start)
+		SetActiveNode(status, pass.target, pass.failover)
+		SetResumed(natpmpCR, status)
+		ClearExpired(status)
+		SetSchedule(status, pass.schedule)
+	})
+	if err != nil {
+		return 0, false, WrapError(ctx, err, "unable to update NatPMP status")
+	}
+
+	reconciler.recordMappings(ctx, *natpmpCR, pass.addresses, pass.protocol, mappings)
+
+	// Renew the port mapping 3/4 of the way through the lifetime.
+	renewAt := pass.start.Add(renewIn(MappedLifetime(mappings), reconciler.renewalFraction()))
+	reconciler.leases.Set(name, Lease{
+		Generation: natpmpCR.Generation,
+		Target:     leaseTarget,
+		RenewAt:    renewAt,
+	})
+
+	// Taking into account the time it took to get here.
+	return renewAt.Sub(reconciler.now()), true, nil
+}
+
+// publishMapping applies the templates and updates the nameserver for the
+// held mapping, then requeues for the renewal, the failover, the schedule or
+// the expiry, whichever is first.
+func (reconciler *NatPMPReconciler) publishMapping(
+	ctx context.Context,
+	pass *reconcilePass,
+	renewAfter time.Duration,
+) (ctrl.Result, error) {
+	if err := reconciler.ApplyTemplates(ctx, *pass.natpmpCR); err != nil {
 		return ctrl.Result{}, WrapError(ctx, err, "unable to apply templates")
 	}
 
-	// Renew the port mapping 3/4 of the way through the lifetime. Taking into
-	// account the time it took to get here.
-	renewAfter := renewIn(mappedLifetime) - time.Since(start)
-	if renewAfter < 0 {
-		renewAfter = 0
+	if err := reconciler.UpdateDNS(ctx, pass.natpmpCR); err != nil {
+		return ctrl.Result{}, err
 	}
 
 	return ctrl.Result{
-		RequeueAfter: renewAfter,
+		RequeueAfter: ExpiryRequeueAfter(
+			*pass.natpmpCR,
+			pass.schedule.RequeueAfter(requeueAfter(renewAfter, pass.failover), pass.start),
+			pass.start,
+		),
+	}, nil
+}
+
+// Delegate assigns the port mapping to the agent on the node of the target
+// and applies the templates once that agent holds the mapping. The target is
+// resolved again every renewal period. A mapping held by a node that no
+// longer exists is released from the status and the agent finalizer, since
+// its agent is gone.
+func (reconciler *NatPMPReconciler) Delegate(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	target *ResolvedTarget,
+	failover Failover,
+	schedule *ScheduleState,
+) (ctrl.Result, error) {
+	now := reconciler.now()
+	mappedNodeGone := false
+
+	if mappedNode := natpmpCR.Status.MappedNode; mappedNode != "" && mappedNode != target.NodeName {
+		gone, err := reconciler.nodeGone(ctx, mappedNode)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		mappedNodeGone = gone
+	}
+
+	// The agent of a node that is gone cannot remove its finalizer.
+	if mappedNodeGone {
+		if err := reconciler.setAgentFinalizer(ctx, natpmpCR, false); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	err := reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		SetActiveNode(status, target, failover)
+		SetSchedule(status, schedule)
+
+		if mappedNodeGone {
+			ClearMappings(status)
+			status.MappedNode = ""
+		}
+
+		if status.MappedNode != status.ActiveNode {
+			SetCondition(
+				natpmpCR,
+				status,
+				networkv1.ConditionReady,
+				metav1.ConditionFalse,
+				networkv1.ReasonWaitingForAgent,
+				fmt.Sprintf("waiting for the agent on node %s", status.ActiveNode),
+			)
+		}
+	})
+	if err != nil {
+		return ctrl.Result{}, WrapError(ctx, err, "unable to update NatPMP status")
+	}
+
+	if natpmpCR.Status.MappedNode == natpmpCR.Status.ActiveNode {
+		if err := reconciler.ApplyTemplates(ctx, *natpmpCR); err != nil {
+			return ctrl.Result{}, WrapError(ctx, err, "unable to apply templates")
+		}
+
+		if err := reconciler.UpdateDNS(ctx, natpmpCR); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	renewAfter := renewIn(reconciler.Defaulted(*natpmpCR).Spec.Lifetime, reconciler.renewalFraction())
+
+	return ctrl.Result{
+		RequeueAfter: ExpiryRequeueAfter(
+			*natpmpCR,
+			schedule.RequeueAfter(requeueAfter(renewAfter, failover), now),
+			now,
+		),
 	}, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (reconciler *NatPMPReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	err := ctrl.NewControllerManagedBy(mgr).
+	err := mgr.GetFieldIndexer().IndexField(
+		context.Background(),
+		&networkv1.NatPMP{},
+		serviceNameField,
+		indexServiceName,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to index NatPMP service names: %w", err)
+	}
+
+	err = mgr.GetFieldIndexer().IndexField(
+		context.Background(),
+		&networkv1.NatPMP{},
+		gatewayRefField,
+		indexGatewayRef,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to index NatPMP gateway references: %w", err)
+	}
+
+	err = mgr.GetFieldIndexer().IndexField(
+		context.Background(),
+		&networkv1.NatPMP{},
+		podSelectorField,
+		indexPodSelector,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to index NatPMP pod selectors: %w", err)
+	}
+
+	natpmpBuilder := ctrl.NewControllerManagedBy(mgr).
 		For(&networkv1.NatPMP{}).
-		Complete(reconciler)
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: reconciler.Settings.Get().Controller.MaxConcurrentReconciles,
+		}).
+		Watches(
+			&discoveryv1.EndpointSlice{},
+			handler.EnqueueRequestsFromMapFunc(reconciler.mapEndpointSlice),
+		).
+		Watches(
+			&corev1.Pod{},
+			handler.EnqueueRequestsFromMapFunc(reconciler.mapPod),
+			builder.WithPredicates(predicate.Funcs{UpdateFunc: podChanged}),
+		).
+		Watches(
+			&networkv1.NatPMPQuota{},
+			handler.EnqueueRequestsFromMapFunc(reconciler.mapQuota),
+		)
+
+	if !reconciler.Namespaced {
+		natpmpBuilder = natpmpBuilder.
+			Watches(
+				&networkv1.NatPMPGateway{},
+				handler.EnqueueRequestsFromMapFunc(reconciler.mapGateway),
+			).
+			Watches(
+				&networkv1.NatPMPPolicy{},
+				handler.EnqueueRequestsFromMapFunc(reconciler.mapPolicy),
+			)
+	}
+
+	// The debug endpoint enqueues NatPMPs to renew them now.
+	reconciler.requests = make(chan event.GenericEvent, requestsBuffer)
+	natpmpBuilder = natpmpBuilder.WatchesRawSource(
+		&source.Channel{Source: reconciler.requests},
+		&handler.EnqueueRequestForObject{},
+	)
+
+	natpmpController, err := natpmpBuilder.Build(reconciler)
 	if err != nil {
 		return fmt.Errorf("unable to complete controller: %w", err)
 	}
 
+	reconciler.watcher = NewWatcher(
+		natpmpController,
+		mgr.GetCache(),
+		handler.EnqueueRequestForOwner(
+			mgr.GetScheme(),
+			mgr.GetRESTMapper(),
+			&networkv1.NatPMP{},
+			handler.OnlyControllerOwner(),
+		),
+	)
+
 	return nil
 }
 
-// ApplyTemplates applies the templates from the NatPMP CR to the cluster.
+// ApplyTemplates applies the templates from the NatPMP CR, and its
+// DNSEndpoint and source NetworkPolicy if any, to the cluster and watches
+// the kinds applied so that drift is corrected.
 func (reconciler *NatPMPReconciler) ApplyTemplates(
 	ctx context.Context,
 	natpmpCR networkv1.NatPMP,
 ) error {
-	objects, err := ProcessTemplates(natpmpCR)
+	objects, err := ProcessTemplates(reconciler.Defaulted(natpmpCR))
 	if err != nil {
 		return WrapError(ctx, err, "unable to process templates")
 	}
 
+	templates := reconciler.Settings.Get().Templates
+	if err := AllowedKinds(objects, templates.AllowedKinds); err != nil {
+		return WrapError(ctx, err, "unable to apply templates")
+	}
+
+	if endpoint := DNSEndpoint(natpmpCR); endpoint != nil {
+		objects = append(objects, endpoint)
+	}
+
+	policy, err := reconciler.SourcePolicy(ctx, natpmpCR)
+	if err != nil {
+		return WrapError(ctx, err, "unable to build source NetworkPolicy")
+	}
+
+	if policy != nil {
+		objects = append(objects, policy)
+	} else if err := reconciler.DeleteSourcePolicy(ctx, natpmpCR); err != nil {
+		return WrapError(ctx, err, "unable to delete source NetworkPolicy")
+	}
+
 	for idx := range objects {
 		object := objects[idx]
 
@@ -158,13 +632,36 @@ func (reconciler *NatPMPReconciler) ApplyTemplates(
 			return WrapError(ctx, err, "unable to set controller reference")
 		}
 
-		opts := []client.PatchOption{
-			client.ForceOwnership,
-			client.FieldOwner("natpmp-controller"),
+		if natpmpCR.Spec.Suspend {
+			annotations := object.GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+
+			annotations[networkv1.AnnotationSuspended] = "true"
+			object.SetAnnotations(annotations)
+		}
+
+		opts := []client.PatchOption{client.FieldOwner("natpmp-controller")}
+		if *templates.ForceOwnership {
+			opts = append(opts, client.ForceOwnership)
 		}
+
 		if err := reconciler.Patch(ctx, object, client.Apply, opts...); err != nil {
 			return WrapError(ctx, err, "unable to apply templates")
 		}
+
+		if reconciler.watcher == nil {
+			continue
+		}
+
+		if err := reconciler.watcher.Watch(object.GroupVersionKind()); err != nil {
+			return WrapError(ctx, err, "unable to watch templated objects")
+		}
+	}
+
+	if err := reconciler.ApplyServiceSourceRanges(ctx, natpmpCR); err != nil {
+		return WrapError(ctx, err, "unable to apply Service source ranges")
 	}
 
 	return nil
@@ -0,0 +1,289 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+// fakeGateway records the requests made to it and maps every port.
+type fakeGateway struct {
+	mu       sync.Mutex
+	requests []gateway.Request
+
+	// assign is the external port handed out, the requested port if zero.
+	assign int
+
+	// err fails every request.
+	err error
+}
+
+// AddPortMapping implements gateway.Client.
+func (fakeGW *fakeGateway) AddPortMapping(_ context.Context, req gateway.Request) (*gateway.Mapping, error) {
+	fakeGW.mu.Lock()
+	defer fakeGW.mu.Unlock()
+
+	fakeGW.requests = append(fakeGW.requests, req)
+
+	if fakeGW.err != nil {
+		return nil, fakeGW.err
+	}
+
+	externalPort := req.ExternalPort
+	if fakeGW.assign != 0 {
+		externalPort = fakeGW.assign
+	}
+
+	return &gateway.Mapping{
+		ExternalIP:               net.ParseIP("203.0.113.1"),
+		InternalIP:               req.InternalIP,
+		InternalPort:             req.InternalPort,
+		ExternalPort:             externalPort,
+		Lifetime:                 req.Lifetime,
+		SecondsSinceStartOfEpoch: 1,
+	}, nil
+}
+
+// Requests returns the requests made so far.
+func (fakeGW *fakeGateway) Requests() []gateway.Request {
+	fakeGW.mu.Lock()
+	defer fakeGW.mu.Unlock()
+
+	return append([]gateway.Request(nil), fakeGW.requests...)
+}
+
+// testReconciler is a reconciler on a fake client and clock, mapping ports on
+// a fake gateway and recording the objects applied.
+type testReconciler struct {
+	*NatPMPReconciler
+
+	gateway *fakeGateway
+	clock   *clocktesting.FakeClock
+
+	mu      sync.Mutex
+	applied []client.Object
+}
+
+func newTestReconciler(t *testing.T, objects ...client.Object) *testReconciler {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, networkv1.AddToScheme(scheme))
+
+	test := &testReconciler{
+		gateway: &fakeGateway{},
+		clock:   clocktesting.NewFakeClock(created),
+	}
+
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&networkv1.NatPMP{}).
+		WithIndex(&networkv1.NatPMP{}, serviceNameField, indexServiceName).
+		WithIndex(&networkv1.NatPMP{}, gatewayRefField, indexGatewayRef).
+		WithIndex(&networkv1.NatPMP{}, podSelectorField, indexPodSelector).
+		WithInterceptorFuncs(interceptor.Funcs{
+			// The fake client does not support server-side apply.
+			Patch: func(
+				ctx context.Context,
+				inner client.WithWatch,
+				obj client.Object,
+				patch client.Patch,
+				opts ...client.PatchOption,
+			) error {
+				if patch.Type() != types.ApplyPatchType {
+					return inner.Patch(ctx, obj, patch, opts...)
+				}
+
+				test.mu.Lock()
+				defer test.mu.Unlock()
+
+				test.applied = append(test.applied, obj.DeepCopyObject().(client.Object))
+
+				return nil
+			},
+		}).
+		Build()
+
+	test.NatPMPReconciler = &NatPMPReconciler{
+		Client: fakeClient,
+		Scheme: scheme,
+		Clock:  test.clock,
+		NewGatewayClient: func(net.IP, gateway.Options) gateway.Client {
+			return test.gateway
+		},
+	}
+
+	return test
+}
+
+// Applied returns the objects applied so far.
+func (test *testReconciler) Applied() []client.Object {
+	test.mu.Lock()
+	defer test.mu.Unlock()
+
+	return append([]client.Object(nil), test.applied...)
+}
+
+// reconcile reconciles the NatPMP and returns it as stored afterwards.
+func (test *testReconciler) reconcile(t *testing.T, natpmpCR *networkv1.NatPMP) (ctrl.Result, *networkv1.NatPMP) {
+	t.Helper()
+
+	result, err := test.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: client.ObjectKeyFromObject(natpmpCR),
+	})
+	require.NoError(t, err)
+
+	var stored networkv1.NatPMP
+	require.NoError(t, test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+
+	return result, &stored
+}
+
+func mapped() *networkv1.NatPMP {
+	return &networkv1.NatPMP{
+		ObjectMeta: expiring(0).ObjectMeta,
+		Spec: networkv1.NatPMPSpec{
+			Gateway:      "192.0.2.1",
+			Protocol:     "tcp",
+			ExternalPort: 2222,
+			InternalPort: 22,
+			Lifetime:     3600,
+			Templates: []string{`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: debug
+  namespace: default
+data:
+  port: "{{ .Status.MappedExternalPort }}"
+`},
+		},
+	}
+}
+
+func TestLeases(t *testing.T) {
+	var leases Leases
+
+	name := types.NamespacedName{Namespace: "default", Name: "debug"}
+
+	_, ok := leases.RenewIn(name, 1, "target", created)
+	require.False(t, ok)
+
+	leases.Set(name, Lease{Generation: 1, Target: "target", RenewAt: created.Add(time.Hour)})
+
+	renewIn, ok := leases.RenewIn(name, 1, "target", created)
+	require.True(t, ok)
+	require.Equal(t, time.Hour, renewIn)
+
+	_, ok = leases.RenewIn(name, 2, "target", created)
+	require.False(t, ok, "a new generation remaps")
+
+	_, ok = leases.RenewIn(name, 1, "moved", created)
+	require.False(t, ok, "a new target remaps")
+
+	_, ok = leases.RenewIn(name, 1, "target", created.Add(time.Hour-renewSlack/2))
+	require.False(t, ok, "a lease about to be due is renewed")
+
+	leases.Forget(name)
+
+	_, ok = leases.Get(name)
+	require.False(t, ok)
+}
+
+func TestReconcileReappliesTemplates(t *testing.T) {
+	natpmpCR := mapped()
+	test := newTestReconciler(t, natpmpCR)
+
+	result, stored := test.reconcile(t, natpmpCR)
+	require.Len(t, test.gateway.Requests(), 1)
+	require.Len(t, test.Applied(), 1)
+	require.Equal(t, 2222, stored.Status.MappedExternalPort)
+	require.Equal(t, 45*time.Minute, result.RequeueAfter)
+
+	// Drift of a templated object reconciles without calling the gateway.
+	test.clock.Step(time.Minute)
+	_, _ = test.reconcile(t, natpmpCR)
+	require.Len(t, test.gateway.Requests(), 1)
+	require.Len(t, test.Applied(), 2)
+
+	require.Equal(t, "debug", test.Applied()[1].GetName())
+
+	// The lease is renewed once due.
+	test.clock.Step(45 * time.Minute)
+	_, _ = test.reconcile(t, natpmpCR)
+	require.Len(t, test.gateway.Requests(), 2)
+}
+
+func TestReconcileMappingFailed(t *testing.T) {
+	natpmpCR := mapped()
+	test := newTestReconciler(t, natpmpCR)
+	test.gateway.err = gateway.ErrThirdPartyUnsupported
+
+	_, err := test.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: client.ObjectKeyFromObject(natpmpCR),
+	})
+	require.Error(t, err)
+	require.Empty(t, test.Applied())
+
+	var stored networkv1.NatPMP
+	require.NoError(t, test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+	require.Empty(t, stored.Status.Mappings)
+	require.True(t, meta.IsStatusConditionFalse(stored.Status.Conditions, networkv1.ConditionReady))
+}
+
+func TestReconcileKeepsNonce(t *testing.T) {
+	natpmpCR := mapped()
+	test := newTestReconciler(t, natpmpCR)
+
+	_, stored := test.reconcile(t, natpmpCR)
+	require.Len(t, Nonce(*stored), 12)
+
+	test.clock.Step(46 * time.Minute)
+	_, stored = test.reconcile(t, natpmpCR)
+
+	gateways := map[corev1.IPFamily]gateway.Client{corev1.IPv4Protocol: test.gateway}
+	require.NoError(t, test.ReleasePortMapping(context.Background(), stored, gateways, "tcp"))
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 3)
+
+	for _, req := range requests {
+		require.Equal(t, Nonce(*stored), req.Nonce, "renewals and the delete reuse the nonce")
+	}
+}
@@ -0,0 +1,531 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// requestsBuffer is how many NatPMPs the debug endpoint may enqueue before
+// the controller picks them up.
+const requestsBuffer = 16
+
+// Actions of the debug endpoint.
+const (
+	// ActionRenew renews the mapping on the next reconcile, which is
+	// enqueued at once.
+	ActionRenew = "renew"
+
+	// ActionRelease suspends the NatPMP and deletes the mapping on the
+	// gateway. Clearing spec.suspend maps it again.
+	ActionRelease = "release"
+)
+
+var (
+	// ErrNotHeld is returned for an action on a NatPMP the manager holds no
+	// lease for. Only the replica holding the mapping, the leader for its
+	// gateway, has its lease.
+	ErrNotHeld = errors.New("no lease is held for the NatPMP by this replica, only the leader for its gateway holds it")
+
+	// ErrControllerBusy is returned when a NatPMP cannot be enqueued.
+	ErrControllerBusy = errors.New("controller is not accepting requests")
+)
+
+// DebugMapping is a port mapping the manager holds a lease for.
+type DebugMapping struct {
+	// Namespace is the namespace of the NatPMP.
+	Namespace string `json:"namespace"`
+
+	// Name is the name of the NatPMP.
+	Name string `json:"name"`
+
+	// Protocol is "tcp" or "udp".
+	Protocol string `json:"protocol"`
+
+	// InternalPort is the requested internal port.
+	InternalPort int `json:"internalPort"`
+
+	// ExternalPort is the requested external port, 0 for any.
+	ExternalPort int `json:"externalPort"`
+
+	// ExternalPortRange is the requested range of external ports.
+	ExternalPortRange *networkv1.PortRange `json:"externalPortRange,omitempty"`
+
+	// Mappings are the mappings the gateway made, with the mapped ports
+	// and the epoch of the gateway.
+	Mappings []networkv1.MappingStatus `json:"mappings,omitempty"`
+
+	// RenewAt is when the mapping is next renewed.
+	RenewAt time.Time `json:"renewAt"`
+
+	// ExpiresAt is when the mapping expires on the gateway.
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// LastError is why the NatPMP is not ready, if it is not.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// DebugGateway are the mappings held on a gateway.
+type DebugGateway struct {
+	// Gateway is the name of the NatPMPGateway or the address of the
+	// gateway.
+	Gateway string `json:"gateway"`
+
+	// Mappings are the mappings held on the gateway, ordered by namespace
+	// and name.
+	Mappings []DebugMapping `json:"mappings"`
+}
+
+// Mappings returns the port mappings the reconciler holds a lease for by
+// gateway, ordered by gateway.
+func (reconciler *NatPMPReconciler) Mappings(ctx context.Context) ([]DebugGateway, error) {
+	byGateway := map[string][]DebugMapping{}
+
+	for _, name := range reconciler.leases.Names() {
+		lease, ok := reconciler.leases.Get(name)
+		if !ok {
+			continue
+		}
+
+		var natpmpCR networkv1.NatPMP
+		if err := reconciler.Get(ctx, name, &natpmpCR); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("unable to fetch NatPMP %s: %w", name, err)
+		}
+
+		defaulted := reconciler.Defaulted(natpmpCR)
+
+		gatewayName := defaulted.Spec.GatewayRef
+		if gatewayName == "" {
+			gatewayName = defaulted.Spec.Gateway
+		}
+
+		mapping := DebugMapping{
+			Namespace:         natpmpCR.Namespace,
+			Name:              natpmpCR.Name,
+			Protocol:          strings.ToLower(natpmpCR.Spec.Protocol),
+			InternalPort:      natpmpCR.Spec.InternalPort,
+			ExternalPort:      natpmpCR.Spec.ExternalPort,
+			ExternalPortRange: natpmpCR.Spec.ExternalPortRange,
+			Mappings:          natpmpCR.Status.Mappings,
+			RenewAt:           lease.RenewAt,
+			ExpiresAt:         natpmpCR.Status.ExpiresAt,
+		}
+
+		ready := meta.FindStatusCondition(natpmpCR.Status.Conditions, networkv1.ConditionReady)
+		if ready != nil && ready.Status == metav1.ConditionFalse {
+			mapping.LastError = ready.Reason + ": " + ready.Message
+		}
+
+		byGateway[gatewayName] = append(byGateway[gatewayName], mapping)
+	}
+
+	gateways := make([]DebugGateway, 0, len(byGateway))
+
+	for gatewayName, mappings := range byGateway {
+		sort.Slice(mappings, func(i, j int) bool {
+			if mappings[i].Namespace != mappings[j].Namespace {
+				return mappings[i].Namespace < mappings[j].Namespace
+			}
+
+			return mappings[i].Name < mappings[j].Name
+		})
+
+		gateways = append(gateways, DebugGateway{Gateway: gatewayName, Mappings: mappings})
+	}
+
+	sort.Slice(gateways, func(i, j int) bool {
+		return gateways[i].Gateway < gateways[j].Gateway
+	})
+
+	return gateways, nil
+}
+
+// GatewayRequests returns the most recent requests the reconciler made to
+// the gateways, newest first.
+func (reconciler *NatPMPReconciler) GatewayRequests() []GatewayRequest {
+	return reconciler.history.Requests()
+}
+
+// Renew makes the lease of the NatPMP due and enqueues it, so it is mapped
+// again at once. The lease is kept due rather than dropped, otherwise the
+// reconcile restores it from the status and does not call the gateway.
+func (reconciler *NatPMPReconciler) Renew(ctx context.Context, name types.NamespacedName) error {
+	natpmpCR, err := reconciler.held(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	reconciler.leases.Due(name, reconciler.now())
+
+	select {
+	case reconciler.requests <- event.GenericEvent{Object: natpmpCR}:
+	default:
+		return ErrControllerBusy
+	}
+
+	reconciler.event(natpmpCR, corev1.EventTypeNormal, "Renew", "renewal requested from the debug endpoint")
+
+	return nil
+}
+
+// Release suspends the NatPMP and deletes its port mapping on its gateway.
+// The NatPMP is suspended first, so its next reconcile does not map it
+// again.
+func (reconciler *NatPMPReconciler) Release(ctx context.Context, name types.NamespacedName) error {
+	natpmpCR, err := reconciler.held(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(natpmpCR.DeepCopy())
+	natpmpCR.Spec.Suspend = true
+
+	if err := reconciler.Patch(ctx, natpmpCR, patch); err != nil {
+		return fmt.Errorf("unable to suspend NatPMP %s: %w", name, err)
+	}
+
+	if err := reconciler.release(ctx, natpmpCR); err != nil {
+		return err
+	}
+
+	reconciler.event(natpmpCR, corev1.EventTypeNormal, "Release", "port mapping released and NatPMP suspended from the debug endpoint")
+
+	return nil
+}
+
+// held returns the NatPMP when the reconciler holds a lease for it.
+func (reconciler *NatPMPReconciler) held(
+	ctx context.Context,
+	name types.NamespacedName,
+) (*networkv1.NatPMP, error) {
+	if _, ok := reconciler.leases.Get(name); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotHeld, name)
+	}
+
+	var natpmpCR networkv1.NatPMP
+	if err := reconciler.Get(ctx, name, &natpmpCR); err != nil {
+		return nil, fmt.Errorf("unable to fetch NatPMP %s: %w", name, err)
+	}
+
+	return &natpmpCR, nil
+}
+
+// debugPage renders the mappings and the gateway requests.
+var debugPage = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>natpmp-controller</title></head>
+<body>
+<h1>Mappings</h1>
+{{- range .Gateways}}
+<h2>{{.Gateway}}</h2>
+<table border="1">
+<tr><th>NatPMP</th><th>Protocol</th><th>Internal</th><th>Requested</th><th>Mapped</th><th>Epoch</th><th>Renew at</th><th>Expires at</th><th>Last error</th><th></th></tr>
+{{- range .Mappings}}
+<tr>
+<td>{{.Namespace}}/{{.Name}}</td>
+<td>{{.Protocol}}</td>
+<td>{{.InternalPort}}</td>
+<td>{{if .ExternalPortRange}}{{.ExternalPortRange.Start}}-{{.ExternalPortRange.End}}{{else}}{{.ExternalPort}}{{end}}</td>
+<td>{{range .Mappings}}{{.IPFamily}} {{.ExternalIP}}:{{.MappedExternalPort}} ({{.MappedLifetime}}s)<br>{{end}}</td>
+<td>{{range .Mappings}}{{.SecondsSinceStartOfEpoch}}<br>{{end}}</td>
+<td>{{.RenewAt}}</td>
+<td>{{if .ExpiresAt}}{{.ExpiresAt}}{{end}}</td>
+<td>{{.LastError}}</td>
+<td>
+{{- if $.Actions}}
+<form method="post" action="/mappings/{{.Namespace}}/{{.Name}}/renew"><input type="password" name="token" placeholder="token"><button>renew now</button></form>
+<form method="post" action="/mappings/{{.Namespace}}/{{.Name}}/release"><input type="password" name="token" placeholder="token"><button>release</button></form>
+{{- end}}
+</td>
+</tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No mappings are held.</p>
+{{- end}}
+<h1>Gateway requests</h1>
+<table border="1">
+<tr><th>Time</th><th>Gateway</th><th>NatPMP</th><th>Protocol</th><th>Internal</th><th>External</th><th>Lifetime</th><th>Mapped</th><th>Epoch</th><th>Duration</th><th>Error</th></tr>
+{{- range .Requests}}
+<tr>
+<td>{{.Time}}</td>
+<td>{{.Gateway}}</td>
+<td>{{.NatPMP}}</td>
+<td>{{.Protocol}}</td>
+<td>{{.InternalPort}}</td>
+<td>{{.ExternalPort}}</td>
+<td>{{.Lifetime}}</td>
+<td>{{.MappedExternalPort}} ({{.MappedLifetime}}s)</td>
+<td>{{.SecondsSinceStartOfEpoch}}</td>
+<td>{{.Duration}}</td>
+<td>{{.Error}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// DebugServer serves the port mappings held by the reconciler and its
+// recent gateway requests, as HTML at / and as JSON at /mappings and
+// /history. POST /mappings/<namespace>/<name>/renew and release act on a
+// mapping, which requires the token. Every replica serves the endpoint, but
+// only for the mappings it holds, so the actions must be sent to the leader
+// for the gateway of the NatPMP.
+type DebugServer struct {
+	// Addr is the address the server binds to, empty or "0" disables it.
+	Addr string
+
+	// TokenFile is the file holding the bearer token, read on each request
+	// so it may be rotated. Without it the actions are disabled and the
+	// views are open.
+	TokenFile string
+
+	// Reconciler is the reconciler whose state is served.
+	Reconciler *NatPMPReconciler
+}
+
+// Start serves the debug endpoint until the context is done.
+func (server *DebugServer) Start(ctx context.Context) error {
+	if server.Addr == "" || server.Addr == "0" {
+		<-ctx.Done()
+
+		return nil
+	}
+
+	logger := log.FromContext(ctx).WithName("debug")
+
+	withLogger := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(resp http.ResponseWriter, req *http.Request) {
+			handler(resp, req.WithContext(log.IntoContext(req.Context(), logger)))
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", withLogger(server.serveIndex))
+	mux.HandleFunc("/mappings", withLogger(server.serveMappings))
+	mux.HandleFunc("/history", withLogger(server.serveHistory))
+	mux.HandleFunc("/mappings/", withLogger(server.serveAction))
+
+	return serve(ctx, server.Addr, mux)
+}
+
+// NeedLeaderElection returns false so every manager serves what it holds.
+func (server *DebugServer) NeedLeaderElection() bool {
+	return false
+}
+
+// authorize returns true if the request carries the token, either as a
+// bearer token or, for the forms of the HTML view, as the token form value.
+// Without a token file only views are authorized.
+func (server *DebugServer) authorize(resp http.ResponseWriter, req *http.Request, action bool) bool {
+	if server.TokenFile == "" {
+		if action {
+			http.Error(resp, "actions require a debug token file", http.StatusForbidden)
+
+			return false
+		}
+
+		return true
+	}
+
+	token, err := os.ReadFile(server.TokenFile)
+	if err != nil {
+		Error(req.Context(), err, "unable to read debug token", "path", server.TokenFile)
+		http.Error(resp, "unable to read the debug token", http.StatusInternalServerError)
+
+		return false
+	}
+
+	expected := strings.TrimSpace(string(token))
+
+	given := req.PostFormValue("token")
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		given = strings.TrimPrefix(header, "Bearer ")
+	}
+
+	if expected == "" || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(resp, "unauthorized", http.StatusUnauthorized)
+
+		return false
+	}
+
+	return true
+}
+
+// serveIndex renders the HTML view.
+func (server *DebugServer) serveIndex(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(resp, req)
+
+		return
+	}
+
+	if !server.authorize(resp, req, false) {
+		return
+	}
+
+	gateways, err := server.Reconciler.Mappings(req.Context())
+	if err != nil {
+		Error(req.Context(), err, "unable to list mappings")
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err = debugPage.Execute(resp, struct {
+		Gateways []DebugGateway
+		Requests []GatewayRequest
+		Actions  bool
+	}{
+		Gateways: gateways,
+		Requests: server.Reconciler.GatewayRequests(),
+		Actions:  server.TokenFile != "",
+	})
+	if err != nil {
+		Error(req.Context(), err, "unable to render debug page")
+	}
+}
+
+// serveMappings writes the mappings as JSON.
+func (server *DebugServer) serveMappings(resp http.ResponseWriter, req *http.Request) {
+	if !server.authorize(resp, req, false) {
+		return
+	}
+
+	gateways, err := server.Reconciler.Mappings(req.Context())
+	if err != nil {
+		Error(req.Context(), err, "unable to list mappings")
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(resp, req, gateways)
+}
+
+// serveHistory writes the gateway requests as JSON.
+func (server *DebugServer) serveHistory(resp http.ResponseWriter, req *http.Request) {
+	if !server.authorize(resp, req, false) {
+		return
+	}
+
+	writeJSON(resp, req, server.Reconciler.GatewayRequests())
+}
+
+// serveAction renews or releases the mapping of the NatPMP in the path.
+func (server *DebugServer) serveAction(resp http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/mappings/"), "/")
+	if len(parts) != 3 || (parts[2] != ActionRenew && parts[2] != ActionRelease) {
+		http.NotFound(resp, req)
+
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Allow", http.MethodPost)
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if !server.authorize(resp, req, true) {
+		return
+	}
+
+	ctx := req.Context()
+	name := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+	action := parts[2]
+
+	Info(ctx, "debug action", "action", action, "natpmp", name, "remote", req.RemoteAddr)
+
+	var err error
+
+	switch action {
+	case ActionRenew:
+		err = server.Reconciler.Renew(ctx, name)
+	case ActionRelease:
+		err = server.Reconciler.Release(ctx, name)
+	}
+
+	switch {
+	case errors.Is(err, ErrNotHeld):
+		http.Error(resp, err.Error(), http.StatusNotFound)
+
+		return
+	case errors.Is(err, ErrControllerBusy):
+		http.Error(resp, err.Error(), http.StatusServiceUnavailable)
+
+		return
+	case err != nil:
+		Error(ctx, err, "unable to "+action+" mapping", "natpmp", name)
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	// The forms of the HTML view return to it.
+	if req.PostFormValue("token") != "" {
+		http.Redirect(resp, req, "/", http.StatusSeeOther)
+
+		return
+	}
+
+	response := map[string]string{"natpmp": name.String(), "action": action}
+	if action == ActionRelease {
+		response["note"] = "the NatPMP is suspended, clear spec.suspend to map it again"
+	}
+
+	writeJSON(resp, req, response)
+}
+
+// writeJSON writes the value as JSON.
+func writeJSON(resp http.ResponseWriter, req *http.Request, value any) {
+	resp.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(resp).Encode(value); err != nil {
+		Error(req.Context(), err, "unable to write response")
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+func TestHistory(t *testing.T) {
+	var history History
+
+	for port := 1; port <= historySize+2; port++ {
+		history.Record(GatewayRequest{ExternalPort: port})
+	}
+
+	requests := history.Requests()
+	require.Len(t, requests, historySize)
+	require.Equal(t, historySize+2, requests[0].ExternalPort)
+	require.Equal(t, 3, requests[historySize-1].ExternalPort)
+}
+
+func TestDebugServer(t *testing.T) {
+	natpmpCR := expiring(2 * time.Hour)
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, networkv1.AddToScheme(scheme))
+
+	reconciler := &NatPMPReconciler{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(natpmpCR).Build(),
+		Scheme:   scheme,
+		requests: make(chan event.GenericEvent, 1),
+	}
+	reconciler.leases.Set(client.ObjectKeyFromObject(natpmpCR), Lease{RenewAt: created})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+	server := &DebugServer{TokenFile: tokenFile, Reconciler: reconciler}
+
+	do := func(method string, path string, token string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(""))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+
+		return recorder
+	}
+
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/mappings", "", server.serveMappings).Code)
+
+	recorder := do(http.MethodGet, "/mappings", "secret", server.serveMappings)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var gateways []DebugGateway
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &gateways))
+	require.Len(t, gateways, 1)
+	require.Equal(t, "192.0.2.1", gateways[0].Gateway)
+	require.Equal(t, 2222, gateways[0].Mappings[0].ExternalPort)
+
+	path := "/mappings/default/debug/renew"
+	require.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, path, "secret", server.serveAction).Code)
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodPost, path, "wrong", server.serveAction).Code)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, path, "secret", server.serveAction).Code)
+
+	renewed := <-reconciler.requests
+	require.Equal(t, natpmpCR.Name, renewed.Object.GetName())
+
+	// The lease is kept and due, so the reconcile renews it.
+	_, held := reconciler.leases.Get(client.ObjectKeyFromObject(natpmpCR))
+	require.True(t, held)
+
+	_, leased := reconciler.leases.RenewIn(client.ObjectKeyFromObject(natpmpCR), 0, "", reconciler.now())
+	require.False(t, leased)
+
+	reconciler.leases.Forget(client.ObjectKeyFromObject(natpmpCR))
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, path, "secret", server.serveAction).Code)
+
+	server.TokenFile = ""
+	require.Equal(t, http.StatusForbidden, do(http.MethodPost, path, "", server.serveAction).Code)
+}
+
+func TestDebugRenew(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+
+	test := newTestReconciler(t, natpmpCR)
+	test.requests = make(chan event.GenericEvent, 1)
+
+	_, _ = test.reconcile(t, natpmpCR)
+	require.Len(t, test.gateway.Requests(), 1)
+
+	// A reconcile that is not due restores the lease and leaves the gateway
+	// alone.
+	_, _ = test.reconcile(t, natpmpCR)
+	require.Len(t, test.gateway.Requests(), 1)
+
+	require.NoError(t, test.Renew(context.Background(), client.ObjectKeyFromObject(natpmpCR)))
+	<-test.requests
+
+	_, stored := test.reconcile(t, natpmpCR)
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Equal(t, 22, requests[1].InternalPort)
+	require.NotZero(t, requests[1].Lifetime)
+	require.Equal(t, 2222, stored.Status.MappedExternalPort)
+}
+
+func TestDebugRelease(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+
+	test := newTestReconciler(t, natpmpCR)
+
+	_, _ = test.reconcile(t, natpmpCR)
+	require.Len(t, test.gateway.Requests(), 1)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+
+	server := &DebugServer{TokenFile: tokenFile, Reconciler: test.NatPMPReconciler}
+
+	req := httptest.NewRequest(http.MethodPost, "/mappings/default/debug/release", strings.NewReader(""))
+	req.Header.Set("Authorization", "Bearer secret")
+
+	recorder := httptest.NewRecorder()
+	server.serveAction(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var response map[string]string
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Contains(t, response["note"], "spec.suspend")
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Zero(t, requests[1].Lifetime)
+
+	// The release is kept, the next reconcile does not map it again.
+	_, stored := test.reconcile(t, natpmpCR)
+	require.True(t, stored.Spec.Suspend)
+	require.Empty(t, stored.Status.Mappings)
+	require.Len(t, test.gateway.Requests(), 2)
+
+	// Without the lease, as on any other replica, the action is refused.
+	recorder = httptest.NewRecorder()
+	server.serveAction(recorder, req)
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+	require.Contains(t, recorder.Body.String(), "leader")
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/rfc2136"
+)
+
+// dnsFinalizer holds a NatPMP until its hostnames are removed from the RFC
+// 2136 nameserver.
+const dnsFinalizer = "natpmp.jkoelker.github.io/dns"
+
+var dnsEndpointGVK = schema.GroupVersionKind{
+	Group:   "externaldns.k8s.io",
+	Version: "v1alpha1",
+	Kind:    "DNSEndpoint",
+}
+
+// recordType returns the DNS record type for the address.
+func recordType(ip net.IP) string {
+	if ip.To4() != nil {
+		return "A"
+	}
+
+	return "AAAA"
+}
+
+// DNSEndpoint returns the ExternalDNS DNSEndpoint publishing the hostnames of
+// the NatPMP, nil when the NatPMP has no hostnames for ExternalDNS or no
+// external address yet.
+func DNSEndpoint(natpmpCR networkv1.NatPMP) *unstructured.Unstructured {
+	dns := natpmpCR.Spec.DNS
+	if dns == nil || dns.RFC2136 != nil {
+		return nil
+	}
+
+	ips := parseIPs(ExternalAddresses(natpmpCR.Status)...)
+	if len(ips) == 0 {
+		return nil
+	}
+
+	endpoints := make([]interface{}, 0, len(dns.Hostnames)*len(ips))
+
+	for _, hostname := range dns.Hostnames {
+		targets := map[string][]interface{}{}
+		rrTypes := make([]string, 0, len(ips))
+
+		for _, ip := range ips {
+			rrType := recordType(ip)
+			if _, ok := targets[rrType]; !ok {
+				rrTypes = append(rrTypes, rrType)
+			}
+
+			targets[rrType] = append(targets[rrType], ip.String())
+		}
+
+		for _, rrType := range rrTypes {
+			endpoints = append(endpoints, map[string]interface{}{
+				"dnsName":    hostname,
+				"recordType": rrType,
+				"recordTTL":  dns.TTL,
+				"targets":    targets[rrType],
+			})
+		}
+	}
+
+	endpoint := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"endpoints": endpoints,
+		},
+	}}
+	endpoint.SetGroupVersionKind(dnsEndpointGVK)
+	endpoint.SetNamespace(natpmpCR.Namespace)
+	endpoint.SetName(natpmpCR.Name)
+
+	return endpoint
+}
+
+// tsig returns the TSIG key for the nameserver from its Secret. The Secret is
+// read from the API server, so Secrets are neither cached nor watched.
+func (reconciler *NatPMPReconciler) tsig(
+	ctx context.Context,
+	namespace string,
+	server *networkv1.RFC2136,
+) (*rfc2136.TSIG, error) {
+	var secret corev1.Secret
+
+	name := types.NamespacedName{Namespace: namespace, Name: server.TSIGSecretRef.Name}
+	if err := reconciler.apiReader().Get(ctx, name, &secret); err != nil {
+		return nil, fmt.Errorf("unable to fetch TSIG secret: %w", err)
+	}
+
+	value, ok := secret.Data[server.TSIGSecretRef.Key]
+	if !ok {
+		return nil, fmt.Errorf("TSIG secret %s has no key %s", name, server.TSIGSecretRef.Key)
+	}
+
+	return &rfc2136.TSIG{
+		KeyName:   server.TSIGKeyName,
+		Algorithm: server.TSIGAlgorithm,
+		Secret:    string(value),
+	}, nil
+}
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get
+//+kubebuilder:rbac:groups=externaldns.k8s.io,resources=dnsendpoints,verbs=get;list;watch;create;update;patch;delete
+
+// desiredDNS returns the RFC 2136 nameserver and hostnames of the NatPMP and
+// the addresses to point them at, nil while there is nothing to publish.
+func desiredDNS(natpmpCR networkv1.NatPMP) (*networkv1.DNSStatus, []string) {
+	dns := natpmpCR.Spec.DNS
+	if dns == nil || dns.RFC2136 == nil || !natpmpCR.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+
+	addresses := ExternalAddresses(natpmpCR.Status)
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+
+	return &networkv1.DNSStatus{RFC2136: *dns.RFC2136, Hostnames: dns.Hostnames}, addresses
+}
+
+// UpdateDNS points the hostnames of the NatPMP at its external addresses on
+// the RFC 2136 nameserver, removing the records of hostnames updated before
+// that are no longer listed. All records are removed once the mapping is
+// released or the NatPMP is deleted. The nameserver is only contacted when
+// the addresses or the spec changed since the last successful update.
+func (reconciler *NatPMPReconciler) UpdateDNS(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+) error {
+	desired, addresses := desiredDNS(*natpmpCR)
+	previous := natpmpCR.Status.DNS
+
+	if desired == nil && previous == nil {
+		return reconciler.setDNSFinalizer(ctx, natpmpCR, false)
+	}
+
+	condition := meta.FindStatusCondition(natpmpCR.Status.Conditions, networkv1.ConditionDNSUpdated)
+	if condition != nil &&
+		condition.Status == metav1.ConditionTrue &&
+		condition.ObservedGeneration == natpmpCR.Generation &&
+		equality.Semantic.DeepEqual(previous, desired) &&
+		equality.Semantic.DeepEqual(natpmpCR.Status.DNSAddresses, addresses) {
+		return nil
+	}
+
+	// Hold the NatPMP until its records are removed.
+	if desired != nil {
+		if err := reconciler.setDNSFinalizer(ctx, natpmpCR, true); err != nil {
+			return err
+		}
+	}
+
+	err := reconciler.updateDNS(ctx, *natpmpCR, desired, addresses)
+
+	patchErr := reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		if err != nil {
+			SetCondition(
+				natpmpCR,
+				status,
+				networkv1.ConditionDNSUpdated,
+				metav1.ConditionFalse,
+				networkv1.ReasonUpdateFailed,
+				err.Error(),
+			)
+
+			return
+		}
+
+		message := "hostnames are updated on the nameserver"
+		if desired == nil {
+			message = "hostnames are removed from the nameserver"
+		}
+
+		status.DNS = desired
+		status.DNSAddresses = addresses
+		SetCondition(
+			natpmpCR,
+			status,
+			networkv1.ConditionDNSUpdated,
+			metav1.ConditionTrue,
+			networkv1.ReasonUpdated,
+			message,
+		)
+	})
+	if patchErr != nil {
+		return WrapError(ctx, patchErr, "unable to update NatPMP status")
+	}
+
+	if err != nil {
+		return WrapError(ctx, err, "unable to update DNS")
+	}
+
+	if desired == nil {
+		return reconciler.setDNSFinalizer(ctx, natpmpCR, false)
+	}
+
+	return nil
+}
+
+// updateDNS removes the stale records of the previous update and points the
+// desired hostnames at the addresses.
+func (reconciler *NatPMPReconciler) updateDNS(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+	desired *networkv1.DNSStatus,
+	addresses []string,
+) error {
+	if previous := natpmpCR.Status.DNS; previous != nil {
+		removed, kept, staleIPs := StaleDNS(
+			*previous,
+			parseIPs(natpmpCR.Status.DNSAddresses...),
+			desired,
+			parseIPs(addresses...),
+		)
+
+		client, err := reconciler.dnsClient(ctx, natpmpCR.Namespace, previous.RFC2136)
+		if err != nil {
+			return err
+		}
+
+		if err := client.Delete(ctx, removed, parseIPs(natpmpCR.Status.DNSAddresses...)); err != nil {
+			return fmt.Errorf("unable to remove hostnames from %s: %w", previous.RFC2136.Server, err)
+		}
+
+		if err := client.Delete(ctx, kept, staleIPs); err != nil {
+			return fmt.Errorf("unable to remove records from %s: %w", previous.RFC2136.Server, err)
+		}
+	}
+
+	if desired == nil {
+		return nil
+	}
+
+	client, err := reconciler.dnsClient(ctx, natpmpCR.Namespace, desired.RFC2136)
+	if err != nil {
+		return err
+	}
+
+	err = client.Update(ctx, desired.Hostnames, uint32(natpmpCR.Spec.DNS.TTL), parseIPs(addresses...))
+	if err != nil {
+		return fmt.Errorf("unable to update hostnames on %s: %w", desired.RFC2136.Server, err)
+	}
+
+	return nil
+}
+
+// canonicalName returns the DNS name without its trailing dot, lowercased,
+// for comparison.
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// StaleDNS compares the previous update with the desired one. It returns the
+// hostnames to remove entirely, and the hostnames kept with addresses of the
+// record types that are no longer published for them. Moving to another
+// nameserver or zone removes every previous hostname.
+func StaleDNS(
+	previous networkv1.DNSStatus,
+	previousIPs []net.IP,
+	desired *networkv1.DNSStatus,
+	ips []net.IP,
+) ([]string, []string, []net.IP) {
+	if desired == nil ||
+		desired.RFC2136.Server != previous.RFC2136.Server ||
+		canonicalName(desired.RFC2136.Zone) != canonicalName(previous.RFC2136.Zone) {
+		return previous.Hostnames, nil, nil
+	}
+
+	listed := make(map[string]struct{}, len(desired.Hostnames))
+	for _, hostname := range desired.Hostnames {
+		listed[canonicalName(hostname)] = struct{}{}
+	}
+
+	var removed, kept []string
+
+	for _, hostname := range previous.Hostnames {
+		if _, ok := listed[canonicalName(hostname)]; ok {
+			kept = append(kept, hostname)
+		} else {
+			removed = append(removed, hostname)
+		}
+	}
+
+	published := map[string]struct{}{}
+	for _, ip := range ips {
+		published[recordType(ip)] = struct{}{}
+	}
+
+	var staleIPs []net.IP
+
+	for _, ip := range previousIPs {
+		if _, ok := published[recordType(ip)]; !ok {
+			staleIPs = append(staleIPs, ip)
+		}
+	}
+
+	return removed, kept, staleIPs
+}
+
+// dnsClient returns the client for the nameserver, signing with the TSIG key
+// from the namespace if it has one.
+func (reconciler *NatPMPReconciler) dnsClient(
+	ctx context.Context,
+	namespace string,
+	server networkv1.RFC2136,
+) (*rfc2136.Client, error) {
+	var tsig *rfc2136.TSIG
+
+	if server.TSIGSecretRef != nil {
+		var err error
+
+		tsig, err = reconciler.tsig(ctx, namespace, &server)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rfc2136.NewClient(server.Server, server.Zone, tsig), nil
+}
+
+// setDNSFinalizer adds or removes the DNS finalizer, so the records are
+// removed from the nameserver before the NatPMP is deleted.
+func (reconciler *NatPMPReconciler) setDNSFinalizer(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	add bool,
+) error {
+	if controllerutil.ContainsFinalizer(natpmpCR, dnsFinalizer) == add {
+		return nil
+	}
+
+	patch := client.MergeFrom(natpmpCR.DeepCopy())
+
+	if add {
+		controllerutil.AddFinalizer(natpmpCR, dnsFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(natpmpCR, dnsFinalizer)
+	}
+
+	if err := reconciler.Patch(ctx, natpmpCR, patch); err != nil {
+		return WrapError(ctx, err, "unable to update NatPMP finalizers")
+	}
+
+	return nil
+}
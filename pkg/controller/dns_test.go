@@ -0,0 +1,206 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// nameserver is an in-process nameserver accepting unsigned updates and
+// recording the names whose records were replaced or removed.
+type nameserver struct {
+	addr    string
+	updates chan *dns.Msg
+}
+
+func serveDNS(t *testing.T) *nameserver {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &nameserver{addr: conn.LocalAddr().String(), updates: make(chan *dns.Msg, 16)}
+	started := make(chan struct{})
+
+	dnsServer := &dns.Server{
+		PacketConn:        conn,
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+		Handler: dns.HandlerFunc(func(writer dns.ResponseWriter, req *dns.Msg) {
+			server.updates <- req
+
+			response := new(dns.Msg)
+			response.SetReply(req)
+			_ = writer.WriteMsg(response)
+		}),
+	}
+
+	go func() { _ = dnsServer.ActivateAndServe() }()
+
+	t.Cleanup(func() { _ = dnsServer.Shutdown() })
+
+	<-started
+
+	return server
+}
+
+// next returns the names whose records the next update removed and the
+// names it inserted records for.
+func (server *nameserver) next(t *testing.T) ([]string, []string) {
+	t.Helper()
+
+	var update *dns.Msg
+	select {
+	case update = <-server.updates:
+	default:
+		require.FailNow(t, "no update was sent")
+	}
+
+	var removed, inserted []string
+
+	for _, record := range update.Ns {
+		if record.Header().Class == dns.ClassANY {
+			removed = append(removed, record.Header().Name)
+		} else {
+			inserted = append(inserted, record.Header().Name)
+		}
+	}
+
+	sort.Strings(removed)
+	sort.Strings(inserted)
+
+	return removed, inserted
+}
+
+func publishingDNS(server *nameserver, hostnames ...string) *networkv1.NatPMP {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+	natpmpCR.Spec.DNS = &networkv1.DNS{
+		Hostnames: hostnames,
+		TTL:       60,
+		RFC2136:   &networkv1.RFC2136{Server: server.addr, Zone: "example.com"},
+	}
+
+	return natpmpCR
+}
+
+func TestReconcileDNS(t *testing.T) {
+	server := serveDNS(t)
+	natpmpCR := publishingDNS(server, "home.example.com", "www.example.com")
+	test := newTestReconciler(t, natpmpCR)
+
+	_, stored := test.reconcile(t, natpmpCR)
+	require.True(t, controllerutil.ContainsFinalizer(stored, dnsFinalizer))
+	require.Equal(t, []string{"home.example.com", "www.example.com"}, stored.Status.DNS.Hostnames)
+
+	_, inserted := server.next(t)
+	require.Equal(t, []string{"home.example.com.", "www.example.com."}, inserted)
+
+	// A hostname dropped from the spec is removed from the nameserver.
+	stored.Spec.DNS.Hostnames = []string{"home.example.com"}
+	stored.Generation++
+	require.NoError(t, test.Update(context.Background(), stored))
+
+	_, stored = test.reconcile(t, natpmpCR)
+	require.Equal(t, []string{"home.example.com"}, stored.Status.DNS.Hostnames)
+
+	removed, inserted := server.next(t)
+	require.Equal(t, []string{"www.example.com."}, removed)
+	require.Empty(t, inserted)
+
+	removed, inserted = server.next(t)
+	require.Equal(t, []string{"home.example.com."}, removed, "the A records are replaced")
+	require.Equal(t, []string{"home.example.com."}, inserted)
+
+	// Suspending releases the mapping and removes every hostname.
+	stored.Spec.Suspend = true
+	stored.Generation++
+	require.NoError(t, test.Update(context.Background(), stored))
+
+	_, stored = test.reconcile(t, natpmpCR)
+	require.Nil(t, stored.Status.DNS)
+	require.Empty(t, stored.Status.DNSAddresses)
+	require.False(t, controllerutil.ContainsFinalizer(stored, dnsFinalizer))
+
+	removed, inserted = server.next(t)
+	require.Equal(t, []string{"home.example.com."}, removed)
+	require.Empty(t, inserted)
+}
+
+func TestReconcileDNSDelete(t *testing.T) {
+	server := serveDNS(t)
+	natpmpCR := publishingDNS(server, "home.example.com")
+	test := newTestReconciler(t, natpmpCR)
+
+	_, stored := test.reconcile(t, natpmpCR)
+	_, _ = server.next(t)
+
+	require.NoError(t, test.Delete(context.Background(), stored))
+
+	_, err := test.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: client.ObjectKeyFromObject(natpmpCR),
+	})
+	require.NoError(t, err)
+
+	removed, _ := server.next(t)
+	require.Equal(t, []string{"home.example.com."}, removed)
+
+	requests := test.gateway.Requests()
+	require.Zero(t, requests[len(requests)-1].Lifetime, "the mapping is released")
+
+	err = test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &networkv1.NatPMP{})
+	require.True(t, apierrors.IsNotFound(err), "the finalizer is removed")
+}
+
+func TestStaleDNS(t *testing.T) {
+	server := networkv1.RFC2136{Server: "192.0.2.53:53", Zone: "example.com"}
+	previous := networkv1.DNSStatus{RFC2136: server, Hostnames: []string{"home.example.com", "www.example.com"}}
+	previousIPs := parseIPs("203.0.113.1", "2001:db8::1")
+
+	removed, kept, stale := StaleDNS(previous, previousIPs, nil, nil)
+	require.Equal(t, previous.Hostnames, removed)
+	require.Empty(t, kept)
+	require.Empty(t, stale)
+
+	moved := &networkv1.DNSStatus{
+		RFC2136:   networkv1.RFC2136{Server: "192.0.2.54:53", Zone: "example.com"},
+		Hostnames: previous.Hostnames,
+	}
+	removed, _, _ = StaleDNS(previous, previousIPs, moved, previousIPs)
+	require.Equal(t, previous.Hostnames, removed, "a new nameserver removes every hostname")
+
+	desired := &networkv1.DNSStatus{RFC2136: server, Hostnames: []string{"HOME.example.com."}}
+	removed, kept, stale = StaleDNS(previous, previousIPs, desired, parseIPs("203.0.113.2"))
+	require.Equal(t, []string{"www.example.com"}, removed)
+	require.Equal(t, []string{"home.example.com"}, kept)
+	require.Equal(t, parseIPs("2001:db8::1"), stale, "the AAAA records are no longer published")
+}
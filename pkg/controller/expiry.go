@@ -0,0 +1,155 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+// now returns the current time of the reconciler's clock.
+func (reconciler *NatPMPReconciler) now() time.Time {
+	if reconciler.Clock == nil {
+		return time.Now()
+	}
+
+	return reconciler.Clock.Now()
+}
+
+// Deadline returns when the NatPMP expires, the earlier of ExpiresAt and the
+// TTL after creation. It returns false if the NatPMP does not expire.
+func Deadline(natpmpCR networkv1.NatPMP) (time.Time, bool) {
+	var deadline time.Time
+
+	if natpmpCR.Spec.ExpiresAt != nil {
+		deadline = natpmpCR.Spec.ExpiresAt.Time
+	}
+
+	if natpmpCR.Spec.TTL != nil {
+		ttlDeadline := natpmpCR.CreationTimestamp.Add(natpmpCR.Spec.TTL.Duration)
+		if deadline.IsZero() || ttlDeadline.Before(deadline) {
+			deadline = ttlDeadline
+		}
+	}
+
+	return deadline, !deadline.IsZero()
+}
+
+// Expired returns true if the NatPMP has passed its deadline at now.
+func Expired(natpmpCR networkv1.NatPMP, now time.Time) bool {
+	deadline, ok := Deadline(natpmpCR)
+
+	return ok && !now.Before(deadline)
+}
+
+// RequestedLifetime returns the lifetime to request for the NatPMP at now,
+// capped so the mapping does not outlive the deadline. The cap is rounded up
+// to whole seconds and is at least one, since zero deletes the mapping.
+func RequestedLifetime(natpmpCR networkv1.NatPMP, now time.Time) int {
+	lifetime := natpmpCR.Spec.Lifetime
+
+	deadline, ok := Deadline(natpmpCR)
+	if !ok {
+		return lifetime
+	}
+
+	remaining := int((deadline.Sub(now) + time.Second - 1) / time.Second)
+	if remaining < 1 {
+		remaining = 1
+	}
+
+	if remaining < lifetime {
+		return remaining
+	}
+
+	return lifetime
+}
+
+// ExpiryRequeueAfter caps requeue so the NatPMP is reconciled at its
+// deadline.
+func ExpiryRequeueAfter(natpmpCR networkv1.NatPMP, requeue time.Duration, now time.Time) time.Duration {
+	deadline, ok := Deadline(natpmpCR)
+	if !ok {
+		return requeue
+	}
+
+	if until := deadline.Sub(now); until < requeue {
+		return until
+	}
+
+	return requeue
+}
+
+// ClearExpired drops the expired condition once the NatPMP is mapped again,
+// after its deadline was extended.
+func ClearExpired(status *networkv1.NatPMPStatus) {
+	meta.RemoveStatusCondition(&status.Conditions, networkv1.ConditionExpired)
+}
+
+// Expire releases the port mapping of an expired NatPMP and marks it
+// expired, deleting it when DeleteOnExpiry is set. Deleting the NatPMP
+// garbage collects the templated objects it owns.
+func (reconciler *NatPMPReconciler) Expire(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+) error {
+	err := reconciler.pause(ctx, natpmpCR, gateways, protocol, func(status *networkv1.NatPMPStatus) {
+		SetCondition(
+			natpmpCR,
+			status,
+			networkv1.ConditionExpired,
+			metav1.ConditionTrue,
+			networkv1.ReasonExpired,
+			"port mapping is released since the NatPMP expired",
+		)
+		SetCondition(
+			natpmpCR,
+			status,
+			networkv1.ConditionReady,
+			metav1.ConditionFalse,
+			networkv1.ReasonExpired,
+			"NatPMP expired",
+		)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !natpmpCR.Spec.DeleteOnExpiry {
+		return nil
+	}
+
+	Info(ctx, "deleting expired NatPMP", "namespace", natpmpCR.Namespace, "name", natpmpCR.Name)
+
+	err = reconciler.Delete(ctx, natpmpCR, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if err != nil && !apierrors.IsNotFound(err) {
+		return WrapError(ctx, err, "unable to delete expired NatPMP")
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+var created = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func expiring(ttl time.Duration) *networkv1.NatPMP {
+	return &networkv1.NatPMP{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "default",
+			Name:              "debug",
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: networkv1.NatPMPSpec{
+			Gateway:      "192.0.2.1",
+			Protocol:     "tcp",
+			ExternalPort: 2222,
+			InternalPort: 22,
+			Lifetime:     3600,
+			TTL:          &metav1.Duration{Duration: ttl},
+		},
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	natpmpCR := expiring(2 * time.Hour)
+
+	deadline, ok := Deadline(*natpmpCR)
+	require.True(t, ok)
+	require.Equal(t, created.Add(2*time.Hour), deadline)
+
+	expiresAt := metav1.NewTime(created.Add(time.Hour))
+	natpmpCR.Spec.ExpiresAt = &expiresAt
+
+	deadline, ok = Deadline(*natpmpCR)
+	require.True(t, ok)
+	require.Equal(t, created.Add(time.Hour), deadline)
+
+	_, ok = Deadline(networkv1.NatPMP{})
+	require.False(t, ok)
+}
+
+func TestRequestedLifetime(t *testing.T) {
+	natpmpCR := *expiring(2 * time.Hour)
+	fakeClock := clocktesting.NewFakePassiveClock(created)
+
+	require.Equal(t, 3600, RequestedLifetime(natpmpCR, fakeClock.Now()))
+
+	fakeClock.SetTime(created.Add(90 * time.Minute))
+	require.Equal(t, 1800, RequestedLifetime(natpmpCR, fakeClock.Now()))
+
+	fakeClock.SetTime(created.Add(2*time.Hour - 1500*time.Millisecond))
+	require.Equal(t, 2, RequestedLifetime(natpmpCR, fakeClock.Now()))
+	require.False(t, Expired(natpmpCR, fakeClock.Now()))
+
+	fakeClock.SetTime(created.Add(2 * time.Hour))
+	require.Equal(t, 1, RequestedLifetime(natpmpCR, fakeClock.Now()))
+	require.True(t, Expired(natpmpCR, fakeClock.Now()))
+
+	require.Equal(
+		t,
+		30*time.Minute,
+		ExpiryRequeueAfter(natpmpCR, time.Hour, created.Add(90*time.Minute)),
+	)
+}
+
+func reconcileExpired(t *testing.T, natpmpCR *networkv1.NatPMP) client.Client {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, networkv1.AddToScheme(scheme))
+
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(natpmpCR).
+		WithStatusSubresource(natpmpCR).
+		Build()
+
+	reconciler := &NatPMPReconciler{
+		Client: fakeClient,
+		Scheme: scheme,
+		Clock:  clocktesting.NewFakePassiveClock(created.Add(3 * time.Hour)),
+	}
+
+	_, err := reconciler.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: client.ObjectKeyFromObject(natpmpCR),
+	})
+	require.NoError(t, err)
+
+	return fakeClient
+}
+
+func TestReconcileExpired(t *testing.T) {
+	natpmpCR := expiring(2 * time.Hour)
+	fakeClient := reconcileExpired(t, natpmpCR)
+
+	var expired networkv1.NatPMP
+	require.NoError(t, fakeClient.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &expired))
+	require.True(t, meta.IsStatusConditionTrue(expired.Status.Conditions, networkv1.ConditionExpired))
+	require.True(t, meta.IsStatusConditionFalse(expired.Status.Conditions, networkv1.ConditionReady))
+}
+
+func TestReconcileExpiredDelete(t *testing.T) {
+	natpmpCR := expiring(2 * time.Hour)
+	natpmpCR.Spec.DeleteOnExpiry = true
+	fakeClient := reconcileExpired(t, natpmpCR)
+
+	var deleted networkv1.NatPMP
+	err := fakeClient.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &deleted)
+	require.True(t, apierrors.IsNotFound(err))
+}
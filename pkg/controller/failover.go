@@ -0,0 +1,282 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+const (
+	// serviceNameField indexes NatPMPs by the Service they target.
+	serviceNameField = "spec.target.serviceName"
+
+	// podSelectorField indexes the NatPMPs targeting a pod selector under
+	// hasPodSelector. Selectors cannot be matched through an index, but
+	// only these NatPMPs need their selector matched against a pod.
+	podSelectorField = "spec.target.podSelector"
+
+	// hasPodSelector is the podSelectorField value of the NatPMPs
+	// targeting a pod selector.
+	hasPodSelector = "true"
+)
+
+// Failover is the state of the active node of a NatPMP.
+type Failover struct {
+	// UnreadySince is when the active node lost its last ready backend, nil
+	// while it has one.
+	UnreadySince *metav1.Time
+
+	// RecheckAfter is how long until the hysteresis of the active node runs
+	// out, zero if the mapping is not being held on an unready node.
+	RecheckAfter time.Duration
+}
+
+// SelectBackend picks the backend the mapping points at. A backend on the
+// active node is preferred so the mapping does not move while that node is
+// healthy. Once the active node has no ready backend, the mapping is held on
+// it for the hysteresis period before moving to the first backend.
+func SelectBackend(
+	backends []ResolvedTarget,
+	status networkv1.NatPMPStatus,
+	hysteresis time.Duration,
+	now time.Time,
+) (*ResolvedTarget, Failover, error) {
+	if status.ActiveNode != "" {
+		for idx := range backends {
+			if backends[idx].NodeName == status.ActiveNode {
+				return &backends[idx], Failover{}, nil
+			}
+		}
+
+		if hysteresis > 0 && len(status.Mappings) > 0 {
+			since := metav1.NewTime(now)
+			if status.ActiveNodeUnreadySince != nil {
+				since = *status.ActiveNodeUnreadySince
+			}
+
+			if remaining := since.Add(hysteresis).Sub(now); remaining > 0 {
+				return heldTarget(status), Failover{
+					UnreadySince: &since,
+					RecheckAfter: remaining,
+				}, nil
+			}
+		}
+	}
+
+	if len(backends) == 0 {
+		return nil, Failover{}, fmt.Errorf("%w: no ready backend", ErrTargetUnavailable)
+	}
+
+	return &backends[0], Failover{}, nil
+}
+
+// heldTarget returns the target of the mappings in the status.
+func heldTarget(status networkv1.NatPMPStatus) *ResolvedTarget {
+	target := &ResolvedTarget{NodeName: status.ActiveNode}
+
+	for _, mapping := range status.Mappings {
+		target.IPs = append(target.IPs, parseIPs(mapping.InternalIP)...)
+	}
+
+	return target
+}
+
+// SetActiveNode records the node the mapping points at in the status.
+func SetActiveNode(status *networkv1.NatPMPStatus, target *ResolvedTarget, failover Failover) {
+	status.ActiveNode = ""
+	if target != nil {
+		status.ActiveNode = target.NodeName
+	}
+
+	status.ActiveNodeUnreadySince = failover.UnreadySince
+}
+
+// Moved returns true if the mappings in the status point at addresses other
+// than the target.
+func Moved(status networkv1.NatPMPStatus, target *ResolvedTarget) bool {
+	if target == nil {
+		return false
+	}
+
+	for _, mapping := range status.Mappings {
+		if mapping.InternalIP == "" {
+			continue
+		}
+
+		if ip := target.IP(mapping.IPFamily); ip == nil || ip.String() != mapping.InternalIP {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requeueAfter returns the sooner of the renewal and the failover recheck.
+func requeueAfter(renewAfter time.Duration, failover Failover) time.Duration {
+	if failover.RecheckAfter > 0 && failover.RecheckAfter < renewAfter {
+		renewAfter = failover.RecheckAfter
+	}
+
+	if renewAfter < 0 {
+		renewAfter = 0
+	}
+
+	return renewAfter
+}
+
+// indexServiceName returns the Service targeted by the NatPMP for the field
+// index.
+func indexServiceName(object client.Object) []string {
+	natpmpCR, ok := object.(*networkv1.NatPMP)
+	if !ok || natpmpCR.Spec.Target == nil || natpmpCR.Spec.Target.ServiceName == "" {
+		return nil
+	}
+
+	return []string{natpmpCR.Spec.Target.ServiceName}
+}
+
+// requestsFor returns a request for each NatPMP.
+func requestsFor(natpmps []networkv1.NatPMP) []reconcile.Request {
+	requests := make([]reconcile.Request, 0, len(natpmps))
+	for idx := range natpmps {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: client.ObjectKeyFromObject(&natpmps[idx]),
+		})
+	}
+
+	return requests
+}
+
+// mapEndpointSlice returns the NatPMPs targeting the Service of the
+// EndpointSlice.
+func (reconciler *NatPMPReconciler) mapEndpointSlice(
+	ctx context.Context,
+	object client.Object,
+) []reconcile.Request {
+	slice, ok := object.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil
+	}
+
+	serviceName := slice.Labels[discoveryv1.LabelServiceName]
+	if serviceName == "" {
+		return nil
+	}
+
+	var natpmps networkv1.NatPMPList
+
+	err := reconciler.List(
+		ctx,
+		&natpmps,
+		client.InNamespace(slice.Namespace),
+		client.MatchingFields{serviceNameField: serviceName},
+	)
+	if err != nil {
+		Error(ctx, err, "unable to list NatPMPs for endpoint slice", "name", slice.Name)
+
+		return nil
+	}
+
+	return requestsFor(natpmps.Items)
+}
+
+// mapPod returns the NatPMPs whose pod selector matches the pod.
+func (reconciler *NatPMPReconciler) mapPod(
+	ctx context.Context,
+	object client.Object,
+) []reconcile.Request {
+	pod, ok := object.(*corev1.Pod)
+	if !ok {
+		return nil
+	}
+
+	var natpmps networkv1.NatPMPList
+
+	err := reconciler.List(
+		ctx,
+		&natpmps,
+		client.InNamespace(pod.Namespace),
+		client.MatchingFields{podSelectorField: hasPodSelector},
+	)
+	if err != nil {
+		Error(ctx, err, "unable to list NatPMPs for pod", "name", pod.Name)
+
+		return nil
+	}
+
+	matched := make([]networkv1.NatPMP, 0, len(natpmps.Items))
+
+	for _, natpmpCR := range natpmps.Items {
+		if natpmpCR.Spec.Target == nil || natpmpCR.Spec.Target.PodSelector == nil {
+			continue
+		}
+
+		selector, err := metav1.LabelSelectorAsSelector(natpmpCR.Spec.Target.PodSelector)
+		if err != nil {
+			continue
+		}
+
+		if selector.Matches(labels.Set(pod.Labels)) {
+			matched = append(matched, natpmpCR)
+		}
+	}
+
+	return requestsFor(matched)
+}
+
+// indexPodSelector returns hasPodSelector for a NatPMP targeting a pod
+// selector for the field index.
+func indexPodSelector(object client.Object) []string {
+	natpmpCR, ok := object.(*networkv1.NatPMP)
+	if !ok || natpmpCR.Spec.Target == nil || natpmpCR.Spec.Target.PodSelector == nil {
+		return nil
+	}
+
+	return []string{hasPodSelector}
+}
+
+// podChanged returns true if the update changes whether or where the pod
+// can be a backend, skipping the status churn of running pods.
+func podChanged(update event.UpdateEvent) bool {
+	oldPod, ok := update.ObjectOld.(*corev1.Pod)
+	if !ok {
+		return true
+	}
+
+	newPod, ok := update.ObjectNew.(*corev1.Pod)
+	if !ok {
+		return true
+	}
+
+	return isPodReady(oldPod) != isPodReady(newPod) ||
+		oldPod.Spec.NodeName != newPod.Spec.NodeName ||
+		!labels.Equals(oldPod.Labels, newPod.Labels) ||
+		!equality.Semantic.DeepEqual(oldPod.Status.PodIPs, newPod.Status.PodIPs)
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+func readyPod(labels map[string]string, ip string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0", Labels: labels},
+		Spec:       corev1.PodSpec{NodeName: "node-a"},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIPs:     []corev1.PodIP{{IP: ip}},
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func TestMapPod(t *testing.T) {
+	selecting := mapped()
+	selecting.Name = "selecting"
+	selecting.Spec.Target = &networkv1.Target{
+		PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+	}
+
+	other := mapped()
+	other.Name = "other"
+	other.Spec.Target = &networkv1.Target{
+		PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+	}
+
+	service := mapped()
+	service.Name = "service"
+	service.Spec.Target = &networkv1.Target{ServiceName: "web"}
+
+	test := newTestReconciler(t, selecting, other, service, mapped())
+
+	requests := test.mapPod(context.Background(), readyPod(map[string]string{"app": "web"}, "10.0.0.1"))
+	require.Len(t, requests, 1)
+	require.Equal(t, "selecting", requests[0].Name)
+
+	require.Empty(t, test.mapPod(context.Background(), readyPod(nil, "10.0.0.1")))
+}
+
+func TestPodChanged(t *testing.T) {
+	pod := readyPod(map[string]string{"app": "web"}, "10.0.0.1")
+
+	unready := pod.DeepCopy()
+	unready.Status.Conditions[0].Status = corev1.ConditionFalse
+
+	relabeled := pod.DeepCopy()
+	relabeled.Labels["app"] = "db"
+
+	readdressed := pod.DeepCopy()
+	readdressed.Status.PodIPs[0].IP = "10.0.0.2"
+
+	churned := pod.DeepCopy()
+	churned.ResourceVersion = "2"
+	churned.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "web", RestartCount: 1}}
+
+	for name, test := range map[string]struct {
+		updated *corev1.Pod
+		changed bool
+	}{
+		"unready":     {updated: unready, changed: true},
+		"relabeled":   {updated: relabeled, changed: true},
+		"readdressed": {updated: readdressed, changed: true},
+		"churned":     {updated: churned, changed: false},
+	} {
+		require.Equal(t, test.changed, podChanged(event.UpdateEvent{
+			ObjectOld: pod,
+			ObjectNew: test.updated,
+		}), name)
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	nodeA := ResolvedTarget{NodeName: "node-a", IPs: []net.IP{net.ParseIP("10.0.0.1")}}
+	nodeB := ResolvedTarget{NodeName: "node-b", IPs: []net.IP{net.ParseIP("10.0.0.2")}}
+
+	held := networkv1.NatPMPStatus{
+		ActiveNode: "node-a",
+		Mappings:   []networkv1.MappingStatus{{IPFamily: "IPv4", InternalIP: "10.0.0.1"}},
+	}
+
+	unreadySince := metav1.NewTime(created.Add(-time.Minute))
+	heldUnready := *held.DeepCopy()
+	heldUnready.ActiveNodeUnreadySince = &unreadySince
+
+	for name, test := range map[string]struct {
+		backends   []ResolvedTarget
+		status     networkv1.NatPMPStatus
+		hysteresis time.Duration
+		node       string
+		ip         string
+		since      *time.Time
+		recheck    time.Duration
+		moved      bool
+		err        error
+	}{
+		"first backend": {
+			backends: []ResolvedTarget{nodeA, nodeB},
+			node:     "node-a",
+			ip:       "10.0.0.1",
+		},
+		"stays on the active node": {
+			backends: []ResolvedTarget{nodeA, nodeB},
+			status:   networkv1.NatPMPStatus{ActiveNode: "node-b"},
+			node:     "node-b",
+			ip:       "10.0.0.2",
+		},
+		"moves without hysteresis": {
+			backends: []ResolvedTarget{nodeB},
+			status:   held,
+			node:     "node-b",
+			ip:       "10.0.0.2",
+			moved:    true,
+		},
+		"holds when the node goes unready": {
+			backends:   []ResolvedTarget{nodeB},
+			status:     held,
+			hysteresis: 5 * time.Minute,
+			node:       "node-a",
+			ip:         "10.0.0.1",
+			since:      &created,
+			recheck:    5 * time.Minute,
+		},
+		"holds for the rest of the hysteresis": {
+			backends:   []ResolvedTarget{nodeB},
+			status:     heldUnready,
+			hysteresis: 5 * time.Minute,
+			node:       "node-a",
+			ip:         "10.0.0.1",
+			since:      &unreadySince.Time,
+			recheck:    4 * time.Minute,
+		},
+		"moves once the hysteresis runs out": {
+			backends:   []ResolvedTarget{nodeB},
+			status:     heldUnready,
+			hysteresis: time.Minute,
+			node:       "node-b",
+			ip:         "10.0.0.2",
+			moved:      true,
+		},
+		"holds without a backend": {
+			status:     held,
+			hysteresis: 5 * time.Minute,
+			node:       "node-a",
+			ip:         "10.0.0.1",
+			since:      &created,
+			recheck:    5 * time.Minute,
+		},
+		"fails without a backend": {
+			status: held,
+			err:    ErrTargetUnavailable,
+		},
+		"does not hold an unmapped node": {
+			backends:   []ResolvedTarget{nodeB},
+			status:     networkv1.NatPMPStatus{ActiveNode: "node-a"},
+			hysteresis: 5 * time.Minute,
+			node:       "node-b",
+			ip:         "10.0.0.2",
+		},
+	} {
+		target, failover, err := SelectBackend(test.backends, test.status, test.hysteresis, created)
+		if test.err != nil {
+			require.ErrorIs(t, err, test.err, name)
+
+			continue
+		}
+
+		require.NoError(t, err, name)
+		require.Equal(t, test.node, target.NodeName, name)
+		require.Equal(t, test.ip, target.IP(corev1.IPv4Protocol).String(), name)
+		require.Equal(t, test.recheck, failover.RecheckAfter, name)
+
+		if test.since == nil {
+			require.Nil(t, failover.UnreadySince, name)
+		} else {
+			require.NotNil(t, failover.UnreadySince, name)
+			require.True(t, test.since.Equal(failover.UnreadySince.Time), name)
+		}
+
+		status := test.status.DeepCopy()
+		SetActiveNode(status, target, failover)
+		require.Equal(t, test.node, status.ActiveNode, name)
+		require.Equal(t, test.moved, Moved(test.status, target), name)
+	}
+}
+
+func TestRequeueAfter(t *testing.T) {
+	require.Equal(t, time.Hour, requeueAfter(time.Hour, Failover{}))
+	require.Equal(t, time.Minute, requeueAfter(time.Hour, Failover{RecheckAfter: time.Minute}))
+	require.Equal(t, time.Minute, requeueAfter(time.Minute, Failover{RecheckAfter: time.Hour}))
+	require.Zero(t, requeueAfter(-time.Minute, Failover{}))
+}
+
+func TestReconcileFailoverHysteresis(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+	natpmpCR.Spec.Target = &networkv1.Target{
+		PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		HysteresisSeconds: 300,
+	}
+
+	podA := readyPod(map[string]string{"app": "web"}, "10.0.0.1")
+	test := newTestReconciler(t, natpmpCR, podA)
+
+	_, stored := test.reconcile(t, natpmpCR)
+	require.Equal(t, "node-a", stored.Status.ActiveNode)
+	require.Equal(t, "10.0.0.1", stored.Status.Mappings[0].InternalIP)
+
+	// The backend on node-a goes unready while one on node-b is ready.
+	podA.Status.Conditions[0].Status = corev1.ConditionFalse
+	require.NoError(t, test.Status().Update(context.Background(), podA))
+
+	podB := readyPod(map[string]string{"app": "web"}, "10.0.0.2")
+	podB.Name = "web-1"
+	podB.Spec.NodeName = "node-b"
+	require.NoError(t, test.Create(context.Background(), podB))
+
+	test.clock.Step(time.Minute)
+	result, stored := test.reconcile(t, natpmpCR)
+	require.Equal(t, 5*time.Minute, result.RequeueAfter)
+	require.Equal(t, "node-a", stored.Status.ActiveNode)
+	require.NotNil(t, stored.Status.ActiveNodeUnreadySince)
+	require.Equal(t, "10.0.0.1", stored.Status.Mappings[0].InternalIP)
+
+	// The mapping moves once the hysteresis runs out.
+	test.clock.Step(5 * time.Minute)
+	_, stored = test.reconcile(t, natpmpCR)
+	require.Equal(t, "node-b", stored.Status.ActiveNode)
+	require.Nil(t, stored.Status.ActiveNodeUnreadySince)
+	require.Equal(t, "10.0.0.2", stored.Status.Mappings[0].InternalIP)
+}
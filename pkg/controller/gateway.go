@@ -0,0 +1,482 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+	"github.com/jkoelker/natpmp-controller/pkg/settings"
+)
+
+const (
+	// gatewayRefField indexes NatPMPs by the NatPMPGateway they reference.
+	gatewayRefField = "spec.gatewayRef"
+
+	// defaultProbeInterval is how often a NatPMPGateway is probed when its
+	// spec does not say.
+	defaultProbeInterval = time.Minute
+)
+
+// GatewayConfig is the gateway a NatPMP maps its port through.
+type GatewayConfig struct {
+	// Name is the name of the NatPMPGateway, empty when the NatPMP sets the
+	// gateway address itself.
+	Name string
+
+	// Address is the address of the gateway.
+	Address net.IP
+
+	// Options configure the clients for the gateway.
+	Options gateway.Options
+
+	// AllowedPortRanges are the external ports that may be requested.
+	AllowedPortRanges []networkv1.PortRange
+}
+
+// Limiters holds the rate limiter of each NatPMPGateway so the limit applies
+// across reconciles. The zero value is ready to use.
+type Limiters struct {
+	mu      sync.Mutex
+	entries map[string]*rate.Limiter
+}
+
+// Get returns the limiter for the gateway, updated to the limit. It returns
+// nil when the gateway has no limit.
+func (limiters *Limiters) Get(name string, limit *networkv1.RateLimit) *rate.Limiter {
+	limiters.mu.Lock()
+	defer limiters.mu.Unlock()
+
+	if limit == nil {
+		delete(limiters.entries, name)
+
+		return nil
+	}
+
+	burst := limit.Burst
+	if burst == 0 {
+		burst = limit.RequestsPerSecond
+	}
+
+	if limiters.entries == nil {
+		limiters.entries = map[string]*rate.Limiter{}
+	}
+
+	limiter, ok := limiters.entries[name]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(limit.RequestsPerSecond), burst)
+		limiters.entries[name] = limiter
+
+		return limiter
+	}
+
+	limiter.SetLimit(rate.Limit(limit.RequestsPerSecond))
+	limiter.SetBurst(burst)
+
+	return limiter
+}
+
+// gatewayAddress returns the address of the NatPMPGateway, discovering the
+// default gateway of the host when it has none.
+func gatewayAddress(natpmpGateway *networkv1.NatPMPGateway) (net.IP, error) {
+	if natpmpGateway.Spec.Address == "" {
+		address, err := gateway.Discover()
+		if err != nil {
+			return nil, fmt.Errorf("unable to discover gateway: %w", err)
+		}
+
+		return address, nil
+	}
+
+	address := net.ParseIP(natpmpGateway.Spec.Address)
+	if address == nil {
+		return nil, fmt.Errorf("invalid gateway address %q", natpmpGateway.Spec.Address)
+	}
+
+	return address, nil
+}
+
+// gatewayOptions returns the client options of the NatPMPGateway.
+func gatewayOptions(natpmpGateway *networkv1.NatPMPGateway, limiter *rate.Limiter) gateway.Options {
+	opts := gateway.Options{
+		Backend: natpmpGateway.Spec.Backend,
+		Limiter: limiter,
+	}
+
+	if natpmpGateway.Spec.RequestTimeout != nil {
+		opts.Timeout = natpmpGateway.Spec.RequestTimeout.Duration
+	}
+
+	return opts
+}
+
+//+kubebuilder:rbac:groups=network.natpmp.jkoelker.github.io,resources=natpmpgateways,verbs=get;list;watch
+//+kubebuilder:rbac:groups=network.natpmp.jkoelker.github.io,resources=natpmpgateways/status,verbs=get;update;patch
+
+// ResolveGateway returns the NatPMPGateway referenced by the NatPMP. When
+// the NatPMP sets the gateway address itself only the configured options
+// are returned.
+func (reconciler *NatPMPReconciler) ResolveGateway(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+) (*GatewayConfig, error) {
+	timeout := reconciler.Settings.Get().Gateway.RequestTimeout.Duration
+
+	name := natpmpCR.Spec.GatewayRef
+	if name == "" {
+		return &GatewayConfig{Options: gateway.Options{Timeout: timeout}}, nil
+	}
+
+	if reconciler.Namespaced {
+		return nil, fmt.Errorf("%w: NatPMPGateway %s", ErrNamespaced, name)
+	}
+
+	var natpmpGateway networkv1.NatPMPGateway
+	if err := reconciler.Get(ctx, types.NamespacedName{Name: name}, &natpmpGateway); err != nil {
+		return nil, fmt.Errorf("unable to fetch NatPMPGateway %s: %w", name, err)
+	}
+
+	address, err := gatewayAddress(&natpmpGateway)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := reconciler.limiters.Get(name, natpmpGateway.Spec.RateLimit)
+
+	opts := gatewayOptions(&natpmpGateway, limiter)
+	if opts.Timeout == 0 {
+		opts.Timeout = timeout
+	}
+
+	return &GatewayConfig{
+		Name:              name,
+		Address:           address,
+		Options:           opts,
+		AllowedPortRanges: natpmpGateway.Spec.AllowedPortRanges,
+	}, nil
+}
+
+// GatewayClients returns the client for the gateway of each IP family, made
+// with newClient or gateway.NewWithOptions if it is nil.
+func GatewayClients(
+	gateways map[corev1.IPFamily]net.IP,
+	config *GatewayConfig,
+	newClient func(net.IP, gateway.Options) gateway.Client,
+) map[corev1.IPFamily]gateway.Client {
+	var opts gateway.Options
+	if config != nil {
+		opts = config.Options
+	}
+
+	if newClient == nil {
+		newClient = gateway.NewWithOptions
+	}
+
+	clients := make(map[corev1.IPFamily]gateway.Client, len(gateways))
+	for family, address := range gateways {
+		clients[family] = newClient(address, opts)
+	}
+
+	return clients
+}
+
+// PortAllowed returns true if the port is in one of the ranges, or there are
+// no ranges.
+func PortAllowed(port int, ranges []networkv1.PortRange) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+
+	for _, portRange := range ranges {
+		end := portRange.End
+		if end == 0 {
+			end = portRange.Start
+		}
+
+		if port >= portRange.Start && port <= end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mapGateway returns the NatPMPs referencing the NatPMPGateway.
+func (reconciler *NatPMPReconciler) mapGateway(
+	ctx context.Context,
+	object client.Object,
+) []reconcile.Request {
+	var natpmps networkv1.NatPMPList
+
+	err := reconciler.List(ctx, &natpmps, client.MatchingFields{gatewayRefField: object.GetName()})
+	if err != nil {
+		Error(ctx, err, "unable to list NatPMPs for gateway", "name", object.GetName())
+
+		return nil
+	}
+
+	return requestsFor(natpmps.Items)
+}
+
+// indexGatewayRef returns the NatPMPGateway referenced by the NatPMP for the
+// field index.
+func indexGatewayRef(object client.Object) []string {
+	natpmpCR, ok := object.(*networkv1.NatPMP)
+	if !ok || natpmpCR.Spec.GatewayRef == "" {
+		return nil
+	}
+
+	return []string{natpmpCR.Spec.GatewayRef}
+}
+
+// NatPMPGatewayReconciler probes each NatPMPGateway and reports its health
+// and the mappings held through it.
+type NatPMPGatewayReconciler struct {
+	client.Client
+
+	// Shard is the set of gateways that are probed, every gateway if nil.
+	Shard *settings.Shard
+}
+
+// Reconcile probes the gateway and updates its status.
+func (reconciler *NatPMPGatewayReconciler) Reconcile(
+	ctx context.Context,
+	req ctrl.Request,
+) (ctrl.Result, error) {
+	var natpmpGateway networkv1.NatPMPGateway
+	if err := reconciler.Get(ctx, req.NamespacedName, &natpmpGateway); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Another manager probes the gateways of other shards.
+	if !reconciler.serves(&natpmpGateway) {
+		return ctrl.Result{}, nil
+	}
+
+	interval := defaultProbeInterval
+	if natpmpGateway.Spec.ProbeInterval != nil && natpmpGateway.Spec.ProbeInterval.Duration > 0 {
+		interval = natpmpGateway.Spec.ProbeInterval.Duration
+	}
+
+	mappings, err := reconciler.mappings(ctx, natpmpGateway.Name)
+	if err != nil {
+		return ctrl.Result{}, WrapError(ctx, err, "unable to list mappings")
+	}
+
+	original := natpmpGateway.DeepCopy()
+	status := &natpmpGateway.Status
+	status.Mappings = mappings
+
+	// Mapping changes only refresh the list, the gateway is probed once per
+	// interval.
+	probeIn := interval
+
+	var probeErr error
+
+	if nextProbe := reconciler.nextProbe(&natpmpGateway, interval); nextProbe > 0 {
+		probeIn = nextProbe
+	} else {
+		probeErr = reconciler.probe(ctx, &natpmpGateway)
+	}
+
+	if probeErr != nil {
+		status.Reachable = false
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               networkv1.ConditionReachable,
+			Status:             metav1.ConditionFalse,
+			ObservedGeneration: natpmpGateway.Generation,
+			Reason:             networkv1.ReasonProbeFailed,
+			Message:            probeErr.Error(),
+		})
+	}
+
+	if !equality.Semantic.DeepEqual(original.Status, natpmpGateway.Status) {
+		if err := reconciler.Status().Patch(ctx, &natpmpGateway, client.MergeFrom(original)); err != nil {
+			return ctrl.Result{}, WrapError(ctx, err, "unable to update NatPMPGateway status")
+		}
+	}
+
+	if probeErr != nil {
+		Error(ctx, probeErr, "unable to probe gateway", "name", natpmpGateway.Name)
+	}
+
+	return ctrl.Result{RequeueAfter: probeIn}, nil
+}
+
+// serves returns true if the shard of the reconciler includes the gateway.
+func (reconciler *NatPMPGatewayReconciler) serves(natpmpGateway *networkv1.NatPMPGateway) bool {
+	address, err := gatewayAddress(natpmpGateway)
+	if err != nil {
+		return reconciler.Shard.Serves(natpmpGateway.Name)
+	}
+
+	return reconciler.Shard.Serves(natpmpGateway.Name, address)
+}
+
+// nextProbe returns how long until the gateway is due to be probed, zero
+// when it is due now.
+func (reconciler *NatPMPGatewayReconciler) nextProbe(
+	natpmpGateway *networkv1.NatPMPGateway,
+	interval time.Duration,
+) time.Duration {
+	condition := meta.FindStatusCondition(natpmpGateway.Status.Conditions, networkv1.ConditionReachable)
+	if condition == nil ||
+		condition.ObservedGeneration != natpmpGateway.Generation ||
+		condition.Status != metav1.ConditionTrue ||
+		natpmpGateway.Status.LastContact == nil {
+		return 0
+	}
+
+	nextProbe := time.Until(natpmpGateway.Status.LastContact.Add(interval))
+	if nextProbe < renewSlack {
+		return 0
+	}
+
+	return nextProbe
+}
+
+// probe records the result of a successful probe of the gateway in its
+// status.
+func (reconciler *NatPMPGatewayReconciler) probe(
+	ctx context.Context,
+	natpmpGateway *networkv1.NatPMPGateway,
+) error {
+	address, err := gatewayAddress(natpmpGateway)
+	if err != nil {
+		return err
+	}
+
+	natpmpGateway.Status.Address = address.String()
+
+	probed, err := gateway.Probe(ctx, address, gatewayOptions(natpmpGateway, nil))
+	if err != nil {
+		return err
+	}
+
+	status := &natpmpGateway.Status
+	now := metav1.Now()
+
+	status.Reachable = true
+	status.LastContact = &now
+	status.SecondsSinceStartOfEpoch = probed.SecondsSinceStartOfEpoch
+
+	switch {
+	case probed.ExternalIP != nil:
+		status.ExternalIP = probed.ExternalIP.String()
+	case len(status.Mappings) > 0:
+		status.ExternalIP = status.Mappings[0].ExternalIP
+	}
+
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               networkv1.ConditionReachable,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: natpmpGateway.Generation,
+		Reason:             networkv1.ReasonProbeSucceeded,
+		Message:            "gateway answered the probe",
+	})
+
+	return nil
+}
+
+// mappings returns the port mappings held through the gateway, sorted by
+// NatPMP. The NatPMPs are looked up through the gatewayRefField index
+// registered by the NatPMPReconciler.
+func (reconciler *NatPMPGatewayReconciler) mappings(
+	ctx context.Context,
+	name string,
+) ([]networkv1.GatewayMapping, error) {
+	var natpmps networkv1.NatPMPList
+
+	err := reconciler.List(ctx, &natpmps, client.MatchingFields{gatewayRefField: name})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list NatPMPs: %w", err)
+	}
+
+	sort.Slice(natpmps.Items, func(i, j int) bool {
+		left, right := natpmps.Items[i], natpmps.Items[j]
+		if left.Namespace != right.Namespace {
+			return left.Namespace < right.Namespace
+		}
+
+		return left.Name < right.Name
+	})
+
+	var mappings []networkv1.GatewayMapping
+
+	for _, natpmpCR := range natpmps.Items {
+		for _, mapping := range natpmpCR.Status.Mappings {
+			mappings = append(mappings, networkv1.GatewayMapping{
+				Namespace:    natpmpCR.Namespace,
+				Name:         natpmpCR.Name,
+				Protocol:     strings.ToLower(natpmpCR.Spec.Protocol),
+				ExternalIP:   mapping.ExternalIP,
+				ExternalPort: mapping.MappedExternalPort,
+				InternalIP:   mapping.InternalIP,
+				InternalPort: mapping.MappedInternalPort,
+			})
+		}
+	}
+
+	return mappings, nil
+}
+
+// mapNatPMP returns the NatPMPGateway referenced by the NatPMP.
+func (reconciler *NatPMPGatewayReconciler) mapNatPMP(
+	_ context.Context,
+	object client.Object,
+) []reconcile.Request {
+	natpmpCR, ok := object.(*networkv1.NatPMP)
+	if !ok || natpmpCR.Spec.GatewayRef == "" {
+		return nil
+	}
+
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: natpmpCR.Spec.GatewayRef}}}
+}
+
+// SetupWithManager sets up the gateway controller with the Manager.
+func (reconciler *NatPMPGatewayReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := ctrl.NewControllerManagedBy(mgr).
+		For(&networkv1.NatPMPGateway{}).
+		Watches(
+			&networkv1.NatPMP{},
+			handler.EnqueueRequestsFromMapFunc(reconciler.mapNatPMP),
+		).
+		Complete(reconciler)
+	if err != nil {
+		return fmt.Errorf("unable to complete gateway controller: %w", err)
+	}
+
+	return nil
+}
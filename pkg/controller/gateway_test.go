@@ -0,0 +1,73 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+func TestGatewayMappings(t *testing.T) {
+	holding := func(name string, gatewayRef string, externalPort int) *networkv1.NatPMP {
+		natpmpCR := mapped()
+		natpmpCR.Name = name
+		natpmpCR.Spec.Gateway = ""
+		natpmpCR.Spec.GatewayRef = gatewayRef
+		natpmpCR.Status.Mappings = []networkv1.MappingStatus{{
+			IPFamily:           "IPv4",
+			ExternalIP:         "203.0.113.1",
+			MappedExternalPort: externalPort,
+			MappedInternalPort: 22,
+		}}
+
+		return natpmpCR
+	}
+
+	test := newTestReconciler(
+		t,
+		holding("web", "home", 8080),
+		holding("ssh", "home", 2222),
+		holding("other", "office", 2223),
+	)
+
+	gatewayReconciler := &NatPMPGatewayReconciler{Client: test.Client}
+
+	mappings, err := gatewayReconciler.mappings(context.Background(), "home")
+	require.NoError(t, err)
+	require.Equal(t, []networkv1.GatewayMapping{
+		{
+			Namespace:    "default",
+			Name:         "ssh",
+			Protocol:     "tcp",
+			ExternalIP:   "203.0.113.1",
+			ExternalPort: 2222,
+			InternalPort: 22,
+		},
+		{
+			Namespace:    "default",
+			Name:         "web",
+			Protocol:     "tcp",
+			ExternalIP:   "203.0.113.1",
+			ExternalPort: 8080,
+			InternalPort: 22,
+		},
+	}, mappings)
+}
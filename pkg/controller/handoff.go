@@ -0,0 +1,110 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// restoreSpread bounds the random delay added to the renewal of a lease
+// restored from the status, so a new leader does not renew every mapping at
+// once.
+const restoreSpread = time.Minute
+
+// MappedForGeneration returns true if the status holds port mappings made
+// for the current generation of the NatPMP.
+func MappedForGeneration(natpmpCR networkv1.NatPMP) bool {
+	if len(natpmpCR.Status.Mappings) == 0 {
+		return false
+	}
+
+	ready := meta.FindStatusCondition(natpmpCR.Status.Conditions, networkv1.ConditionReady)
+
+	return ready != nil &&
+		ready.Status == metav1.ConditionTrue &&
+		ready.ObservedGeneration == natpmpCR.Generation
+}
+
+// RequestedPort returns the external port to request for the IP family. A
+// mapping made for the current generation is renewed with the port the
+// gateway mapped, so the port survives a restart, except with the preferred
+// policy which asks for the requested port again on every renewal.
+func RequestedPort(natpmpCR networkv1.NatPMP, family corev1.IPFamily) int {
+	port := ExternalPort(natpmpCR)
+
+	if PortPolicy(natpmpCR) == networkv1.PortPolicyPreferred || !MappedForGeneration(natpmpCR) {
+		return port
+	}
+
+	for _, mapping := range natpmpCR.Status.Mappings {
+		if mapping.IPFamily == family && mapping.MappedExternalPort != 0 {
+			return mapping.MappedExternalPort
+		}
+	}
+
+	return port
+}
+
+// RestoreLease rebuilds the lease for the port mappings recorded in the
+// status, so that a controller taking over renews them when due instead of
+// requesting them again. The fraction is the part of the lifetime after
+// which mappings are renewed. It returns false if the status holds no live
+// mapping for the current generation.
+func RestoreLease(
+	natpmpCR networkv1.NatPMP,
+	target string,
+	fraction float64,
+	now time.Time,
+) (Lease, bool) {
+	status := natpmpCR.Status
+
+	if !MappedForGeneration(natpmpCR) || status.RenewedAt == nil || status.ExpiresAt == nil {
+		return Lease{}, false
+	}
+
+	if !status.ExpiresAt.Time.After(now) {
+		return Lease{}, false
+	}
+
+	renewAt := status.RenewedAt.Add(renewIn(MappedLifetime(status.Mappings), fraction))
+	if renewAt.Before(now) {
+		renewAt = now
+	}
+
+	// Spread the renewals over part of the time left before expiry.
+	spread := status.ExpiresAt.Sub(renewAt) / 2
+	if spread > restoreSpread {
+		spread = restoreSpread
+	}
+
+	if spread > 0 {
+		renewAt = renewAt.Add(time.Duration(rand.Int63nRange(0, int64(spread))))
+	}
+
+	return Lease{
+		Generation: natpmpCR.Generation,
+		Target:     target,
+		RenewAt:    renewAt,
+	}, true
+}
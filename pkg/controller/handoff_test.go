@@ -0,0 +1,111 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// held returns a NatPMP whose status holds a mapping on port 3333 with a
+// lifetime of an hour, renewed at renewedAt.
+func held(renewedAt time.Time) *networkv1.NatPMP {
+	natpmpCR := mapped()
+	natpmpCR.Generation = 1
+
+	SetMappings(natpmpCR, &natpmpCR.Status, []networkv1.MappingStatus{{
+		IPFamily:           "IPv4",
+		ExternalIP:         "203.0.113.1",
+		MappedExternalPort: 3333,
+		MappedInternalPort: 22,
+		MappedLifetime:     3600,
+	}}, renewedAt)
+
+	return natpmpCR
+}
+
+func TestRestoreLease(t *testing.T) {
+	natpmpCR := held(created)
+
+	lease, ok := RestoreLease(*natpmpCR, "target", 0.75, created.Add(10*time.Minute))
+	require.True(t, ok)
+	require.Equal(t, int64(1), lease.Generation)
+	require.Equal(t, "target", lease.Target)
+	require.False(t, lease.RenewAt.Before(created.Add(45*time.Minute)))
+	require.True(t, lease.RenewAt.Before(created.Add(46*time.Minute)), "the renewal is spread by at most a minute")
+
+	// A mapping already due is renewed before it expires.
+	lease, ok = RestoreLease(*natpmpCR, "target", 0.75, created.Add(50*time.Minute))
+	require.True(t, ok)
+	require.False(t, lease.RenewAt.Before(created.Add(50*time.Minute)))
+	require.True(t, lease.RenewAt.Before(created.Add(time.Hour)))
+
+	_, ok = RestoreLease(*natpmpCR, "target", 0.75, created.Add(time.Hour))
+	require.False(t, ok, "an expired mapping is requested again")
+
+	changed := natpmpCR.DeepCopy()
+	changed.Generation = 2
+	_, ok = RestoreLease(*changed, "target", 0.75, created)
+	require.False(t, ok, "a mapping of another generation is requested again")
+
+	notReady := natpmpCR.DeepCopy()
+	notReady.Status.Conditions[0].Status = metav1.ConditionFalse
+	_, ok = RestoreLease(*notReady, "target", 0.75, created)
+	require.False(t, ok)
+}
+
+func TestRequestedPort(t *testing.T) {
+	natpmpCR := held(created)
+	require.Equal(t, 3333, RequestedPort(*natpmpCR, "IPv4"), "the mapped port survives a restart")
+	require.Equal(t, 2222, RequestedPort(*natpmpCR, "IPv6"))
+
+	natpmpCR.Spec.PortPolicy = networkv1.PortPolicyPreferred
+	require.Equal(t, 2222, RequestedPort(*natpmpCR, "IPv4"))
+
+	natpmpCR.Spec.PortPolicy = ""
+	natpmpCR.Generation = 2
+	require.Equal(t, 2222, RequestedPort(*natpmpCR, "IPv4"), "a new generation asks for its port")
+}
+
+func TestReconcileRestoresLease(t *testing.T) {
+	natpmpCR := held(created)
+	natpmpCR.Spec.Templates = nil
+	natpmpCR.Status.ActiveNode = ""
+
+	test := newTestReconciler(t, natpmpCR)
+	test.clock.SetTime(created.Add(10 * time.Minute))
+
+	// A new leader adopts the mapping instead of requesting it again.
+	result, _ := test.reconcile(t, natpmpCR)
+	require.Empty(t, test.gateway.Requests())
+	require.GreaterOrEqual(t, result.RequeueAfter, 35*time.Minute)
+	require.Less(t, result.RequeueAfter, 36*time.Minute)
+
+	test.clock.SetTime(created.Add(46 * time.Minute))
+	_, stored := test.reconcile(t, natpmpCR)
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 1)
+	require.Equal(t, 3333, requests[0].ExternalPort)
+	require.Equal(t, 3333, stored.Status.MappedExternalPort)
+}
@@ -0,0 +1,540 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+const (
+	// cacheSyncTimeout is how long the readiness probe waits for the caches
+	// to sync.
+	cacheSyncTimeout = time.Second
+
+	// healthProbeTimeout bounds the probe of a gateway without a request
+	// timeout, since the retries of NAT-PMP alone take over a minute.
+	healthProbeTimeout = 10 * time.Second
+
+	// serverTimeout bounds reading the headers of a request to the probe
+	// and debug servers, and waiting for the requests in flight when they
+	// stop.
+	serverTimeout = 5 * time.Second
+)
+
+var (
+	// ErrCacheNotSynced is returned by the readiness probe until the caches
+	// have synced.
+	ErrCacheNotSynced = errors.New("caches have not synced")
+
+	// ErrGatewaysNotProbed is returned by the readiness probe until the
+	// gateways have been probed once.
+	ErrGatewaysNotProbed = errors.New("gateways have not been probed")
+
+	// ErrNoGatewayReachable is returned by the readiness probe when none of
+	// the gateways answered the last probe.
+	ErrNoGatewayReachable = errors.New("no gateway is reachable")
+
+	// ErrReconcileStalled is returned by the liveness probe when no
+	// reconcile in flight has returned within the stall timeout.
+	ErrReconcileStalled = errors.New("reconcile loop is stalled")
+)
+
+// CacheSynced returns a check that fails until the caches have synced.
+func CacheSynced(informers cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), cacheSyncTimeout)
+		defer cancel()
+
+		if !informers.WaitForCacheSync(ctx) {
+			return ErrCacheNotSynced
+		}
+
+		return nil
+	}
+}
+
+// Progress tracks the reconciles in flight, so a reconcile loop that is
+// wedged with work queued behind it fails the liveness probe. A nil Progress
+// tracks nothing.
+type Progress struct {
+	// Timeout is how long the reconciles in flight may go without one
+	// returning.
+	Timeout time.Duration
+
+	// Clock is the time source, the real clock if nil.
+	Clock clock.PassiveClock
+
+	mu       sync.Mutex
+	inflight int
+	last     time.Time
+}
+
+func (progress *Progress) now() time.Time {
+	if progress.Clock == nil {
+		return time.Now()
+	}
+
+	return progress.Clock.Now()
+}
+
+// Track records the start of a reconcile and returns the function recording
+// its end.
+func (progress *Progress) Track() func() {
+	if progress == nil {
+		return func() {}
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	if progress.inflight == 0 {
+		progress.last = progress.now()
+	}
+
+	progress.inflight++
+
+	return func() {
+		progress.mu.Lock()
+		defer progress.mu.Unlock()
+
+		progress.inflight--
+		progress.last = progress.now()
+	}
+}
+
+// Check fails when reconciles are in flight and none has returned within the
+// timeout. An idle loop, such as that of a manager that is not the leader,
+// passes.
+func (progress *Progress) Check(_ *http.Request) error {
+	if progress == nil {
+		return nil
+	}
+
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	if progress.inflight == 0 {
+		return nil
+	}
+
+	if stalled := progress.now().Sub(progress.last); stalled > progress.Timeout {
+		return fmt.Errorf(
+			"%w: %d reconciles in flight, none returned in %s",
+			ErrReconcileStalled,
+			progress.inflight,
+			stalled.Round(time.Second),
+		)
+	}
+
+	return nil
+}
+
+// GatewayStatus is the result of the last probe of a gateway.
+type GatewayStatus struct {
+	// Name is the name of the NatPMPGateway, empty when NatPMPs set the
+	// gateway address themselves.
+	Name string `json:"name,omitempty"`
+
+	// Address is the address of the gateway.
+	Address string `json:"address"`
+
+	// Reachable is true if the gateway answered the probe.
+	Reachable bool `json:"reachable"`
+
+	// ExternalIP is the external address the gateway reported.
+	ExternalIP string `json:"externalIP,omitempty"`
+
+	// SecondsSinceStartOfEpoch is the epoch the gateway reported.
+	SecondsSinceStartOfEpoch int `json:"secondsSinceStartOfEpoch,omitempty"`
+
+	// Error is why the probe failed.
+	Error string `json:"error,omitempty"`
+
+	// LastProbe is when the gateway was probed.
+	LastProbe time.Time `json:"lastProbe"`
+}
+
+// GatewayReport is the detail of the gateway readiness check.
+type GatewayReport struct {
+	// Ready is true if the check passes.
+	Ready bool `json:"ready"`
+
+	// Error is why the check fails.
+	Error string `json:"error,omitempty"`
+
+	// Gateways are the statuses of the gateways, ordered by name and
+	// address.
+	Gateways []GatewayStatus `json:"gateways"`
+}
+
+// probeTarget is a gateway to probe and the options of its clients.
+type probeTarget struct {
+	name    string
+	address net.IP
+	opts    gateway.Options
+}
+
+// GatewayHealth probes the gateways the NatPMPs of the reconciler map their
+// ports through, along with the default gateway, for the readiness probe.
+// The probes run in the background since a gateway may take longer to
+// answer than the kubelet waits.
+type GatewayHealth struct {
+	// Reconciler resolves the gateways the way it does for its NatPMPs.
+	Reconciler *NatPMPReconciler
+
+	// Interval is how often the gateways are probed.
+	Interval time.Duration
+
+	mu       sync.Mutex
+	probed   bool
+	statuses []GatewayStatus
+}
+
+// Check fails until the gateways have been probed and while none of them
+// answered. Without any gateway there is nothing to reach, so it passes.
+func (health *GatewayHealth) Check(_ *http.Request) error {
+	_, err := health.report()
+
+	return err
+}
+
+// report returns the statuses of the gateways and the result of the check.
+func (health *GatewayHealth) report() ([]GatewayStatus, error) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	if !health.probed {
+		return nil, ErrGatewaysNotProbed
+	}
+
+	if len(health.statuses) == 0 {
+		return health.statuses, nil
+	}
+
+	failures := make([]string, 0, len(health.statuses))
+
+	for _, status := range health.statuses {
+		if status.Reachable {
+			return health.statuses, nil
+		}
+
+		failures = append(failures, status.Address+": "+status.Error)
+	}
+
+	return health.statuses, fmt.Errorf("%w: %s", ErrNoGatewayReachable, strings.Join(failures, "; "))
+}
+
+// ServeHTTP reports the status of each gateway as JSON.
+func (health *GatewayHealth) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	statuses, err := health.report()
+
+	report := GatewayReport{Ready: err == nil, Gateways: statuses}
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	if report.Gateways == nil {
+		report.Gateways = []GatewayStatus{}
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+	}
+
+	if err := json.NewEncoder(resp).Encode(report); err != nil {
+		Error(req.Context(), err, "unable to write gateway report")
+	}
+}
+
+// targets returns the gateways of the shard of the reconciler.
+func (health *GatewayHealth) targets(ctx context.Context) ([]probeTarget, error) {
+	reconciler := health.Reconciler
+
+	timeout := reconciler.Settings.Get().Gateway.RequestTimeout.Duration
+	if timeout == 0 {
+		timeout = healthProbeTimeout
+	}
+
+	targets := map[string]probeTarget{}
+
+	addAddress := func(address net.IP) {
+		if address == nil || !reconciler.Shard.Serves("", address) {
+			return
+		}
+
+		targets[address.String()] = probeTarget{
+			address: address,
+			opts:    gateway.Options{Timeout: timeout},
+		}
+	}
+
+	if defaultGateway := reconciler.Settings.Get().Defaults.Gateway; defaultGateway != "" {
+		addAddress(net.ParseIP(defaultGateway))
+	}
+
+	// NatPMPGateways are cluster-scoped.
+	if !reconciler.Namespaced {
+		var natpmpGateways networkv1.NatPMPGatewayList
+		if err := reconciler.List(ctx, &natpmpGateways); err != nil {
+			return nil, fmt.Errorf("unable to list NatPMPGateways: %w", err)
+		}
+
+		for idx := range natpmpGateways.Items {
+			natpmpGateway := &natpmpGateways.Items[idx]
+
+			address, err := gatewayAddress(natpmpGateway)
+			if err != nil {
+				Error(ctx, err, "unable to resolve gateway", "name", natpmpGateway.Name)
+
+				continue
+			}
+
+			if !reconciler.Shard.Serves(natpmpGateway.Name, address) {
+				continue
+			}
+
+			limiter := reconciler.limiters.Get(natpmpGateway.Name, natpmpGateway.Spec.RateLimit)
+
+			opts := gatewayOptions(natpmpGateway, limiter)
+			if opts.Timeout == 0 {
+				opts.Timeout = timeout
+			}
+
+			targets["gateway/"+natpmpGateway.Name] = probeTarget{
+				name:    natpmpGateway.Name,
+				address: address,
+				opts:    opts,
+			}
+		}
+	}
+
+	var natpmps networkv1.NatPMPList
+	if err := reconciler.List(ctx, &natpmps); err != nil {
+		return nil, fmt.Errorf("unable to list NatPMPs: %w", err)
+	}
+
+	for _, natpmpCR := range natpmps.Items {
+		if natpmpCR.Spec.GatewayRef != "" {
+			continue
+		}
+
+		defaulted := reconciler.Defaulted(natpmpCR)
+		addAddress(net.ParseIP(defaulted.Spec.Gateway))
+		addAddress(net.ParseIP(defaulted.Spec.IPv6Gateway))
+	}
+
+	result := make([]probeTarget, 0, len(targets))
+	for _, target := range targets {
+		result = append(result, target)
+	}
+
+	return result, nil
+}
+
+// Probe probes each of the gateways and records their statuses.
+func (health *GatewayHealth) Probe(ctx context.Context) error {
+	targets, err := health.targets(ctx)
+	if err != nil {
+		return err
+	}
+
+	statuses := make([]GatewayStatus, len(targets))
+
+	var wg sync.WaitGroup
+
+	for idx, target := range targets {
+		wg.Add(1)
+
+		go func(idx int, target probeTarget) {
+			defer wg.Done()
+
+			statuses[idx] = probeStatus(ctx, target)
+		}(idx, target)
+	}
+
+	wg.Wait()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Name != statuses[j].Name {
+			return statuses[i].Name < statuses[j].Name
+		}
+
+		return statuses[i].Address < statuses[j].Address
+	})
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	health.probed = true
+	health.statuses = statuses
+
+	return nil
+}
+
+// probeStatus probes the gateway for its external address.
+func probeStatus(ctx context.Context, target probeTarget) GatewayStatus {
+	status := GatewayStatus{
+		Name:      target.name,
+		Address:   target.address.String(),
+		LastProbe: time.Now(),
+	}
+
+	probed, err := gateway.Probe(ctx, target.address, target.opts)
+	if err != nil {
+		status.Error = err.Error()
+
+		return status
+	}
+
+	status.Reachable = true
+	status.SecondsSinceStartOfEpoch = probed.SecondsSinceStartOfEpoch
+
+	if probed.ExternalIP != nil {
+		status.ExternalIP = probed.ExternalIP.String()
+	}
+
+	return status
+}
+
+// Start probes the gateways every interval until the context is done.
+func (health *GatewayHealth) Start(ctx context.Context) error {
+	interval := health.Interval
+	if interval == 0 {
+		interval = defaultProbeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := health.Probe(ctx); err != nil {
+			Error(ctx, err, "unable to probe gateways")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection returns false since every manager reports its own
+// readiness.
+func (health *GatewayHealth) NeedLeaderElection() bool {
+	return false
+}
+
+// ProbeServer serves the liveness checks at /healthz and the readiness
+// checks at /readyz, each check also on its own below them. Unlike the probe
+// server of the manager it serves details of a check instead of only whether
+// it passed.
+type ProbeServer struct {
+	// Addr is the address the server binds to, "0" disables it.
+	Addr string
+
+	// Liveness are the checks of the liveness probe.
+	Liveness map[string]healthz.Checker
+
+	// Readiness are the checks of the readiness probe.
+	Readiness map[string]healthz.Checker
+
+	// Details are served at /readyz/<name> in place of the readiness check
+	// of that name.
+	Details map[string]http.Handler
+}
+
+// Start serves the probes until the context is done. It runs apart from the
+// manager, so the liveness probe passes while the caches sync.
+func (server *ProbeServer) Start(ctx context.Context) error {
+	if server.Addr == "0" {
+		<-ctx.Done()
+
+		return nil
+	}
+
+	mux := http.NewServeMux()
+
+	liveness := http.StripPrefix("/healthz", &healthz.Handler{Checks: server.Liveness})
+	mux.Handle("/healthz", liveness)
+	mux.Handle("/healthz/", liveness)
+
+	readiness := http.StripPrefix("/readyz", &healthz.Handler{Checks: server.Readiness})
+	mux.Handle("/readyz", readiness)
+	mux.Handle("/readyz/", readiness)
+
+	for name, handler := range server.Details {
+		mux.Handle("/readyz/"+name, handler)
+	}
+
+	return serve(ctx, server.Addr, mux)
+}
+
+// serve serves the handler on the address until the context is done.
+func serve(ctx context.Context, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", addr, err)
+	}
+
+	httpServer := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: serverTimeout,
+	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverTimeout)
+		defer cancel()
+
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			Error(ctx, err, "unable to shut down server", "address", addr)
+		}
+	}()
+
+	if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("unable to serve on %s: %w", addr, err)
+	}
+
+	<-stopped
+
+	return nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestProgress(t *testing.T) {
+	fakeClock := clocktesting.NewFakePassiveClock(created)
+	progress := &Progress{Timeout: time.Minute, Clock: fakeClock}
+
+	fakeClock.SetTime(created.Add(time.Hour))
+	require.NoError(t, progress.Check(nil))
+
+	done := progress.Track()
+	fakeClock.SetTime(created.Add(time.Hour + 30*time.Second))
+	require.NoError(t, progress.Check(nil))
+
+	fakeClock.SetTime(created.Add(time.Hour + 2*time.Minute))
+	require.ErrorIs(t, progress.Check(nil), ErrReconcileStalled)
+
+	done()
+	require.NoError(t, progress.Check(nil))
+
+	var untracked *Progress
+	untracked.Track()()
+	require.NoError(t, untracked.Check(nil))
+}
+
+func TestGatewayHealth(t *testing.T) {
+	health := &GatewayHealth{}
+	require.ErrorIs(t, health.Check(nil), ErrGatewaysNotProbed)
+
+	health.probed = true
+	require.NoError(t, health.Check(nil))
+
+	health.statuses = []GatewayStatus{
+		{Address: "192.0.2.1", Error: "timeout"},
+		{Name: "site-b", Address: "198.51.100.1", Error: "timeout"},
+	}
+	require.ErrorIs(t, health.Check(nil), ErrNoGatewayReachable)
+
+	recorder := httptest.NewRecorder()
+	health.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz/gateways", nil))
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+
+	health.statuses[1].Reachable = true
+	health.statuses[1].Error = ""
+	require.NoError(t, health.Check(nil))
+
+	recorder = httptest.NewRecorder()
+	health.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz/gateways", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var report GatewayReport
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	require.True(t, report.Ready)
+	require.Len(t, report.Gateways, 2)
+	require.Equal(t, "site-b", report.Gateways[1].Name)
+}
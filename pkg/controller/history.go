@@ -0,0 +1,180 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+// historySize is how many gateway requests the history keeps.
+const historySize = 256
+
+// GatewayRequest is a request made to a gateway and its outcome.
+type GatewayRequest struct {
+	// Time is when the request was made.
+	Time time.Time `json:"time"`
+
+	// Gateway is the address of the gateway.
+	Gateway string `json:"gateway"`
+
+	// NatPMP is the namespace and name of the NatPMP the request was made
+	// for.
+	NatPMP string `json:"natpmp"`
+
+	// Protocol is "tcp" or "udp".
+	Protocol string `json:"protocol"`
+
+	// InternalPort is the port on the internal host.
+	InternalPort int `json:"internalPort"`
+
+	// ExternalPort is the requested external port.
+	ExternalPort int `json:"externalPort"`
+
+	// Lifetime is the requested lifetime in seconds, 0 releases the
+	// mapping.
+	Lifetime int `json:"lifetime"`
+
+	// MappedExternalPort is the external port the gateway assigned.
+	MappedExternalPort int `json:"mappedExternalPort,omitempty"`
+
+	// MappedLifetime is the lifetime in seconds the gateway assigned.
+	MappedLifetime int `json:"mappedLifetime,omitempty"`
+
+	// SecondsSinceStartOfEpoch is the epoch the gateway reported.
+	SecondsSinceStartOfEpoch int `json:"secondsSinceStartOfEpoch,omitempty"`
+
+	// Duration is how long the gateway took to answer.
+	Duration string `json:"duration"`
+
+	// Error is why the request failed.
+	Error string `json:"error,omitempty"`
+}
+
+// History keeps the most recent requests made to the gateways. The zero
+// value is ready to use.
+type History struct {
+	mu      sync.Mutex
+	entries []GatewayRequest
+	next    int
+}
+
+// Record adds the request to the history, dropping the oldest once full.
+func (history *History) Record(request GatewayRequest) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	if len(history.entries) < historySize {
+		history.entries = append(history.entries, request)
+
+		return
+	}
+
+	history.entries[history.next] = request
+	history.next = (history.next + 1) % historySize
+}
+
+// Requests returns the requests in the history, newest first.
+func (history *History) Requests() []GatewayRequest {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	requests := make([]GatewayRequest, 0, len(history.entries))
+
+	for idx := len(history.entries) - 1; idx >= 0; idx-- {
+		requests = append(requests, history.entries[(history.next+idx)%len(history.entries)])
+	}
+
+	return requests
+}
+
+// recordingClient records the requests made through a gateway client in the
+// history.
+type recordingClient struct {
+	gateway.Client
+
+	history *History
+	natpmp  types.NamespacedName
+	address string
+	now     func() time.Time
+}
+
+// AddPortMapping implements gateway.Client.
+func (recording *recordingClient) AddPortMapping(
+	ctx context.Context,
+	req gateway.Request,
+) (*gateway.Mapping, error) {
+	start := recording.now()
+
+	mapping, err := recording.Client.AddPortMapping(ctx, req)
+
+	request := GatewayRequest{
+		Time:         start,
+		Gateway:      recording.address,
+		NatPMP:       recording.natpmp.String(),
+		Protocol:     req.Protocol,
+		InternalPort: req.InternalPort,
+		ExternalPort: req.ExternalPort,
+		Lifetime:     req.Lifetime,
+		Duration:     recording.now().Sub(start).String(),
+	}
+
+	if err != nil {
+		request.Error = err.Error()
+	}
+
+	if mapping != nil {
+		request.MappedExternalPort = mapping.ExternalPort
+		request.MappedLifetime = mapping.Lifetime
+		request.SecondsSinceStartOfEpoch = mapping.SecondsSinceStartOfEpoch
+	}
+
+	recording.history.Record(request)
+
+	return mapping, err
+}
+
+// gatewayClients returns the client for the gateway of each IP family of the
+// NatPMP, recording their requests in the history of the reconciler.
+func (reconciler *NatPMPReconciler) gatewayClients(
+	natpmpCR networkv1.NatPMP,
+	addresses map[corev1.IPFamily]net.IP,
+	config *GatewayConfig,
+) map[corev1.IPFamily]gateway.Client {
+	clients := GatewayClients(addresses, config, reconciler.NewGatewayClient)
+
+	for family, gatewayClient := range clients {
+		clients[family] = &recordingClient{
+			Client:  gatewayClient,
+			history: &reconciler.history,
+			natpmp:  client.ObjectKeyFromObject(&natpmpCR),
+			address: addresses[family].String(),
+			now:     reconciler.now,
+		}
+	}
+
+	return clients
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// renewSlack is how close to the renewal time a lease is considered due, so a
+// requeue that fires a hair early still renews.
+const renewSlack = time.Second
+
+// Lease is the controller's record of a port mapping held on a gateway.
+type Lease struct {
+	// Generation is the NatPMP generation the mapping was made for.
+	Generation int64
+
+	// Target identifies the resolved target and external port the mapping
+	// was made for.
+	Target string
+
+	// RenewAt is when the mapping should next be renewed.
+	RenewAt time.Time
+}
+
+// Leases tracks the port mappings held on behalf of each NatPMP, so that
+// reconciles triggered by anything other than a renewal do not call the
+// gateway. The zero value is ready to use.
+type Leases struct {
+	mu      sync.Mutex
+	entries map[types.NamespacedName]Lease
+}
+
+// Set records the lease for the NatPMP.
+func (leases *Leases) Set(name types.NamespacedName, lease Lease) {
+	leases.mu.Lock()
+	defer leases.mu.Unlock()
+
+	if leases.entries == nil {
+		leases.entries = map[types.NamespacedName]Lease{}
+	}
+
+	leases.entries[name] = lease
+}
+
+// Restore records the lease for the NatPMP unless one is already held. It
+// returns true if the lease was recorded.
+func (leases *Leases) Restore(name types.NamespacedName, lease Lease) bool {
+	leases.mu.Lock()
+	defer leases.mu.Unlock()
+
+	if _, ok := leases.entries[name]; ok {
+		return false
+	}
+
+	if leases.entries == nil {
+		leases.entries = map[types.NamespacedName]Lease{}
+	}
+
+	leases.entries[name] = lease
+
+	return true
+}
+
+// Get returns the lease for the NatPMP and true if one is held.
+func (leases *Leases) Get(name types.NamespacedName) (Lease, bool) {
+	leases.mu.Lock()
+	defer leases.mu.Unlock()
+
+	lease, ok := leases.entries[name]
+
+	return lease, ok
+}
+
+// Forget drops the lease for the NatPMP.
+func (leases *Leases) Forget(name types.NamespacedName) {
+	leases.mu.Lock()
+	defer leases.mu.Unlock()
+
+	delete(leases.entries, name)
+}
+
+// Due makes the lease for the NatPMP due at now, so its next reconcile
+// renews the mapping instead of restoring the lease from the status.
+func (leases *Leases) Due(name types.NamespacedName, now time.Time) {
+	leases.mu.Lock()
+	defer leases.mu.Unlock()
+
+	if lease, ok := leases.entries[name]; ok {
+		lease.RenewAt = now
+		leases.entries[name] = lease
+	}
+}
+
+// Names returns the NatPMPs a lease is held for.
+func (leases *Leases) Names() []types.NamespacedName {
+	leases.mu.Lock()
+	defer leases.mu.Unlock()
+
+	names := make([]types.NamespacedName, 0, len(leases.entries))
+	for name := range leases.entries {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// RenewIn returns how long until the lease for the NatPMP must be renewed.
+// It returns false if there is no lease for the generation and target or it
+// is due.
+func (leases *Leases) RenewIn(
+	name types.NamespacedName,
+	generation int64,
+	target string,
+	now time.Time,
+) (time.Duration, bool) {
+	leases.mu.Lock()
+	defer leases.mu.Unlock()
+
+	lease, ok := leases.entries[name]
+	if !ok || lease.Generation != generation || lease.Target != target {
+		return 0, false
+	}
+
+	renewAfter := lease.RenewAt.Sub(now)
+	if renewAfter < renewSlack {
+		return 0, false
+	}
+
+	return renewAfter, true
+}
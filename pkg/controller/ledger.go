@@ -0,0 +1,701 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+	"github.com/jkoelker/natpmp-controller/pkg/settings"
+)
+
+const (
+	// ledgerLabel marks the ConfigMaps that record the port mappings held
+	// on a gateway.
+	ledgerLabel = "natpmp.jkoelker.github.io/ledger"
+
+	// ledgerPrefix prefixes the names of the ledger ConfigMaps.
+	ledgerPrefix = "natpmp-ledger-"
+
+	// sweepInterval is how often the ledger is swept for orphaned mappings.
+	sweepInterval = 5 * time.Minute
+)
+
+// ErrInvalidLedgerEntry is returned for a ledger entry that cannot be
+// released.
+var ErrInvalidLedgerEntry = errors.New("invalid ledger entry")
+
+// orphanedMappings counts the mappings found on a gateway whose NatPMP no
+// longer exists.
+var orphanedMappings = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "natpmp_orphaned_mappings_total",
+		Help: "Number of port mappings found whose NatPMP no longer exists.",
+	},
+	[]string{"gateway", "released"},
+)
+
+// LedgerEntry is the record of a port mapping held on a gateway.
+type LedgerEntry struct {
+	// Namespace is the namespace of the NatPMP the mapping is held for.
+	Namespace string `json:"namespace"`
+
+	// Name is the name of the NatPMP the mapping is held for.
+	Name string `json:"name"`
+
+	// UID is the UID of the NatPMP, so a recreated NatPMP does not adopt
+	// the mapping.
+	UID types.UID `json:"uid"`
+
+	// GatewayRef is the NatPMPGateway the mapping was made through.
+	GatewayRef string `json:"gatewayRef,omitempty"`
+
+	// Gateway is the address of the gateway.
+	Gateway string `json:"gateway"`
+
+	// IPFamily is the address family of the mapping.
+	IPFamily corev1.IPFamily `json:"ipFamily"`
+
+	// Protocol is the protocol of the mapping.
+	Protocol string `json:"protocol"`
+
+	// InternalIP is the internal address of the mapping, if known.
+	InternalIP string `json:"internalIP,omitempty"`
+
+	// InternalPort is the internal port of the mapping.
+	InternalPort int `json:"internalPort"`
+
+	// ExternalPort is the external port of the mapping.
+	ExternalPort int `json:"externalPort"`
+
+	// Nonce is the hex encoded PCP mapping nonce, needed to release the
+	// mapping from a PCP gateway.
+	Nonce string `json:"nonce,omitempty"`
+
+	// Lifetime is the longest lifetime in seconds the mapping was granted.
+	// A mapping whose NatPMP is gone is no longer renewed, so it expires
+	// within a lifetime of the NatPMP being found gone.
+	Lifetime int `json:"lifetime"`
+}
+
+// Ledger keeps a durable record of the port mappings the controller holds,
+// one ConfigMap per gateway, and sweeps it for mappings whose NatPMP no
+// longer exists so they do not linger until they expire.
+type Ledger struct {
+	client.Client
+
+	// Namespace is the namespace of the ledger ConfigMaps.
+	Namespace string
+
+	// Reader reads the NatPMPs and NatPMPGateways of the entries when
+	// sweeping, the client if nil. It should not be cached, so that the
+	// NatPMPs of other managers sharing the ledger, outside the namespaces
+	// or selector of the cache, are not taken for orphans.
+	Reader client.Reader
+
+	// Shard is the set of gateways whose mappings are swept, every gateway
+	// if nil. The gateways of other shards may not be reachable.
+	Shard *settings.Shard
+
+	// NewGatewayClient returns the client for a gateway,
+	// gateway.NewWithOptions if nil.
+	NewGatewayClient func(net.IP, gateway.Options) gateway.Client
+
+	// Clock is the time source for the expiry of orphaned mappings, the
+	// real clock if nil.
+	Clock clock.PassiveClock
+
+	mu sync.Mutex
+
+	// orphans is when each entry that failed to release was first found
+	// orphaned, by ledger and key.
+	orphans map[string]time.Time
+}
+
+// now returns the current time of the ledger's clock.
+func (ledger *Ledger) now() time.Time {
+	if ledger.Clock == nil {
+		return time.Now()
+	}
+
+	return ledger.Clock.Now()
+}
+
+// reader returns the reader for the entries when sweeping.
+func (ledger *Ledger) reader() client.Reader {
+	if ledger.Reader == nil {
+		return ledger.Client
+	}
+
+	return ledger.Reader
+}
+
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+
+// ledgerKey identifies the gateway of the NatPMP in the ledger.
+func ledgerKey(natpmpCR networkv1.NatPMP) string {
+	if natpmpCR.Spec.GatewayRef != "" {
+		return "gatewayRef/" + natpmpCR.Spec.GatewayRef
+	}
+
+	return "gateway/" + natpmpCR.Spec.Gateway
+}
+
+// ledgerName returns the name of the ConfigMap for the gateway key.
+func ledgerName(key string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+
+	return fmt.Sprintf("%s%08x", ledgerPrefix, hash.Sum32())
+}
+
+// entryKey returns the ConfigMap key of the mapping for the IP family.
+func entryKey(natpmpCR networkv1.NatPMP, family corev1.IPFamily) string {
+	return strings.Join([]string{natpmpCR.Namespace, natpmpCR.Name, string(family)}, ".")
+}
+
+// entryPrefix returns the prefix of the ConfigMap keys of the NatPMP.
+func entryPrefix(natpmpCR networkv1.NatPMP) string {
+	return natpmpCR.Namespace + "." + natpmpCR.Name + "."
+}
+
+// Record records the mappings held for the NatPMP, replacing any recorded
+// before. The ledger is only written when an entry changed or its mapping
+// was granted a longer lifetime, so renewals do not rewrite it, and the
+// entries recorded under another gateway are dropped when the NatPMP moved.
+func (ledger *Ledger) Record(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+	addresses map[corev1.IPFamily]net.IP,
+	protocol string,
+	mappings []networkv1.MappingStatus,
+) error {
+	entries := make(map[string]LedgerEntry, len(mappings))
+
+	for _, mapping := range mappings {
+		entries[entryKey(natpmpCR, mapping.IPFamily)] = LedgerEntry{
+			Namespace:    natpmpCR.Namespace,
+			Name:         natpmpCR.Name,
+			UID:          natpmpCR.UID,
+			GatewayRef:   natpmpCR.Spec.GatewayRef,
+			Gateway:      addresses[mapping.IPFamily].String(),
+			IPFamily:     mapping.IPFamily,
+			Protocol:     protocol,
+			InternalIP:   mapping.InternalIP,
+			InternalPort: natpmpCR.Spec.InternalPort,
+			ExternalPort: mapping.MappedExternalPort,
+			Nonce:        natpmpCR.Status.Nonce,
+			Lifetime:     mapping.MappedLifetime,
+		}
+	}
+
+	encoded := make(map[string]string, len(entries))
+
+	for key, entry := range entries {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("unable to encode ledger entry: %w", err)
+		}
+
+		encoded[key] = string(value)
+	}
+
+	key := ledgerKey(natpmpCR)
+
+	var changed bool
+
+	err := ledger.update(ctx, key, func(data map[string]string) bool {
+		changed = !sameEntries(data, entryPrefix(natpmpCR), entries)
+		if !changed {
+			return false
+		}
+
+		dropEntries(data, entryPrefix(natpmpCR))
+
+		for key, value := range encoded {
+			data[key] = value
+		}
+
+		return true
+	})
+	if err != nil || !changed {
+		return err
+	}
+
+	return ledger.forget(ctx, natpmpCR, key)
+}
+
+// Forget drops the mappings recorded for the NatPMP.
+func (ledger *Ledger) Forget(ctx context.Context, natpmpCR networkv1.NatPMP) error {
+	return ledger.forget(ctx, natpmpCR, "")
+}
+
+// forget drops the mappings recorded for the NatPMP from every ledger but
+// the one of the gateway key, so the entries recorded before the NatPMP
+// moved to another gateway are dropped as well.
+func (ledger *Ledger) forget(ctx context.Context, natpmpCR networkv1.NatPMP, except string) error {
+	var configMaps corev1.ConfigMapList
+
+	err := ledger.List(
+		ctx,
+		&configMaps,
+		client.InNamespace(ledger.Namespace),
+		client.MatchingLabels{ledgerLabel: "true"},
+	)
+	if err != nil {
+		return fmt.Errorf("unable to list ledgers: %w", err)
+	}
+
+	prefix := entryPrefix(natpmpCR)
+
+	var errs []error
+
+	for _, configMap := range configMaps.Items {
+		if configMap.Name == ledgerName(except) || !hasEntries(configMap.Data, prefix) {
+			continue
+		}
+
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			if err := ledger.Get(ctx, client.ObjectKeyFromObject(&configMap), &configMap); err != nil {
+				return fmt.Errorf("unable to fetch ledger: %w", err)
+			}
+
+			if !dropEntries(configMap.Data, prefix) {
+				return nil
+			}
+
+			return ledger.Update(ctx, &configMap)
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("unable to update ledger %s: %w", configMap.Name, err))
+		}
+	}
+
+	return kerrors.NewAggregate(errs)
+}
+
+// hasEntries returns true if any key of the data starts with the prefix.
+func hasEntries(data map[string]string, prefix string) bool {
+	for key := range data {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dropEntries deletes the keys of the data starting with the prefix,
+// returning true if any was deleted.
+func dropEntries(data map[string]string, prefix string) bool {
+	dropped := false
+
+	for key := range data {
+		if strings.HasPrefix(key, prefix) {
+			delete(data, key)
+
+			dropped = true
+		}
+	}
+
+	return dropped
+}
+
+// sameEntries returns true if the entries of the data under the prefix are
+// the entries. A recorded lifetime at least as long still bounds the
+// mapping, so it counts as the same.
+func sameEntries(data map[string]string, prefix string, entries map[string]LedgerEntry) bool {
+	recorded := 0
+
+	for key, value := range data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		recorded++
+
+		want, ok := entries[key]
+		if !ok {
+			return false
+		}
+
+		var entry LedgerEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			return false
+		}
+
+		if entry.Lifetime >= want.Lifetime {
+			entry.Lifetime = want.Lifetime
+		}
+
+		if entry != want {
+			return false
+		}
+	}
+
+	return recorded == len(entries)
+}
+
+// update applies mutate to the entries of the ConfigMap for the gateway key,
+// creating it when missing. The ConfigMap is only written when mutate
+// returns true.
+func (ledger *Ledger) update(
+	ctx context.Context,
+	key string,
+	mutate func(data map[string]string) bool,
+) error {
+	name := types.NamespacedName{Namespace: ledger.Namespace, Name: ledgerName(key)}
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var configMap corev1.ConfigMap
+
+		err := ledger.Get(ctx, name, &configMap)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("unable to fetch ledger: %w", err)
+		}
+
+		if apierrors.IsNotFound(err) {
+			data := map[string]string{}
+			if !mutate(data) || len(data) == 0 {
+				return nil
+			}
+
+			configMap = corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: name.Namespace,
+					Name:      name.Name,
+					Labels:    map[string]string{ledgerLabel: "true"},
+				},
+				Data: data,
+			}
+
+			return ledger.Create(ctx, &configMap)
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+
+		if !mutate(configMap.Data) {
+			return nil
+		}
+
+		return ledger.Update(ctx, &configMap)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update ledger %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Sweep releases the recorded mappings whose NatPMP no longer exists and
+// drops them from the ledger. Mappings that cannot be released are dropped
+// regardless once a lifetime has passed since they were first found
+// orphaned, since nothing renews them.
+func (ledger *Ledger) Sweep(ctx context.Context) error {
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+
+	var configMaps corev1.ConfigMapList
+
+	err := ledger.List(
+		ctx,
+		&configMaps,
+		client.InNamespace(ledger.Namespace),
+		client.MatchingLabels{ledgerLabel: "true"},
+	)
+	if err != nil {
+		return fmt.Errorf("unable to list ledgers: %w", err)
+	}
+
+	var errs []error
+
+	// Only the entries still failing to release are kept, so the ones
+	// released or dropped elsewhere are not tracked forever.
+	pending := map[string]time.Time{}
+
+	for _, configMap := range configMaps.Items {
+		orphans, err := ledger.sweep(ctx, configMap, pending)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if len(orphans) == 0 {
+			continue
+		}
+
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			if err := ledger.Get(ctx, client.ObjectKeyFromObject(&configMap), &configMap); err != nil {
+				return fmt.Errorf("unable to fetch ledger: %w", err)
+			}
+
+			for _, key := range orphans {
+				delete(configMap.Data, key)
+			}
+
+			return ledger.Update(ctx, &configMap)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to update ledger %s: %w", configMap.Name, err))
+		}
+	}
+
+	ledger.orphans = pending
+
+	return kerrors.NewAggregate(errs)
+}
+
+// sweep returns the keys of the orphaned entries of the ConfigMap that were
+// released or expired, adding when the others failing to release were first
+// found orphaned to pending.
+func (ledger *Ledger) sweep(
+	ctx context.Context,
+	configMap corev1.ConfigMap,
+	pending map[string]time.Time,
+) ([]string, error) {
+	var (
+		orphans []string
+		errs    []error
+	)
+
+	now := ledger.now()
+
+	for key, value := range configMap.Data {
+		var entry LedgerEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			Error(ctx, err, "dropping undecodable ledger entry", "ledger", configMap.Name, "key", key)
+			orphans = append(orphans, key)
+
+			continue
+		}
+
+		if !ledger.Shard.Serves(entry.GatewayRef, net.ParseIP(entry.Gateway)) {
+			continue
+		}
+
+		orphaned, err := ledger.orphaned(ctx, entry)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		if !orphaned {
+			continue
+		}
+
+		released := "true"
+
+		if err := ledger.release(ctx, entry); err != nil {
+			id := configMap.Name + "/" + key
+
+			orphanedAt, ok := ledger.orphans[id]
+			if !ok {
+				orphanedAt = now
+			}
+
+			if orphanedAt.Add(time.Duration(entry.Lifetime) * time.Second).After(now) {
+				pending[id] = orphanedAt
+
+				errs = append(errs, WrapError(
+					ctx,
+					err,
+					"unable to release orphaned port mapping",
+					"namespace", entry.Namespace,
+					"name", entry.Name,
+					"ipFamily", entry.IPFamily,
+				))
+
+				continue
+			}
+
+			released = "false"
+		}
+
+		Info(
+			ctx,
+			"swept orphaned port mapping",
+			"namespace", entry.Namespace,
+			"name", entry.Name,
+			"gateway", entry.Gateway,
+			"externalPort", entry.ExternalPort,
+			"released", released,
+		)
+
+		orphanedMappings.WithLabelValues(entry.Gateway, released).Inc()
+
+		orphans = append(orphans, key)
+	}
+
+	return orphans, kerrors.NewAggregate(errs)
+}
+
+// orphaned returns true if the NatPMP of the entry no longer exists.
+func (ledger *Ledger) orphaned(ctx context.Context, entry LedgerEntry) (bool, error) {
+	var natpmpCR networkv1.NatPMP
+
+	err := ledger.reader().Get(ctx, types.NamespacedName{Namespace: entry.Namespace, Name: entry.Name}, &natpmpCR)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("unable to fetch NatPMP %s/%s: %w", entry.Namespace, entry.Name, err)
+	}
+
+	return natpmpCR.UID != entry.UID, nil
+}
+
+// release deletes the mapping of the entry from its gateway.
+func (ledger *Ledger) release(ctx context.Context, entry LedgerEntry) error {
+	address := net.ParseIP(entry.Gateway)
+	if address == nil {
+		return fmt.Errorf("%w: gateway %q", ErrInvalidLedgerEntry, entry.Gateway)
+	}
+
+	var opts gateway.Options
+
+	if entry.GatewayRef != "" {
+		var natpmpGateway networkv1.NatPMPGateway
+
+		err := ledger.reader().Get(ctx, types.NamespacedName{Name: entry.GatewayRef}, &natpmpGateway)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("unable to fetch NatPMPGateway %s: %w", entry.GatewayRef, err)
+		}
+
+		if err == nil {
+			opts = gatewayOptions(&natpmpGateway, nil)
+		}
+	}
+
+	nonce, err := hex.DecodeString(entry.Nonce)
+	if err != nil {
+		return fmt.Errorf("%w: nonce %q", ErrInvalidLedgerEntry, entry.Nonce)
+	}
+
+	newClient := ledger.NewGatewayClient
+	if newClient == nil {
+		newClient = gateway.NewWithOptions
+	}
+
+	_, err = newClient(address, opts).AddPortMapping(ctx, gateway.Request{
+		Protocol:     entry.Protocol,
+		InternalPort: entry.InternalPort,
+		InternalIP:   net.ParseIP(entry.InternalIP),
+		Nonce:        nonce,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to release port mapping: %w", err)
+	}
+
+	return nil
+}
+
+// recordMappings records the mappings in the ledger, if any. Failing to
+// record does not fail the reconcile since the mapping is held regardless,
+// it is recorded as a warning event instead.
+func (reconciler *NatPMPReconciler) recordMappings(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+	addresses map[corev1.IPFamily]net.IP,
+	protocol string,
+	mappings []networkv1.MappingStatus,
+) {
+	if reconciler.Ledger == nil {
+		return
+	}
+
+	if err := reconciler.Ledger.Record(ctx, natpmpCR, addresses, protocol, mappings); err != nil {
+		Error(ctx, err, "unable to record port mappings")
+
+		reconciler.event(
+			&natpmpCR,
+			corev1.EventTypeWarning,
+			networkv1.ReasonLedgerFailed,
+			"unable to record port mapping in the ledger: "+err.Error(),
+		)
+	}
+}
+
+// forgetMappings drops the mappings of the NatPMP from the ledger, if any.
+func (reconciler *NatPMPReconciler) forgetMappings(ctx context.Context, natpmpCR networkv1.NatPMP) {
+	if reconciler.Ledger == nil {
+		return
+	}
+
+	if err := reconciler.Ledger.Forget(ctx, natpmpCR); err != nil {
+		Error(ctx, err, "unable to forget port mappings")
+	}
+}
+
+// Start sweeps the ledger every sweepInterval until the context is done.
+func (ledger *Ledger) Start(ctx context.Context) error {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := ledger.Sweep(ctx); err != nil {
+			Error(ctx, err, "unable to sweep ledger")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// SetupWithManager registers the orphan metric and the sweeper with the
+// Manager.
+func (ledger *Ledger) SetupWithManager(mgr ctrl.Manager) error {
+	if err := metrics.Registry.Register(orphanedMappings); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if !errors.As(err, &registered) {
+			return fmt.Errorf("unable to register orphaned mappings metric: %w", err)
+		}
+	}
+
+	if err := mgr.Add(ledger); err != nil {
+		return fmt.Errorf("unable to add ledger sweeper: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+// errLedger fails the ledger writes.
+var errLedger = errors.New("ledger unavailable")
+
+// newTestLedger returns a ledger in the natpmp-system namespace releasing
+// through the fake gateway.
+func newTestLedger(t *testing.T, fakeGW *fakeGateway, objects ...client.Object) *Ledger {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, networkv1.AddToScheme(scheme))
+
+	return &Ledger{
+		Client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Namespace: "natpmp-system",
+		NewGatewayClient: func(net.IP, gateway.Options) gateway.Client {
+			return fakeGW
+		},
+	}
+}
+
+// ledgerEntries returns the ledger ConfigMap of the gateway key, nil if
+// missing.
+func ledgerEntries(t *testing.T, ledger *Ledger, key string) *corev1.ConfigMap {
+	t.Helper()
+
+	var configMap corev1.ConfigMap
+
+	err := ledger.Get(
+		context.Background(),
+		types.NamespacedName{Namespace: ledger.Namespace, Name: ledgerName(key)},
+		&configMap,
+	)
+	if err != nil {
+		return nil
+	}
+
+	return &configMap
+}
+
+// ledgered returns the mappings of the NatPMP as recorded in its status.
+func ledgered(lifetime int, externalPort int) []networkv1.MappingStatus {
+	return []networkv1.MappingStatus{{
+		IPFamily:           corev1.IPv4Protocol,
+		InternalIP:         "10.0.0.2",
+		MappedExternalPort: externalPort,
+		MappedLifetime:     lifetime,
+	}}
+}
+
+func TestLedgerRecord(t *testing.T) {
+	ctx := context.Background()
+	ledger := newTestLedger(t, &fakeGateway{})
+
+	natpmpCR := mapped()
+	natpmpCR.UID = "uid"
+	addresses := map[corev1.IPFamily]net.IP{corev1.IPv4Protocol: net.ParseIP("192.0.2.1")}
+
+	require.NoError(t, ledger.Record(ctx, *natpmpCR, addresses, "tcp", ledgered(3600, 2222)))
+
+	recorded := ledgerEntries(t, ledger, ledgerKey(*natpmpCR))
+	require.NotNil(t, recorded)
+	require.Len(t, recorded.Data, 1)
+
+	var entry LedgerEntry
+	require.NoError(t, json.Unmarshal([]byte(recorded.Data[entryKey(*natpmpCR, corev1.IPv4Protocol)]), &entry))
+	require.Equal(t, "192.0.2.1", entry.Gateway)
+	require.Equal(t, 2222, entry.ExternalPort)
+
+	// A renewal granted a shorter lifetime is not written.
+	require.NoError(t, ledger.Record(ctx, *natpmpCR, addresses, "tcp", ledgered(1800, 2222)))
+	require.Equal(t, recorded.ResourceVersion, ledgerEntries(t, ledger, ledgerKey(*natpmpCR)).ResourceVersion)
+
+	require.NoError(t, ledger.Record(ctx, *natpmpCR, addresses, "tcp", ledgered(3600, 2223)))
+	require.NotEqual(t, recorded.ResourceVersion, ledgerEntries(t, ledger, ledgerKey(*natpmpCR)).ResourceVersion)
+
+	// Moving to another gateway drops the entry recorded under the old one.
+	moved := natpmpCR.DeepCopy()
+	moved.Spec.Gateway = "192.0.2.2"
+	addresses[corev1.IPv4Protocol] = net.ParseIP("192.0.2.2")
+
+	require.NoError(t, ledger.Record(ctx, *moved, addresses, "tcp", ledgered(3600, 2223)))
+	require.Len(t, ledgerEntries(t, ledger, ledgerKey(*moved)).Data, 1)
+	require.Empty(t, ledgerEntries(t, ledger, ledgerKey(*natpmpCR)).Data)
+
+	require.NoError(t, ledger.Forget(ctx, *moved))
+	require.Empty(t, ledgerEntries(t, ledger, ledgerKey(*moved)).Data)
+}
+
+func TestLedgerSweep(t *testing.T) {
+	ctx := context.Background()
+
+	live := mapped()
+	live.Name = "live"
+	live.UID = "live"
+
+	recreated := mapped()
+	recreated.Name = "recreated"
+	recreated.UID = "recreated"
+
+	deleted := mapped()
+	deleted.Name = "deleted"
+	deleted.UID = "deleted"
+
+	fakeGW := &fakeGateway{}
+	ledger := newTestLedger(t, fakeGW, live, recreated)
+	addresses := map[corev1.IPFamily]net.IP{corev1.IPv4Protocol: net.ParseIP("192.0.2.1")}
+
+	recreatedBefore := recreated.DeepCopy()
+	recreatedBefore.UID = "before"
+
+	for _, natpmpCR := range []*networkv1.NatPMP{live, recreatedBefore, deleted} {
+		require.NoError(t, ledger.Record(ctx, *natpmpCR, addresses, "tcp", ledgered(3600, 2222)))
+	}
+
+	require.NoError(t, ledger.Sweep(ctx))
+
+	require.Len(t, fakeGW.Requests(), 2, "the orphans are released")
+
+	for _, request := range fakeGW.Requests() {
+		require.Zero(t, request.Lifetime)
+	}
+
+	data := ledgerEntries(t, ledger, ledgerKey(*live)).Data
+	require.Len(t, data, 1)
+	require.Contains(t, data, entryKey(*live, corev1.IPv4Protocol))
+}
+
+func TestLedgerSweepReleaseFailure(t *testing.T) {
+	ctx := context.Background()
+
+	fakeGW := &fakeGateway{err: errLedger}
+	ledger := newTestLedger(t, fakeGW)
+	fakeClock := clocktesting.NewFakeClock(created)
+	ledger.Clock = fakeClock
+	addresses := map[corev1.IPFamily]net.IP{corev1.IPv4Protocol: net.ParseIP("192.0.2.1")}
+
+	pending := mapped()
+	pending.Name = "pending"
+	pending.UID = "pending"
+
+	expired := mapped()
+	expired.Name = "expired"
+	expired.UID = "expired"
+
+	require.NoError(t, ledger.Record(ctx, *pending, addresses, "tcp", ledgered(3600, 2222)))
+	require.NoError(t, ledger.Record(ctx, *expired, addresses, "tcp", ledgered(-1, 2223)))
+
+	// An undecodable entry is dropped.
+	configMap := ledgerEntries(t, ledger, ledgerKey(*pending))
+	configMap.Data["garbage"] = "{"
+	require.NoError(t, ledger.Update(ctx, configMap))
+
+	require.ErrorIs(t, ledger.Sweep(ctx), errLedger)
+
+	data := ledgerEntries(t, ledger, ledgerKey(*pending)).Data
+	require.Len(t, data, 1, "an unexpired mapping that failed to release is kept to retry")
+	require.Contains(t, data, entryKey(*pending, corev1.IPv4Protocol))
+
+	// The lifetime runs from when the mapping was first found orphaned.
+	fakeClock.Step(59 * time.Minute)
+	require.ErrorIs(t, ledger.Sweep(ctx), errLedger)
+	require.Len(t, ledgerEntries(t, ledger, ledgerKey(*pending)).Data, 1)
+
+	fakeClock.Step(time.Minute)
+	require.NoError(t, ledger.Sweep(ctx))
+	require.Empty(t, ledgerEntries(t, ledger, ledgerKey(*pending)).Data)
+}
+
+func TestReconcileLedgerFailure(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+
+	test := newTestReconciler(t, natpmpCR)
+
+	recorder := record.NewFakeRecorder(16)
+	test.Recorder = recorder
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+
+	test.Ledger = &Ledger{
+		Client: fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithInterceptorFuncs(interceptor.Funcs{
+				Create: func(context.Context, client.WithWatch, client.Object, ...client.CreateOption) error {
+					return errLedger
+				},
+			}).
+			Build(),
+		Namespace: "natpmp-system",
+	}
+
+	_, status := test.reconcile(t, natpmpCR)
+	require.Len(t, status.Status.Mappings, 1, "the mapping is held regardless")
+
+	require.Contains(t, events(recorder), "Warning "+networkv1.ReasonLedgerFailed+
+		" unable to record port mapping in the ledger: unable to update ledger natpmp-system/"+
+		ledgerName(ledgerKey(*natpmpCR))+": "+errLedger.Error())
+}
+
+func TestSameEntries(t *testing.T) {
+	entry := LedgerEntry{Namespace: "default", Name: "debug", ExternalPort: 2222, Lifetime: 3600}
+
+	encoded, err := json.Marshal(entry)
+	require.NoError(t, err)
+
+	data := map[string]string{"default.debug.IPv4": string(encoded), "other.debug.IPv4": "{"}
+
+	renewed := entry
+	renewed.Lifetime = 1800
+
+	require.True(t, sameEntries(data, "default.debug.", map[string]LedgerEntry{"default.debug.IPv4": renewed}))
+
+	renewed.Lifetime = 7200
+	require.False(t, sameEntries(data, "default.debug.", map[string]LedgerEntry{"default.debug.IPv4": renewed}),
+		"a longer lifetime is recorded")
+
+	renewed.Lifetime = 3600
+
+	renewed.ExternalPort = 2223
+	require.False(t, sameEntries(data, "default.debug.", map[string]LedgerEntry{"default.debug.IPv4": renewed}))
+	require.False(t, sameEntries(data, "default.debug.", nil))
+	require.True(t, sameEntries(map[string]string{}, "default.debug.", nil))
+}
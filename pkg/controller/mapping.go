@@ -0,0 +1,253 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+	"github.com/jkoelker/natpmp-controller/pkg/pcp"
+)
+
+// MappingFailed records on the NatPMP status that the port mapping could not
+// be made and returns err.
+func (reconciler *NatPMPReconciler) MappingFailed(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	reason string,
+	err error,
+) error {
+	patchErr := reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		SetCondition(natpmpCR, status, networkv1.ConditionReady, metav1.ConditionFalse, reason, err.Error())
+	})
+	if patchErr != nil {
+		Error(ctx, patchErr, "unable to update NatPMP status")
+	}
+
+	return err
+}
+
+// Nonce returns the PCP mapping nonce of the NatPMP, nil if it has none.
+func Nonce(natpmpCR networkv1.NatPMP) []byte {
+	nonce, err := hex.DecodeString(natpmpCR.Status.Nonce)
+	if err != nil || len(nonce) == 0 {
+		return nil
+	}
+
+	return nonce
+}
+
+// EnsureNonce records a random PCP mapping nonce in the NatPMP status if it
+// has none, so every request for the mapping, from any instance, carries the
+// same nonce.
+func (reconciler *NatPMPReconciler) EnsureNonce(ctx context.Context, natpmpCR *networkv1.NatPMP) error {
+	if Nonce(*natpmpCR) != nil {
+		return nil
+	}
+
+	nonce, err := pcp.NewNonce()
+	if err != nil {
+		return WrapError(ctx, err, "unable to generate mapping nonce")
+	}
+
+	err = reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		if status.Nonce == "" {
+			status.Nonce = hex.EncodeToString(nonce)
+		}
+	})
+	if err != nil {
+		return WrapError(ctx, err, "unable to update NatPMP status")
+	}
+
+	return nil
+}
+
+// AddPortMapping requests the port mapping for each IP family from its
+// gateway, returning the mappings to record with SetMappings. A nil target
+// maps to the requesting host. Failures are recorded in the NatPMP status.
+func (reconciler *NatPMPReconciler) AddPortMapping(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+	target *ResolvedTarget,
+) ([]networkv1.MappingStatus, error) {
+	if err := reconciler.EnsureNonce(ctx, natpmpCR); err != nil {
+		return nil, err
+	}
+
+	families := IPFamilies(*natpmpCR)
+	mappings := make([]networkv1.MappingStatus, 0, len(families))
+
+	for _, family := range families {
+		internalIP := target.IP(family)
+		if target != nil && internalIP == nil {
+			err := fmt.Errorf("%w: no %s address", ErrTargetUnavailable, family)
+
+			return nil, reconciler.MappingFailed(
+				ctx,
+				natpmpCR,
+				networkv1.ReasonTargetUnavailable,
+				WrapError(ctx, err, "unable to add port mapping", "ipFamily", family),
+			)
+		}
+
+		mapping, err := gateways[family].AddPortMapping(ctx, gateway.Request{
+			Protocol:     protocol,
+			InternalPort: natpmpCR.Spec.InternalPort,
+			ExternalPort: RequestedPort(*natpmpCR, family),
+			Lifetime:     RequestedLifetime(reconciler.Defaulted(*natpmpCR), reconciler.now()),
+			InternalIP:   internalIP,
+			Nonce:        Nonce(*natpmpCR),
+		})
+		if err != nil {
+			return nil, reconciler.MappingFailed(
+				ctx,
+				natpmpCR,
+				MappingFailedReason(err),
+				WrapError(ctx, err, "unable to add port mapping", "ipFamily", family),
+			)
+		}
+
+		mappings = append(mappings, MappingStatus(family, mapping))
+	}
+
+	return mappings, nil
+}
+
+// ReleasePortMapping deletes the port mapping held for each IP family in the
+// NatPMP status by requesting a lifetime of zero.
+func (reconciler *NatPMPReconciler) ReleasePortMapping(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+) error {
+	return reconciler.releaseMappings(ctx, natpmpCR, gateways, protocol, natpmpCR.Status.Mappings)
+}
+
+// releaseMappings deletes the port mappings by requesting a lifetime of
+// zero.
+func (reconciler *NatPMPReconciler) releaseMappings(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+	mappings []networkv1.MappingStatus,
+) error {
+	for _, mapping := range mappings {
+		client, ok := gateways[mapping.IPFamily]
+		if !ok {
+			continue
+		}
+
+		_, err := client.AddPortMapping(ctx, gateway.Request{
+			Protocol:     protocol,
+			InternalPort: natpmpCR.Spec.InternalPort,
+			InternalIP:   net.ParseIP(mapping.InternalIP),
+			Nonce:        Nonce(*natpmpCR),
+		})
+		if err != nil {
+			return WrapError(ctx, err, "unable to release port mapping", "ipFamily", mapping.IPFamily)
+		}
+	}
+
+	return nil
+}
+
+// MappedLifetime returns the shortest lifetime of the mappings.
+func MappedLifetime(mappings []networkv1.MappingStatus) int {
+	lifetime := 0
+
+	for _, mapping := range mappings {
+		if lifetime == 0 || mapping.MappedLifetime < lifetime {
+			lifetime = mapping.MappedLifetime
+		}
+	}
+
+	return lifetime
+}
+
+// SetMappings records the mappings requested at now in the status, mirroring
+// the first into the top level fields, and marks the NatPMP ready.
+func SetMappings(
+	natpmpCR *networkv1.NatPMP,
+	status *networkv1.NatPMPStatus,
+	mappings []networkv1.MappingStatus,
+	now time.Time,
+) {
+	status.Mappings = mappings
+
+	renewedAt := metav1.NewTime(now)
+	expiresAt := metav1.NewTime(now.Add(time.Duration(MappedLifetime(mappings)) * time.Second))
+	status.RenewedAt = &renewedAt
+	status.ExpiresAt = &expiresAt
+
+	primary := mappings[0]
+	status.ExternalIP = primary.ExternalIP
+	status.MappedExternalPort = primary.MappedExternalPort
+	status.MappedInternalPort = primary.MappedInternalPort
+	status.MappedLifetime = primary.MappedLifetime
+	status.SecondsSinceStartOfEpoch = primary.SecondsSinceStartOfEpoch
+
+	SetCondition(
+		natpmpCR,
+		status,
+		networkv1.ConditionReady,
+		metav1.ConditionTrue,
+		networkv1.ReasonMapped,
+		"port mapping is held on the gateway",
+	)
+}
+
+// ClearMappings removes the mappings from the status.
+func ClearMappings(status *networkv1.NatPMPStatus) {
+	status.Mappings = nil
+	status.ExternalIP = ""
+	status.MappedExternalPort = 0
+	status.MappedInternalPort = 0
+	status.MappedLifetime = 0
+	status.SecondsSinceStartOfEpoch = 0
+	status.RenewedAt = nil
+	status.ExpiresAt = nil
+}
+
+// MappingStatus converts a gateway mapping to its status representation.
+func MappingStatus(family corev1.IPFamily, mapping *gateway.Mapping) networkv1.MappingStatus {
+	status := networkv1.MappingStatus{
+		IPFamily:                 family,
+		ExternalIP:               mapping.ExternalIP.String(),
+		MappedInternalPort:       mapping.InternalPort,
+		MappedExternalPort:       mapping.ExternalPort,
+		MappedLifetime:           mapping.Lifetime,
+		SecondsSinceStartOfEpoch: mapping.SecondsSinceStartOfEpoch,
+	}
+
+	if mapping.InternalIP != nil {
+		status.InternalIP = mapping.InternalIP.String()
+	}
+
+	return status
+}
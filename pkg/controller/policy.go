@@ -0,0 +1,232 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+//+kubebuilder:rbac:groups=network.natpmp.jkoelker.github.io,resources=natpmppolicies,verbs=get;list;watch
+
+// Policies are the NatPMPPolicies that apply to a NatPMP, with the number
+// of NatPMPs in its namespace that were there before it.
+type Policies struct {
+	// Items are the policies that apply to the NatPMP.
+	Items []networkv1.NatPMPPolicy
+
+	// Before is the number of other NatPMPs in the namespace that claim
+	// before the NatPMP.
+	Before int
+}
+
+// policyApplies returns true if the policy applies to the namespace.
+func policyApplies(policy networkv1.NatPMPPolicy, namespace string) bool {
+	if len(policy.Spec.Namespaces) == 0 {
+		return true
+	}
+
+	for _, name := range policy.Spec.Namespaces {
+		if name == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ListPolicies returns the NatPMPPolicies that apply to the NatPMP, nil if
+// none do.
+func ListPolicies(
+	ctx context.Context,
+	reader client.Reader,
+	natpmpCR networkv1.NatPMP,
+) (*Policies, error) {
+	var policyList networkv1.NatPMPPolicyList
+	if err := reader.List(ctx, &policyList); err != nil {
+		return nil, fmt.Errorf("unable to list NatPMPPolicies: %w", err)
+	}
+
+	var policies Policies
+
+	limited := false
+
+	for _, policy := range policyList.Items {
+		if !policyApplies(policy, natpmpCR.Namespace) {
+			continue
+		}
+
+		policies.Items = append(policies.Items, policy)
+		limited = limited || policy.Spec.MaxMappingsPerNamespace > 0
+	}
+
+	if len(policies.Items) == 0 {
+		return nil, nil
+	}
+
+	if !limited {
+		return &policies, nil
+	}
+
+	before, err := natpmpsBefore(ctx, reader, natpmpCR)
+	if err != nil {
+		return nil, err
+	}
+
+	policies.Before = len(before)
+
+	return &policies, nil
+}
+
+// PortPermitted returns true if the policies allow the external port.
+func (policies *Policies) PortPermitted(port int) bool {
+	if policies == nil {
+		return true
+	}
+
+	for _, policy := range policies.Items {
+		if !portPermitted(port, policy) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// portPermitted returns true if the port is in the allowed ranges of the
+// policy and not in its denied ranges.
+func portPermitted(port int, policy networkv1.NatPMPPolicy) bool {
+	if !PortAllowed(port, policy.Spec.AllowedPortRanges) {
+		return false
+	}
+
+	return len(policy.Spec.DeniedPortRanges) == 0 || !PortAllowed(port, policy.Spec.DeniedPortRanges)
+}
+
+// protocolAllowed returns true if the protocol is one of the allowed, or
+// none are listed.
+func protocolAllowed(protocol string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, candidate := range allowed {
+		if strings.EqualFold(candidate, protocol) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidatePolicies returns the violations of the policies by the NatPMP.
+// Allocated ports are not checked, the allocator skips forbidden ports.
+func ValidatePolicies(natpmpCR networkv1.NatPMP, policies *Policies) field.ErrorList {
+	if policies == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	spec := field.NewPath("spec")
+
+	for _, policy := range policies.Items {
+		forbidden := "forbidden by NatPMPPolicy " + policy.Name
+
+		if port := natpmpCR.Spec.ExternalPort; port != 0 && !portPermitted(port, policy) {
+			allErrs = append(allErrs, field.Forbidden(spec.Child("externalPort"), forbidden))
+		}
+
+		if !protocolAllowed(natpmpCR.Spec.Protocol, policy.Spec.AllowedProtocols) {
+			allErrs = append(allErrs, field.Forbidden(spec.Child("protocol"), forbidden))
+		}
+
+		if maxLifetime := policy.Spec.MaxLifetime; maxLifetime > 0 && natpmpCR.Spec.Lifetime > maxLifetime {
+			allErrs = append(allErrs, field.Forbidden(
+				spec.Child("lifetime"),
+				fmt.Sprintf("longer than %d seconds is %s", maxLifetime, forbidden),
+			))
+		}
+
+		if maxMappings := policy.Spec.MaxMappingsPerNamespace; maxMappings > 0 && policies.Before >= maxMappings {
+			allErrs = append(allErrs, field.Forbidden(
+				field.NewPath("metadata", "namespace"),
+				fmt.Sprintf("more than %d NatPMPs in the namespace is %s", maxMappings, forbidden),
+			))
+		}
+
+		for _, label := range policy.Spec.RequiredLabels {
+			if _, ok := natpmpCR.Labels[label]; !ok {
+				allErrs = append(allErrs, field.Required(
+					field.NewPath("metadata", "labels").Key(label),
+					"required by NatPMPPolicy "+policy.Name,
+				))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+// Deny releases the port mapping of a NatPMP a policy or quota forbids and
+// records the violations in its status.
+func (reconciler *NatPMPReconciler) Deny(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+	reason string,
+	violations field.ErrorList,
+) error {
+	Info(ctx, "NatPMP denied", "reason", reason, "violations", violations.ToAggregate().Error())
+
+	return reconciler.pause(ctx, natpmpCR, gateways, protocol, func(status *networkv1.NatPMPStatus) {
+		SetCondition(
+			natpmpCR,
+			status,
+			networkv1.ConditionReady,
+			metav1.ConditionFalse,
+			reason,
+			violations.ToAggregate().Error(),
+		)
+	})
+}
+
+// mapPolicy enqueues every NatPMP when a NatPMPPolicy changes.
+func (reconciler *NatPMPReconciler) mapPolicy(
+	ctx context.Context,
+	_ client.Object,
+) []reconcile.Request {
+	var natpmps networkv1.NatPMPList
+	if err := reconciler.List(ctx, &natpmps); err != nil {
+		Error(ctx, err, "unable to list NatPMPs for policy")
+
+		return nil
+	}
+
+	return requestsFor(natpmps.Items)
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+// portRetryInterval is how long to wait before asking for the requested
+// port again after the gateway assigned another under the exact policy.
+const portRetryInterval = time.Minute
+
+// Event reasons for port assignments.
+const (
+	// EventPortMismatch is recorded when the gateway assigns another
+	// external port than requested.
+	EventPortMismatch = "PortMismatch"
+
+	// EventPortChanged is recorded when the assigned external port changes.
+	EventPortChanged = "PortChanged"
+)
+
+// PortPolicy returns the port policy of the NatPMP, defaulting to any.
+func PortPolicy(natpmpCR networkv1.NatPMP) string {
+	if natpmpCR.Spec.PortPolicy == "" {
+		return networkv1.PortPolicyAny
+	}
+
+	return natpmpCR.Spec.PortPolicy
+}
+
+// mismatchedPort returns the first external port of the mappings other than
+// the requested one, zero if they all match or any port was requested.
+func mismatchedPort(requested int, mappings []networkv1.MappingStatus) int {
+	if requested == 0 {
+		return 0
+	}
+
+	for _, mapping := range mappings {
+		if mapping.MappedExternalPort != requested {
+			return mapping.MappedExternalPort
+		}
+	}
+
+	return 0
+}
+
+// ApplyPortPolicy checks the external port of the new mappings against the
+// port policy and the NatPMPPolicies, and records events when the
+// assignment changes. It returns false when the mappings were released,
+// because the policy is exact and the port differs or because a NatPMPPolicy
+// forbids the port the gateway assigned instead, in which case the NatPMP is
+// marked not ready and should be retried after portRetryInterval.
+func (reconciler *NatPMPReconciler) ApplyPortPolicy(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+	mappings []networkv1.MappingStatus,
+	policies *Policies,
+) (bool, error) {
+	requested := ExternalPort(*natpmpCR)
+	mapped := mismatchedPort(requested, mappings)
+
+	if previous := natpmpCR.Status.MappedExternalPort; previous != 0 &&
+		len(mappings) > 0 && previous != mappings[0].MappedExternalPort {
+		reconciler.event(
+			natpmpCR,
+			corev1.EventTypeNormal,
+			EventPortChanged,
+			fmt.Sprintf("external port changed from %d to %d", previous, mappings[0].MappedExternalPort),
+		)
+	}
+
+	if mapped == 0 {
+		return true, nil
+	}
+
+	message := fmt.Sprintf("gateway mapped external port %d instead of %d", mapped, requested)
+	reason := networkv1.ReasonPortMismatch
+	release := PortPolicy(*natpmpCR) == networkv1.PortPolicyExact
+
+	if !policies.PortPermitted(mapped) {
+		message += ", which a NatPMPPolicy forbids"
+		reason = networkv1.ReasonPolicyViolation
+		release = true
+	}
+
+	// A mismatch that is kept is only reported when first mapped.
+	if release || mapped != natpmpCR.Status.MappedExternalPort {
+		reconciler.event(natpmpCR, corev1.EventTypeWarning, EventPortMismatch, message)
+	}
+
+	if !release {
+		return true, nil
+	}
+
+	if err := reconciler.releaseMappings(ctx, natpmpCR, gateways, protocol, mappings); err != nil {
+		Error(ctx, err, "unable to release mismatched port mapping")
+	}
+
+	reconciler.forgetMappings(ctx, *natpmpCR)
+
+	err := reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		ClearMappings(status)
+		SetCondition(
+			natpmpCR,
+			status,
+			networkv1.ConditionReady,
+			metav1.ConditionFalse,
+			reason,
+			message,
+		)
+	})
+	if err != nil {
+		return false, WrapError(ctx, err, "unable to update NatPMP status")
+	}
+
+	return false, nil
+}
+
+// event records an event on the NatPMP when a recorder is configured.
+func (reconciler *NatPMPReconciler) event(
+	natpmpCR *networkv1.NatPMP,
+	eventType string,
+	reason string,
+	message string,
+) {
+	if reconciler.Recorder == nil {
+		return
+	}
+
+	reconciler.Recorder.Event(natpmpCR, eventType, reason, message)
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// events returns the events recorded so far.
+func events(recorder *record.FakeRecorder) []string {
+	var recorded []string
+
+	for {
+		select {
+		case event := <-recorder.Events:
+			recorded = append(recorded, event)
+		default:
+			return recorded
+		}
+	}
+}
+
+// reassigning returns a test reconciler whose gateway maps the NatPMP with
+// the port policy on port 3333, recording events.
+func reassigning(t *testing.T, policy string) (*testReconciler, *networkv1.NatPMP, *record.FakeRecorder) {
+	t.Helper()
+
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+	natpmpCR.Spec.PortPolicy = policy
+
+	test := newTestReconciler(t, natpmpCR)
+	test.gateway.assign = 3333
+
+	recorder := record.NewFakeRecorder(16)
+	test.Recorder = recorder
+
+	return test, natpmpCR, recorder
+}
+
+func TestPortPolicyExact(t *testing.T) {
+	test, natpmpCR, recorder := reassigning(t, networkv1.PortPolicyExact)
+
+	result, stored := test.reconcile(t, natpmpCR)
+	require.Equal(t, portRetryInterval, result.RequeueAfter)
+	require.Empty(t, stored.Status.Mappings)
+
+	ready := meta.FindStatusCondition(stored.Status.Conditions, networkv1.ConditionReady)
+	require.NotNil(t, ready)
+	require.Equal(t, networkv1.ReasonPortMismatch, ready.Reason)
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Equal(t, 2222, requests[0].ExternalPort)
+	require.Zero(t, requests[1].Lifetime, "the mismatched mapping is released")
+
+	require.Equal(t, []string{
+		"Warning PortMismatch gateway mapped external port 3333 instead of 2222",
+	}, events(recorder))
+
+	// The requested port is asked for again after the retry interval.
+	test.gateway.assign = 0
+	test.clock.Step(portRetryInterval)
+
+	_, stored = test.reconcile(t, natpmpCR)
+	require.Equal(t, 2222, stored.Status.MappedExternalPort)
+	require.True(t, meta.IsStatusConditionTrue(stored.Status.Conditions, networkv1.ConditionReady))
+}
+
+func TestPortPolicyAny(t *testing.T) {
+	test, natpmpCR, recorder := reassigning(t, networkv1.PortPolicyAny)
+
+	_, stored := test.reconcile(t, natpmpCR)
+	require.Equal(t, 3333, stored.Status.MappedExternalPort)
+	require.Equal(t, []string{
+		"Warning PortMismatch gateway mapped external port 3333 instead of 2222",
+	}, events(recorder))
+
+	// The assigned port is renewed and the mismatch is not reported again.
+	test.clock.Step(46 * time.Minute)
+	_, _ = test.reconcile(t, natpmpCR)
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Equal(t, 3333, requests[1].ExternalPort)
+	require.Empty(t, events(recorder))
+
+	// A change of the assigned port is reported.
+	test.gateway.assign = 4444
+	test.clock.Step(46 * time.Minute)
+
+	_, stored = test.reconcile(t, natpmpCR)
+	require.Equal(t, 4444, stored.Status.MappedExternalPort)
+	require.Equal(t, []string{
+		"Normal PortChanged external port changed from 3333 to 4444",
+		"Warning PortMismatch gateway mapped external port 4444 instead of 2222",
+	}, events(recorder))
+}
+
+func TestPortPolicyPreferred(t *testing.T) {
+	test, natpmpCR, _ := reassigning(t, networkv1.PortPolicyPreferred)
+
+	_, stored := test.reconcile(t, natpmpCR)
+	require.Equal(t, 3333, stored.Status.MappedExternalPort)
+
+	// Every renewal asks for the requested port again.
+	test.gateway.assign = 0
+	test.clock.Step(46 * time.Minute)
+
+	_, stored = test.reconcile(t, natpmpCR)
+	require.Equal(t, 2222, stored.Status.MappedExternalPort)
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Equal(t, 2222, requests[1].ExternalPort)
+}
+
+func TestPortPolicyDenied(t *testing.T) {
+	for _, policy := range []string{networkv1.PortPolicyAny, networkv1.PortPolicyPreferred} {
+		policy := policy
+
+		t.Run(policy, func(t *testing.T) {
+			test, natpmpCR, recorder := reassigning(t, policy)
+
+			require.NoError(t, test.Create(context.Background(), &networkv1.NatPMPPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "no-3000s"},
+				Spec: networkv1.NatPMPPolicySpec{
+					DeniedPortRanges: []networkv1.PortRange{{Start: 3000, End: 3999}},
+				},
+			}))
+
+			result, stored := test.reconcile(t, natpmpCR)
+			require.Equal(t, portRetryInterval, result.RequeueAfter)
+			require.Empty(t, stored.Status.Mappings)
+
+			ready := meta.FindStatusCondition(stored.Status.Conditions, networkv1.ConditionReady)
+			require.NotNil(t, ready)
+			require.Equal(t, networkv1.ReasonPolicyViolation, ready.Reason)
+
+			requests := test.gateway.Requests()
+			require.Len(t, requests, 2)
+			require.Zero(t, requests[1].Lifetime, "the forbidden mapping is released")
+
+			require.Equal(t, []string{
+				"Warning PortMismatch gateway mapped external port 3333 instead of 2222, " +
+					"which a NatPMPPolicy forbids",
+			}, events(recorder))
+		})
+	}
+}
+
+func TestReconcilePolicyViolation(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+
+	test := newTestReconciler(t, natpmpCR)
+
+	_, stored := test.reconcile(t, natpmpCR)
+	require.Len(t, stored.Status.Mappings, 1)
+
+	require.NoError(t, test.Create(context.Background(), &networkv1.NatPMPPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "no-ssh"},
+		Spec: networkv1.NatPMPPolicySpec{
+			DeniedPortRanges: []networkv1.PortRange{{Start: 2222}},
+		},
+	}))
+
+	_, stored = test.reconcile(t, natpmpCR)
+	require.Empty(t, stored.Status.Mappings, "a violating NatPMP releases its mapping")
+
+	ready := meta.FindStatusCondition(stored.Status.Conditions, networkv1.ConditionReady)
+	require.NotNil(t, ready)
+	require.Equal(t, networkv1.ReasonPolicyViolation, ready.Reason)
+}
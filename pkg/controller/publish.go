@@ -0,0 +1,500 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+const (
+	// KindIngress is the AddressTarget kind of an Ingress.
+	KindIngress = "Ingress"
+
+	// KindGateway is the AddressTarget kind of a Gateway API Gateway.
+	KindGateway = "Gateway"
+
+	// publishAddressToField indexes NatPMPs by the objects they publish to.
+	publishAddressToField = "spec.publishAddressTo"
+
+	// publisherFinalizer holds a NatPMP until its published addresses are
+	// removed.
+	publisherFinalizer = "natpmp.jkoelker.github.io/publisher"
+)
+
+var (
+	ingressGVK = networkingv1.SchemeGroupVersion.WithKind(KindIngress)
+	gatewayGVK = schema.GroupVersionKind{
+		Group:   "gateway.networking.k8s.io",
+		Version: "v1",
+		Kind:    KindGateway,
+	}
+)
+
+// AddressPublisher writes the external address of each NatPMP into the
+// status of the Ingresses and Gateways it references, so that ingress
+// controllers behind the NAT report a public address for ExternalDNS.
+type AddressPublisher struct {
+	client.Client
+
+	watcher *Watcher
+}
+
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=gateways,verbs=get;list;watch
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=gateways/status,verbs=get;update;patch
+
+// Reconcile publishes the external addresses of the NatPMP, merging them with
+// the addresses written by others. Addresses published before are removed
+// once the NatPMP no longer holds them, no longer publishes to the object or
+// is deleted.
+func (publisher *AddressPublisher) Reconcile(
+	ctx context.Context,
+	req ctrl.Request,
+) (ctrl.Result, error) {
+	var natpmpCR networkv1.NatPMP
+	if err := publisher.Get(ctx, req.NamespacedName, &natpmpCR); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	deleting := !natpmpCR.DeletionTimestamp.IsZero()
+	targets := natpmpCR.Spec.PublishAddressTo
+
+	if deleting {
+		targets = nil
+	}
+
+	if len(targets) > 0 {
+		if err := publisher.setFinalizer(ctx, &natpmpCR, true); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	published, err := publisher.publishAll(ctx, natpmpCR, targets)
+
+	if !equality.Semantic.DeepEqual(natpmpCR.Status.Published, published) {
+		patch := client.MergeFrom(natpmpCR.DeepCopy())
+		natpmpCR.Status.Published = published
+
+		if patchErr := publisher.Status().Patch(ctx, &natpmpCR, patch); patchErr != nil {
+			return ctrl.Result{}, WrapError(ctx, patchErr, "unable to update NatPMP status")
+		}
+	}
+
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if len(targets) == 0 && len(published) == 0 {
+		if err := publisher.setFinalizer(ctx, &natpmpCR, false); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// publishAll publishes the external addresses of the NatPMP to the targets
+// and removes them from the objects published to before that are no longer
+// targets. It returns the addresses now published to each object, keeping
+// the previous record of an object that failed so it is retried.
+func (publisher *AddressPublisher) publishAll(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+	targets []networkv1.AddressTarget,
+) ([]networkv1.PublishedAddresses, error) {
+	addresses := ExternalAddresses(natpmpCR.Status)
+	previous := make(map[networkv1.AddressTarget][]string, len(natpmpCR.Status.Published))
+	desired := make(map[networkv1.AddressTarget][]string, len(targets))
+	order := make([]networkv1.AddressTarget, 0, len(targets)+len(natpmpCR.Status.Published))
+
+	for _, target := range targets {
+		if _, ok := desired[target]; !ok {
+			desired[target] = addresses
+			order = append(order, target)
+		}
+	}
+
+	for _, record := range natpmpCR.Status.Published {
+		previous[record.AddressTarget] = record.Addresses
+
+		if _, ok := desired[record.AddressTarget]; !ok {
+			desired[record.AddressTarget] = nil
+			order = append(order, record.AddressTarget)
+		}
+	}
+
+	published := make([]networkv1.PublishedAddresses, 0, len(order))
+	errs := make([]error, 0, len(order))
+
+	for _, target := range order {
+		name := types.NamespacedName{Namespace: natpmpCR.Namespace, Name: target.Name}
+		record := desired[target]
+
+		err := publisher.publish(ctx, target.Kind, name, previous[target], record)
+		if err != nil {
+			errs = append(errs, WrapError(
+				ctx,
+				err,
+				"unable to publish address",
+				"kind", target.Kind,
+				"name", target.Name,
+			))
+
+			record = previous[target]
+		}
+
+		if len(record) > 0 {
+			published = append(published, networkv1.PublishedAddresses{
+				AddressTarget: target,
+				Addresses:     record,
+			})
+		}
+	}
+
+	return published, kerrors.NewAggregate(errs)
+}
+
+// publish replaces the previously published addresses in the status of the
+// object with the addresses. An object that no longer exists has nothing to
+// remove.
+func (publisher *AddressPublisher) publish(
+	ctx context.Context,
+	kind string,
+	name types.NamespacedName,
+	previous []string,
+	addresses []string,
+) error {
+	var err error
+
+	switch kind {
+	case KindIngress:
+		err = publisher.publishIngress(ctx, name, previous, addresses)
+	case KindGateway:
+		err = publisher.publishGateway(ctx, name, previous, addresses)
+	default:
+		err = fmt.Errorf("unsupported kind %q", kind)
+	}
+
+	if len(addresses) == 0 && apierrors.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+// setFinalizer adds or removes the publisher finalizer, so the published
+// addresses are removed before the NatPMP is deleted.
+func (publisher *AddressPublisher) setFinalizer(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	add bool,
+) error {
+	if controllerutil.ContainsFinalizer(natpmpCR, publisherFinalizer) == add {
+		return nil
+	}
+
+	patch := client.MergeFrom(natpmpCR.DeepCopy())
+
+	if add {
+		controllerutil.AddFinalizer(natpmpCR, publisherFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(natpmpCR, publisherFinalizer)
+	}
+
+	if err := publisher.Patch(ctx, natpmpCR, patch); err != nil {
+		return WrapError(ctx, err, "unable to update NatPMP finalizers")
+	}
+
+	return nil
+}
+
+// ExternalAddresses returns the distinct external addresses of the mappings.
+func ExternalAddresses(status networkv1.NatPMPStatus) []string {
+	addresses := make([]string, 0, len(status.Mappings)+1)
+	seen := map[string]struct{}{}
+
+	add := func(address string) {
+		if _, ok := seen[address]; ok || address == "" {
+			return
+		}
+
+		seen[address] = struct{}{}
+		addresses = append(addresses, address)
+	}
+
+	for _, mapping := range status.Mappings {
+		add(mapping.ExternalIP)
+	}
+
+	add(status.ExternalIP)
+
+	return addresses
+}
+
+// addressSet returns the set of the addresses.
+func addressSet(addresses ...[]string) map[string]struct{} {
+	set := map[string]struct{}{}
+
+	for _, list := range addresses {
+		for _, address := range list {
+			set[address] = struct{}{}
+		}
+	}
+
+	return set
+}
+
+// MergeIngressAddresses replaces the previously published addresses in the
+// load balancer status of an Ingress with the addresses, keeping the entries
+// written by the ingress controller.
+func MergeIngressAddresses(
+	current []networkingv1.IngressLoadBalancerIngress,
+	previous []string,
+	addresses []string,
+) []networkingv1.IngressLoadBalancerIngress {
+	replaced := addressSet(previous, addresses)
+	merged := make([]networkingv1.IngressLoadBalancerIngress, 0, len(current)+len(addresses))
+
+	for _, entry := range current {
+		if _, ok := replaced[entry.IP]; ok && entry.Hostname == "" {
+			continue
+		}
+
+		merged = append(merged, entry)
+	}
+
+	for _, address := range addresses {
+		merged = append(merged, networkingv1.IngressLoadBalancerIngress{IP: address})
+	}
+
+	return merged
+}
+
+// MergeGatewayAddresses replaces the previously published addresses in the
+// status addresses of a Gateway with the addresses, keeping the entries
+// written by the gateway controller.
+func MergeGatewayAddresses(current []interface{}, previous []string, addresses []string) []interface{} {
+	replaced := addressSet(previous, addresses)
+	merged := make([]interface{}, 0, len(current)+len(addresses))
+
+	for _, entry := range current {
+		if fields, ok := entry.(map[string]interface{}); ok {
+			addressType, _ := fields["type"].(string)
+			value, _ := fields["value"].(string)
+
+			if _, ok := replaced[value]; ok && (addressType == "" || addressType == "IPAddress") {
+				continue
+			}
+		}
+
+		merged = append(merged, entry)
+	}
+
+	for _, address := range addresses {
+		merged = append(merged, map[string]interface{}{
+			"type":  "IPAddress",
+			"value": address,
+		})
+	}
+
+	return merged
+}
+
+func (publisher *AddressPublisher) publishIngress(
+	ctx context.Context,
+	name types.NamespacedName,
+	previous []string,
+	addresses []string,
+) error {
+	if err := publisher.watch(ingressGVK); err != nil {
+		return err
+	}
+
+	var ingress networkingv1.Ingress
+	if err := publisher.Get(ctx, name, &ingress); err != nil {
+		return fmt.Errorf("unable to fetch ingress: %w", err)
+	}
+
+	loadBalancer := MergeIngressAddresses(ingress.Status.LoadBalancer.Ingress, previous, addresses)
+
+	if equality.Semantic.DeepEqual(ingress.Status.LoadBalancer.Ingress, loadBalancer) {
+		return nil
+	}
+
+	patch := client.MergeFrom(ingress.DeepCopy())
+	ingress.Status.LoadBalancer.Ingress = loadBalancer
+
+	if err := publisher.Status().Patch(ctx, &ingress, patch); err != nil {
+		return fmt.Errorf("unable to patch ingress status: %w", err)
+	}
+
+	return nil
+}
+
+func (publisher *AddressPublisher) publishGateway(
+	ctx context.Context,
+	name types.NamespacedName,
+	previous []string,
+	addresses []string,
+) error {
+	if err := publisher.watch(gatewayGVK); err != nil {
+		return err
+	}
+
+	gateway := &unstructured.Unstructured{}
+	gateway.SetGroupVersionKind(gatewayGVK)
+
+	if err := publisher.Get(ctx, name, gateway); err != nil {
+		return fmt.Errorf("unable to fetch gateway: %w", err)
+	}
+
+	current, _, err := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+	if err != nil {
+		return fmt.Errorf("invalid gateway status: %w", err)
+	}
+
+	gatewayAddresses := MergeGatewayAddresses(current, previous, addresses)
+
+	if equality.Semantic.DeepEqual(current, gatewayAddresses) {
+		return nil
+	}
+
+	patch := client.MergeFrom(gateway.DeepCopy())
+
+	err = unstructured.SetNestedSlice(gateway.Object, gatewayAddresses, "status", "addresses")
+	if err != nil {
+		return fmt.Errorf("unable to set gateway addresses: %w", err)
+	}
+
+	if err := publisher.Status().Patch(ctx, gateway, patch); err != nil {
+		return fmt.Errorf("unable to patch gateway status: %w", err)
+	}
+
+	return nil
+}
+
+// watch starts watching the kind on first use, so that the Gateway API CRDs
+// are only required when a Gateway is referenced and status written by other
+// controllers is corrected.
+func (publisher *AddressPublisher) watch(gvk schema.GroupVersionKind) error {
+	if publisher.watcher == nil {
+		return nil
+	}
+
+	return publisher.watcher.Watch(gvk)
+}
+
+// indexPublishAddressTo returns the names of the objects the NatPMP
+// publishes to for the field index. The kind is left out since the metadata
+// events of the watched objects do not reliably carry it, an Ingress and
+// Gateway sharing a name only cost an extra reconcile.
+func indexPublishAddressTo(object client.Object) []string {
+	natpmpCR, ok := object.(*networkv1.NatPMP)
+	if !ok {
+		return nil
+	}
+
+	keys := make([]string, 0, len(natpmpCR.Spec.PublishAddressTo))
+	for _, target := range natpmpCR.Spec.PublishAddressTo {
+		keys = append(keys, target.Name)
+	}
+
+	return keys
+}
+
+// mapPublished returns the NatPMPs publishing to the object.
+func (publisher *AddressPublisher) mapPublished(
+	ctx context.Context,
+	object client.Object,
+) []reconcile.Request {
+	var natpmps networkv1.NatPMPList
+
+	err := publisher.List(
+		ctx,
+		&natpmps,
+		client.InNamespace(object.GetNamespace()),
+		client.MatchingFields{publishAddressToField: object.GetName()},
+	)
+	if err != nil {
+		Error(ctx, err, "unable to list NatPMPs for published object", "name", object.GetName())
+
+		return nil
+	}
+
+	return requestsFor(natpmps.Items)
+}
+
+// publishes returns true if the NatPMP references an object to publish to
+// or has addresses published to remove.
+func publishes(object client.Object) bool {
+	natpmpCR, ok := object.(*networkv1.NatPMP)
+
+	return ok && (len(natpmpCR.Spec.PublishAddressTo) > 0 ||
+		len(natpmpCR.Status.Published) > 0 ||
+		controllerutil.ContainsFinalizer(natpmpCR, publisherFinalizer))
+}
+
+// SetupWithManager sets up the publisher with the Manager.
+func (publisher *AddressPublisher) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(
+		context.Background(),
+		&networkv1.NatPMP{},
+		publishAddressToField,
+		indexPublishAddressTo,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to index NatPMP published objects: %w", err)
+	}
+
+	publisherController, err := ctrl.NewControllerManagedBy(mgr).
+		Named("address-publisher").
+		For(
+			&networkv1.NatPMP{},
+			builder.WithPredicates(predicate.NewPredicateFuncs(publishes)),
+		).
+		Build(publisher)
+	if err != nil {
+		return fmt.Errorf("unable to complete address publisher: %w", err)
+	}
+
+	publisher.watcher = NewWatcher(
+		publisherController,
+		mgr.GetCache(),
+		handler.EnqueueRequestsFromMapFunc(publisher.mapPublished),
+	)
+
+	return nil
+}
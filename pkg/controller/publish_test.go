@@ -0,0 +1,175 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// ingressControllerAddress is the address reported by the ingress
+// controller.
+var ingressControllerAddress = networkingv1.IngressLoadBalancerIngress{IP: "10.0.0.1"}
+
+func newTestPublisher(t *testing.T, objects ...client.Object) *AddressPublisher {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(scheme))
+	require.NoError(t, networkv1.AddToScheme(scheme))
+
+	return &AddressPublisher{
+		Client: fake.NewClientBuilder().
+			WithScheme(scheme).
+			WithObjects(objects...).
+			WithStatusSubresource(&networkv1.NatPMP{}, &networkingv1.Ingress{}).
+			Build(),
+	}
+}
+
+func publishing() (*networkv1.NatPMP, *networkingv1.Ingress) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.PublishAddressTo = []networkv1.AddressTarget{{Kind: KindIngress, Name: "web"}}
+	natpmpCR.Status.Mappings = []networkv1.MappingStatus{{IPFamily: "IPv4", ExternalIP: "203.0.113.1"}}
+
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Status: networkingv1.IngressStatus{
+			LoadBalancer: networkingv1.IngressLoadBalancerStatus{
+				Ingress: []networkingv1.IngressLoadBalancerIngress{ingressControllerAddress},
+			},
+		},
+	}
+
+	return natpmpCR, ingress
+}
+
+// reconcilePublisher reconciles the NatPMP and returns the Ingress addresses
+// afterwards.
+func reconcilePublisher(
+	t *testing.T,
+	publisher *AddressPublisher,
+	natpmpCR *networkv1.NatPMP,
+) []networkingv1.IngressLoadBalancerIngress {
+	t.Helper()
+
+	_, err := publisher.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: client.ObjectKeyFromObject(natpmpCR),
+	})
+	require.NoError(t, err)
+
+	var ingress networkingv1.Ingress
+	require.NoError(t, publisher.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web"}, &ingress))
+
+	return ingress.Status.LoadBalancer.Ingress
+}
+
+func TestPublisherMergesAndClears(t *testing.T) {
+	natpmpCR, ingress := publishing()
+	publisher := newTestPublisher(t, natpmpCR, ingress)
+
+	addresses := reconcilePublisher(t, publisher, natpmpCR)
+	require.Equal(t, []networkingv1.IngressLoadBalancerIngress{
+		ingressControllerAddress,
+		{IP: "203.0.113.1"},
+	}, addresses)
+
+	var stored networkv1.NatPMP
+	require.NoError(t, publisher.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+	require.True(t, controllerutil.ContainsFinalizer(&stored, publisherFinalizer))
+	require.Equal(t, []networkv1.PublishedAddresses{{
+		AddressTarget: networkv1.AddressTarget{Kind: KindIngress, Name: "web"},
+		Addresses:     []string{"203.0.113.1"},
+	}}, stored.Status.Published)
+
+	// Releasing the mapping removes only the published address.
+	stored.Status.Mappings = nil
+	require.NoError(t, publisher.Status().Update(context.Background(), &stored))
+
+	addresses = reconcilePublisher(t, publisher, natpmpCR)
+	require.Equal(t, []networkingv1.IngressLoadBalancerIngress{ingressControllerAddress}, addresses)
+
+	require.NoError(t, publisher.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+	require.Empty(t, stored.Status.Published)
+	require.True(t, controllerutil.ContainsFinalizer(&stored, publisherFinalizer))
+}
+
+func TestPublisherTargetRemoved(t *testing.T) {
+	natpmpCR, ingress := publishing()
+	publisher := newTestPublisher(t, natpmpCR, ingress)
+
+	_ = reconcilePublisher(t, publisher, natpmpCR)
+
+	var stored networkv1.NatPMP
+	require.NoError(t, publisher.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+
+	stored.Spec.PublishAddressTo = nil
+	require.NoError(t, publisher.Update(context.Background(), &stored))
+
+	addresses := reconcilePublisher(t, publisher, natpmpCR)
+	require.Equal(t, []networkingv1.IngressLoadBalancerIngress{ingressControllerAddress}, addresses)
+
+	require.NoError(t, publisher.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+	require.Empty(t, stored.Status.Published)
+	require.False(t, controllerutil.ContainsFinalizer(&stored, publisherFinalizer))
+}
+
+func TestPublisherDelete(t *testing.T) {
+	natpmpCR, ingress := publishing()
+	publisher := newTestPublisher(t, natpmpCR, ingress)
+
+	_ = reconcilePublisher(t, publisher, natpmpCR)
+
+	require.NoError(t, publisher.Delete(context.Background(), natpmpCR))
+
+	addresses := reconcilePublisher(t, publisher, natpmpCR)
+	require.Equal(t, []networkingv1.IngressLoadBalancerIngress{ingressControllerAddress}, addresses)
+
+	err := publisher.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &networkv1.NatPMP{})
+	require.True(t, apierrors.IsNotFound(err), "the finalizer is removed")
+}
+
+func TestMergeGatewayAddresses(t *testing.T) {
+	current := []interface{}{
+		map[string]interface{}{"type": "IPAddress", "value": "10.0.0.1"},
+		map[string]interface{}{"type": "Hostname", "value": "198.51.100.1"},
+		map[string]interface{}{"type": "IPAddress", "value": "198.51.100.1"},
+	}
+
+	merged := MergeGatewayAddresses(current, []string{"198.51.100.1"}, []string{"203.0.113.1"})
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"type": "IPAddress", "value": "10.0.0.1"},
+		map[string]interface{}{"type": "Hostname", "value": "198.51.100.1"},
+		map[string]interface{}{"type": "IPAddress", "value": "203.0.113.1"},
+	}, merged)
+
+	require.Equal(t, current[:2], MergeGatewayAddresses(merged, []string{"203.0.113.1"}, nil))
+}
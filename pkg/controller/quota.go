@@ -0,0 +1,245 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+//+kubebuilder:rbac:groups=network.natpmp.jkoelker.github.io,resources=natpmpquotas,verbs=get;list;watch
+//+kubebuilder:rbac:groups=network.natpmp.jkoelker.github.io,resources=natpmpquotas/status,verbs=get;update;patch
+
+// Quotas are the NatPMPQuotas of the namespace of a NatPMP, with the other
+// NatPMPs in the namespace that claim before it.
+type Quotas struct {
+	// Items are the quotas of the namespace.
+	Items []networkv1.NatPMPQuota
+
+	// Before are the NatPMPs in the namespace that claim before the
+	// NatPMP.
+	Before []networkv1.NatPMP
+}
+
+// natpmpsBefore returns the other NatPMPs in the namespace of the NatPMP
+// that claim before it. A NatPMP being created has no creation timestamp yet
+// and comes after every existing one.
+func natpmpsBefore(
+	ctx context.Context,
+	reader client.Reader,
+	natpmpCR networkv1.NatPMP,
+) ([]networkv1.NatPMP, error) {
+	var natpmps networkv1.NatPMPList
+	if err := reader.List(ctx, &natpmps, client.InNamespace(natpmpCR.Namespace)); err != nil {
+		return nil, fmt.Errorf("unable to list NatPMPs: %w", err)
+	}
+
+	var before []networkv1.NatPMP
+
+	for _, other := range natpmps.Items {
+		if other.Name == natpmpCR.Name {
+			continue
+		}
+
+		if natpmpCR.CreationTimestamp.IsZero() || claimsBefore(other, natpmpCR) {
+			before = append(before, other)
+		}
+	}
+
+	return before, nil
+}
+
+// ListQuotas returns the NatPMPQuotas of the namespace of the NatPMP, nil if
+// there are none.
+func ListQuotas(
+	ctx context.Context,
+	reader client.Reader,
+	natpmpCR networkv1.NatPMP,
+) (*Quotas, error) {
+	var quotaList networkv1.NatPMPQuotaList
+	if err := reader.List(ctx, &quotaList, client.InNamespace(natpmpCR.Namespace)); err != nil {
+		return nil, fmt.Errorf("unable to list NatPMPQuotas: %w", err)
+	}
+
+	if len(quotaList.Items) == 0 {
+		return nil, nil
+	}
+
+	before, err := natpmpsBefore(ctx, reader, natpmpCR)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Quotas{Items: quotaList.Items, Before: before}, nil
+}
+
+// Usage returns what the NatPMPs use of a quota.
+func Usage(natpmps []networkv1.NatPMP) networkv1.QuotaUsage {
+	var usage networkv1.QuotaUsage
+
+	ports := map[int]struct{}{}
+
+	for _, natpmpCR := range natpmps {
+		usage.Mappings += len(IPFamilies(natpmpCR))
+
+		port := natpmpCR.Spec.ExternalPort
+		if port == 0 {
+			port = natpmpCR.Status.AllocatedExternalPort
+		}
+
+		if port == 0 {
+			usage.ExternalPorts++
+
+			continue
+		}
+
+		if _, ok := ports[port]; !ok {
+			ports[port] = struct{}{}
+			usage.ExternalPorts++
+		}
+	}
+
+	return usage
+}
+
+// ValidateQuotas returns the quotas the NatPMP would exceed, counting the
+// NatPMPs that claim before it.
+func ValidateQuotas(natpmpCR networkv1.NatPMP, quotas *Quotas) field.ErrorList {
+	if quotas == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	path := field.NewPath("metadata", "namespace")
+	natpmps := append([]networkv1.NatPMP{natpmpCR}, quotas.Before...)
+	usage := Usage(natpmps)
+
+	for _, quota := range quotas.Items {
+		if limit := quota.Spec.Mappings; limit > 0 && usage.Mappings > limit {
+			allErrs = append(allErrs, field.Forbidden(
+				path,
+				fmt.Sprintf("exceeds the %d mappings of NatPMPQuota %s", limit, quota.Name),
+			))
+		}
+
+		if limit := quota.Spec.ExternalPorts; limit > 0 && usage.ExternalPorts > limit {
+			allErrs = append(allErrs, field.Forbidden(
+				path,
+				fmt.Sprintf("exceeds the %d external ports of NatPMPQuota %s", limit, quota.Name),
+			))
+		}
+	}
+
+	return allErrs
+}
+
+// mapQuota enqueues the NatPMPs in the namespace of a NatPMPQuota, so those
+// over quota are allowed as it grows or others are deleted.
+func (reconciler *NatPMPReconciler) mapQuota(
+	ctx context.Context,
+	object client.Object,
+) []reconcile.Request {
+	var natpmps networkv1.NatPMPList
+	if err := reconciler.List(ctx, &natpmps, client.InNamespace(object.GetNamespace())); err != nil {
+		Error(ctx, err, "unable to list NatPMPs for quota")
+
+		return nil
+	}
+
+	return requestsFor(natpmps.Items)
+}
+
+// NatPMPQuotaReconciler reports the usage of each NatPMPQuota.
+type NatPMPQuotaReconciler struct {
+	client.Client
+}
+
+// Reconcile counts the NatPMPs in the namespace of the quota and updates its
+// status.
+func (reconciler *NatPMPQuotaReconciler) Reconcile(
+	ctx context.Context,
+	req ctrl.Request,
+) (ctrl.Result, error) {
+	var quota networkv1.NatPMPQuota
+	if err := reconciler.Get(ctx, req.NamespacedName, &quota); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	var natpmps networkv1.NatPMPList
+	if err := reconciler.List(ctx, &natpmps, client.InNamespace(quota.Namespace)); err != nil {
+		return ctrl.Result{}, WrapError(ctx, err, "unable to list NatPMPs")
+	}
+
+	original := quota.DeepCopy()
+	quota.Status.Used = Usage(natpmps.Items)
+
+	if !equality.Semantic.DeepEqual(original.Status, quota.Status) {
+		if err := reconciler.Status().Patch(ctx, &quota, client.MergeFrom(original)); err != nil {
+			return ctrl.Result{}, WrapError(ctx, err, "unable to update NatPMPQuota status")
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// mapNatPMP returns the NatPMPQuotas in the namespace of the NatPMP.
+func (reconciler *NatPMPQuotaReconciler) mapNatPMP(
+	ctx context.Context,
+	object client.Object,
+) []reconcile.Request {
+	var quotas networkv1.NatPMPQuotaList
+	if err := reconciler.List(ctx, &quotas, client.InNamespace(object.GetNamespace())); err != nil {
+		Error(ctx, err, "unable to list NatPMPQuotas")
+
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(quotas.Items))
+	for idx := range quotas.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: client.ObjectKeyFromObject(&quotas.Items[idx]),
+		})
+	}
+
+	return requests
+}
+
+// SetupWithManager sets up the quota controller with the Manager.
+func (reconciler *NatPMPQuotaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := ctrl.NewControllerManagedBy(mgr).
+		For(&networkv1.NatPMPQuota{}).
+		Watches(
+			&networkv1.NatPMP{},
+			handler.EnqueueRequestsFromMapFunc(reconciler.mapNatPMP),
+		).
+		Complete(reconciler)
+	if err != nil {
+		return fmt.Errorf("unable to complete quota controller: %w", err)
+	}
+
+	return nil
+}
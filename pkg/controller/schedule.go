@@ -0,0 +1,393 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+const (
+	// scheduleHorizon is how far ahead the next boundaries of a schedule
+	// are searched for.
+	scheduleHorizon = 8 * 24 * time.Hour
+
+	// maxCronActivations bounds the activations of a cron window walked
+	// within the horizon.
+	maxCronActivations = 100000
+
+	// day is the length of a day without daylight saving changes.
+	day = 24 * time.Hour
+)
+
+// ErrInvalidTime is returned for a time of day that is not HH:MM.
+var ErrInvalidTime = errors.New("time of day must be HH:MM")
+
+// ScheduleState is whether a schedule is open at a time, with its next
+// boundaries within the horizon. A zero boundary was not found.
+type ScheduleState struct {
+	// Open is true if a window is open.
+	Open bool
+
+	// NextOpen is when a window next opens.
+	NextOpen time.Time
+
+	// NextClose is when the open, or next, window closes.
+	NextClose time.Time
+}
+
+// interval is a span of time a window is open, end exclusive.
+type interval struct {
+	start time.Time
+	end   time.Time
+}
+
+// Boundary returns the next time the state changes, the horizon from now
+// if none was found.
+func (state ScheduleState) Boundary(now time.Time) time.Time {
+	boundary := state.NextOpen
+	if state.Open {
+		boundary = state.NextClose
+	}
+
+	if boundary.IsZero() {
+		return now.Add(scheduleHorizon)
+	}
+
+	return boundary
+}
+
+// RequeueAfter caps requeue to the next boundary of the schedule, if any.
+func (state *ScheduleState) RequeueAfter(requeue time.Duration, now time.Time) time.Duration {
+	if state == nil {
+		return requeue
+	}
+
+	if until := state.Boundary(now).Sub(now); until < requeue {
+		return until
+	}
+
+	return requeue
+}
+
+// parseClock returns the hour and minute of a time of day.
+func parseClock(value string) (int, int, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %q", ErrInvalidTime, value)
+	}
+
+	return clock.Hour(), clock.Minute(), nil
+}
+
+// scheduleLocation returns the time zone of the schedule.
+func scheduleLocation(schedule networkv1.Schedule) (*time.Location, error) {
+	if schedule.TimeZone == "" {
+		return time.UTC, nil
+	}
+
+	location, err := time.LoadLocation(schedule.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load time zone: %w", err)
+	}
+
+	return location, nil
+}
+
+// windowIntervals returns the intervals of the window that end after from
+// and start before until.
+func windowIntervals(
+	window networkv1.Window,
+	location *time.Location,
+	from time.Time,
+	until time.Time,
+) ([]interval, error) {
+	startHour, startMinute, err := parseClock(window.Start)
+	if err != nil {
+		return nil, err
+	}
+
+	endHour, endMinute, err := parseClock(window.End)
+	if err != nil {
+		return nil, err
+	}
+
+	days := map[string]bool{}
+	for _, weekday := range window.Days {
+		days[string(weekday)] = true
+	}
+
+	var intervals []interval
+
+	// Start the day before so a window crossing midnight is found.
+	year, month, date := from.In(location).Add(-day).Date()
+
+	for offset := 0; ; offset++ {
+		midnight := time.Date(year, month, date+offset, 0, 0, 0, 0, location)
+		if !midnight.Before(until) {
+			break
+		}
+
+		if len(days) > 0 && !days[midnight.Weekday().String()] {
+			continue
+		}
+
+		start := time.Date(year, month, date+offset, startHour, startMinute, 0, 0, location)
+		end := time.Date(year, month, date+offset, endHour, endMinute, 0, 0, location)
+
+		if !end.After(start) {
+			end = time.Date(year, month, date+offset+1, endHour, endMinute, 0, 0, location)
+		}
+
+		if end.After(from) && start.Before(until) {
+			intervals = append(intervals, interval{start: start, end: end})
+		}
+	}
+
+	return intervals, nil
+}
+
+// cronIntervals returns the intervals of the cron window that end after from
+// and start before until.
+func cronIntervals(
+	window networkv1.CronWindow,
+	location *time.Location,
+	from time.Time,
+	until time.Time,
+) ([]interval, error) {
+	schedule, err := cron.ParseStandard(window.Open)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse cron expression: %w", err)
+	}
+
+	var intervals []interval
+
+	// Activations up to a duration before from may still be open.
+	activation := from.Add(-window.Duration.Duration).In(location)
+
+	for count := 0; count < maxCronActivations; count++ {
+		activation = schedule.Next(activation)
+		if activation.IsZero() || !activation.Before(until) {
+			break
+		}
+
+		end := activation.Add(window.Duration.Duration)
+		if end.After(from) {
+			intervals = append(intervals, interval{start: activation, end: end})
+		}
+	}
+
+	return intervals, nil
+}
+
+// ScheduleAt returns the state of the schedule at now.
+func ScheduleAt(schedule networkv1.Schedule, now time.Time) (ScheduleState, error) {
+	location, err := scheduleLocation(schedule)
+	if err != nil {
+		return ScheduleState{}, err
+	}
+
+	until := now.Add(scheduleHorizon)
+
+	var intervals []interval
+
+	for _, window := range schedule.Windows {
+		windowed, err := windowIntervals(window, location, now, until)
+		if err != nil {
+			return ScheduleState{}, err
+		}
+
+		intervals = append(intervals, windowed...)
+	}
+
+	for _, window := range schedule.Cron {
+		windowed, err := cronIntervals(window, location, now, until)
+		if err != nil {
+			return ScheduleState{}, err
+		}
+
+		intervals = append(intervals, windowed...)
+	}
+
+	return scheduleState(mergeIntervals(intervals), now, until), nil
+}
+
+// mergeIntervals sorts the intervals and joins those that overlap or touch.
+func mergeIntervals(intervals []interval) []interval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Before(intervals[j].start)
+	})
+
+	var merged []interval
+
+	for _, next := range intervals {
+		if last := len(merged) - 1; last >= 0 && !next.start.After(merged[last].end) {
+			if next.end.After(merged[last].end) {
+				merged[last].end = next.end
+			}
+
+			continue
+		}
+
+		merged = append(merged, next)
+	}
+
+	return merged
+}
+
+// scheduleState returns the state at now of the merged intervals. A close
+// past until is left zero, since a later window may extend it.
+func scheduleState(merged []interval, now time.Time, until time.Time) ScheduleState {
+	var state ScheduleState
+
+	for idx, current := range merged {
+		end := current.end
+		if end.After(until) {
+			end = time.Time{}
+		}
+
+		if !current.start.After(now) && (end.IsZero() || end.After(now)) {
+			state.Open = true
+			state.NextClose = end
+
+			if idx+1 < len(merged) {
+				state.NextOpen = merged[idx+1].start
+			}
+
+			return state
+		}
+
+		if current.start.After(now) {
+			state.NextOpen = current.start
+			state.NextClose = end
+
+			return state
+		}
+	}
+
+	return state
+}
+
+// SetSchedule records the next boundaries of the schedule in the status.
+func SetSchedule(status *networkv1.NatPMPStatus, state *ScheduleState) {
+	status.NextOpen = nil
+	status.NextClose = nil
+
+	if state == nil {
+		return
+	}
+
+	if !state.NextOpen.IsZero() {
+		nextOpen := metav1.NewTime(state.NextOpen)
+		status.NextOpen = &nextOpen
+	}
+
+	if !state.NextClose.IsZero() {
+		nextClose := metav1.NewTime(state.NextClose)
+		status.NextClose = &nextClose
+	}
+}
+
+// ValidateSchedule returns the errors in the schedule of the NatPMP.
+func ValidateSchedule(natpmpCR networkv1.NatPMP) field.ErrorList {
+	schedule := natpmpCR.Spec.Schedule
+	if schedule == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	path := field.NewPath("spec", "schedule")
+
+	if len(schedule.Windows) == 0 && len(schedule.Cron) == 0 {
+		allErrs = append(allErrs, field.Required(path, "a schedule needs a window or a cron window"))
+	}
+
+	if _, err := scheduleLocation(*schedule); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("timeZone"), schedule.TimeZone, err.Error()))
+	}
+
+	for idx, window := range schedule.Windows {
+		windowPath := path.Child("windows").Index(idx)
+
+		if _, _, err := parseClock(window.Start); err != nil {
+			allErrs = append(allErrs, field.Invalid(windowPath.Child("start"), window.Start, err.Error()))
+		}
+
+		if _, _, err := parseClock(window.End); err != nil {
+			allErrs = append(allErrs, field.Invalid(windowPath.Child("end"), window.End, err.Error()))
+		}
+	}
+
+	for idx, window := range schedule.Cron {
+		cronPath := path.Child("cron").Index(idx)
+
+		if _, err := cron.ParseStandard(window.Open); err != nil {
+			allErrs = append(allErrs, field.Invalid(cronPath.Child("open"), window.Open, err.Error()))
+		}
+
+		if window.Duration.Duration <= 0 {
+			allErrs = append(allErrs, field.Invalid(
+				cronPath.Child("duration"),
+				window.Duration.Duration.String(),
+				"duration must be positive",
+			))
+		}
+	}
+
+	return allErrs
+}
+
+// CloseSchedule releases the port mapping outside the windows of the
+// schedule and requeues when the next window opens.
+func (reconciler *NatPMPReconciler) CloseSchedule(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+	state ScheduleState,
+	now time.Time,
+) (ctrl.Result, error) {
+	err := reconciler.pause(ctx, natpmpCR, gateways, protocol, func(status *networkv1.NatPMPStatus) {
+		SetSchedule(status, &state)
+		SetCondition(
+			natpmpCR,
+			status,
+			networkv1.ConditionReady,
+			metav1.ConditionFalse,
+			networkv1.ReasonOutsideSchedule,
+			"port mapping is released outside the schedule",
+		)
+	})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{RequeueAfter: state.Boundary(now).Sub(now)}, nil
+}
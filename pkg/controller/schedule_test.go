@@ -0,0 +1,266 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// at returns the time of day on the date in the time zone.
+func at(t *testing.T, zone string, value string) time.Time {
+	t.Helper()
+
+	location, err := time.LoadLocation(zone)
+	require.NoError(t, err)
+
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, location)
+	require.NoError(t, err)
+
+	return parsed
+}
+
+func TestScheduleAt(t *testing.T) {
+	const newYork = "America/New_York"
+
+	weekdays := networkv1.Schedule{Windows: []networkv1.Window{{
+		Days:  []networkv1.Weekday{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday"},
+		Start: "09:00",
+		End:   "17:00",
+	}}}
+
+	overnight := networkv1.Schedule{Windows: []networkv1.Window{{Start: "22:00", End: "02:00"}}}
+
+	nightly := networkv1.Schedule{
+		TimeZone: newYork,
+		Windows:  []networkv1.Window{{Start: "00:00", End: "04:00"}},
+	}
+
+	business := weekdays
+	business.TimeZone = newYork
+
+	hourly := networkv1.Schedule{Cron: []networkv1.CronWindow{{
+		Open:     "0 * * * *",
+		Duration: metav1.Duration{Duration: 15 * time.Minute},
+	}}}
+
+	tests := []struct {
+		name     string
+		schedule networkv1.Schedule
+		now      time.Time
+		want     ScheduleState
+	}{
+		{
+			name:     "opens at start",
+			schedule: weekdays,
+			now:      at(t, "UTC", "2024-01-01 09:00"),
+			want: ScheduleState{
+				Open:      true,
+				NextOpen:  at(t, "UTC", "2024-01-02 09:00"),
+				NextClose: at(t, "UTC", "2024-01-01 17:00"),
+			},
+		},
+		{
+			name:     "closes at end",
+			schedule: weekdays,
+			now:      at(t, "UTC", "2024-01-01 17:00"),
+			want: ScheduleState{
+				NextOpen:  at(t, "UTC", "2024-01-02 09:00"),
+				NextClose: at(t, "UTC", "2024-01-02 17:00"),
+			},
+		},
+		{
+			name:     "skips the weekend",
+			schedule: weekdays,
+			now:      at(t, "UTC", "2024-01-05 17:30"),
+			want: ScheduleState{
+				NextOpen:  at(t, "UTC", "2024-01-08 09:00"),
+				NextClose: at(t, "UTC", "2024-01-08 17:00"),
+			},
+		},
+		{
+			name:     "crosses midnight",
+			schedule: overnight,
+			now:      at(t, "UTC", "2024-01-02 01:59"),
+			want: ScheduleState{
+				Open:      true,
+				NextOpen:  at(t, "UTC", "2024-01-02 22:00"),
+				NextClose: at(t, "UTC", "2024-01-02 02:00"),
+			},
+		},
+		{
+			name:     "keeps local time after spring forward",
+			schedule: business,
+			now:      at(t, newYork, "2024-03-08 17:00"),
+			want: ScheduleState{
+				NextOpen:  at(t, "UTC", "2024-03-11 13:00"),
+				NextClose: at(t, "UTC", "2024-03-11 21:00"),
+			},
+		},
+		{
+			name:     "is shorter on spring forward",
+			schedule: nightly,
+			now:      at(t, newYork, "2024-03-10 00:00"),
+			want: ScheduleState{
+				Open:      true,
+				NextOpen:  at(t, "UTC", "2024-03-11 04:00"),
+				NextClose: at(t, "UTC", "2024-03-10 08:00"),
+			},
+		},
+		{
+			name:     "is longer on fall back",
+			schedule: nightly,
+			now:      at(t, newYork, "2024-11-03 00:00"),
+			want: ScheduleState{
+				Open:      true,
+				NextOpen:  at(t, "UTC", "2024-11-04 05:00"),
+				NextClose: at(t, "UTC", "2024-11-03 09:00"),
+			},
+		},
+		{
+			name:     "cron window open",
+			schedule: hourly,
+			now:      at(t, "UTC", "2024-01-01 12:14"),
+			want: ScheduleState{
+				Open:      true,
+				NextOpen:  at(t, "UTC", "2024-01-01 13:00"),
+				NextClose: at(t, "UTC", "2024-01-01 12:15"),
+			},
+		},
+		{
+			name:     "cron window closed",
+			schedule: hourly,
+			now:      at(t, "UTC", "2024-01-01 12:15"),
+			want: ScheduleState{
+				NextOpen:  at(t, "UTC", "2024-01-01 13:00"),
+				NextClose: at(t, "UTC", "2024-01-01 13:15"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			state, err := ScheduleAt(test.schedule, test.now)
+			require.NoError(t, err)
+
+			require.Equal(t, test.want.Open, state.Open)
+			require.True(t, test.want.NextOpen.Equal(state.NextOpen), "next open %s", state.NextOpen)
+			require.True(t, test.want.NextClose.Equal(state.NextClose), "next close %s", state.NextClose)
+		})
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule networkv1.Schedule
+		want     []string
+	}{
+		{
+			name:     "valid",
+			schedule: networkv1.Schedule{Windows: []networkv1.Window{{Start: "09:00", End: "17:00"}}},
+		},
+		{
+			name: "empty",
+			want: []string{"spec.schedule"},
+		},
+		{
+			name: "time zone",
+			schedule: networkv1.Schedule{
+				TimeZone: "Nowhere/Special",
+				Windows:  []networkv1.Window{{Start: "09:00", End: "17:00"}},
+			},
+			want: []string{"spec.schedule.timeZone"},
+		},
+		{
+			name:     "times",
+			schedule: networkv1.Schedule{Windows: []networkv1.Window{{Start: "9am", End: "25:00"}}},
+			want:     []string{"spec.schedule.windows[0].start", "spec.schedule.windows[0].end"},
+		},
+		{
+			name:     "cron",
+			schedule: networkv1.Schedule{Cron: []networkv1.CronWindow{{Open: "every hour"}}},
+			want:     []string{"spec.schedule.cron[0].open", "spec.schedule.cron[0].duration"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			natpmpCR := mapped()
+			natpmpCR.Spec.Schedule = &test.schedule
+
+			var fields []string
+
+			for _, err := range ValidateSchedule(*natpmpCR) {
+				fields = append(fields, err.Field)
+			}
+
+			require.Equal(t, test.want, fields)
+		})
+	}
+
+	require.Empty(t, ValidateSchedule(*mapped()), "a NatPMP without a schedule is always open")
+}
+
+func TestReconcileSchedule(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+	natpmpCR.Spec.Lifetime = 7200
+	natpmpCR.Spec.Schedule = &networkv1.Schedule{
+		Windows: []networkv1.Window{{Start: "13:00", End: "14:00"}},
+	}
+
+	test := newTestReconciler(t, natpmpCR)
+
+	// Created at 12:00, an hour before the window opens.
+	result, stored := test.reconcile(t, natpmpCR)
+	require.Equal(t, time.Hour, result.RequeueAfter)
+	require.Empty(t, test.gateway.Requests())
+	require.Equal(t, created.Add(time.Hour), stored.Status.NextOpen.Time.UTC())
+
+	ready := meta.FindStatusCondition(stored.Status.Conditions, networkv1.ConditionReady)
+	require.NotNil(t, ready)
+	require.Equal(t, networkv1.ReasonOutsideSchedule, ready.Reason)
+
+	test.clock.Step(time.Hour)
+
+	result, stored = test.reconcile(t, natpmpCR)
+	require.Len(t, stored.Status.Mappings, 1)
+	require.Equal(t, time.Hour, result.RequeueAfter, "renewal is capped at the close")
+	require.Equal(t, created.Add(2*time.Hour), stored.Status.NextClose.Time.UTC())
+
+	test.clock.Step(time.Hour)
+
+	result, stored = test.reconcile(t, natpmpCR)
+	require.Empty(t, stored.Status.Mappings)
+	require.Equal(t, 23*time.Hour, result.RequeueAfter)
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Zero(t, requests[1].Lifetime)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// ErrNamespaced is returned for what needs cluster-scoped resources when the
+// reconciler only reads namespaced ones.
+var ErrNamespaced = errors.New("not available to a namespaced manager")
+
+// Defaulted returns a copy of the NatPMP with the configured gateway and
+// lifetime when it sets none. The copy is only for reading, patches are made
+// against the NatPMP itself.
+func (reconciler *NatPMPReconciler) Defaulted(natpmpCR networkv1.NatPMP) networkv1.NatPMP {
+	defaults := reconciler.Settings.Get().Defaults
+
+	if natpmpCR.Spec.Gateway == "" && natpmpCR.Spec.GatewayRef == "" {
+		natpmpCR.Spec.Gateway = defaults.Gateway
+	}
+
+	if natpmpCR.Spec.Lifetime == 0 {
+		natpmpCR.Spec.Lifetime = defaults.Lifetime
+	}
+
+	return natpmpCR
+}
+
+// renewalFraction returns the configured part of the lifetime of a mapping
+// after which it is renewed.
+func (reconciler *NatPMPReconciler) renewalFraction() float64 {
+	return reconciler.Settings.Get().Gateway.RenewalFraction
+}
+
+// listPolicies returns the NatPMPPolicies that apply to the NatPMP, none for
+// a namespaced reconciler since they are cluster-scoped. The manager warns
+// that they are not enforced when it starts namespaced.
+func (reconciler *NatPMPReconciler) listPolicies(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+) (*Policies, error) {
+	if reconciler.Namespaced {
+		return nil, nil
+	}
+
+	return ListPolicies(ctx, reconciler, natpmpCR)
+}
+
+// serves returns true if the shard of the reconciler includes the gateway of
+// the defaulted NatPMP.
+func (reconciler *NatPMPReconciler) serves(natpmpCR networkv1.NatPMP, config *GatewayConfig) bool {
+	addresses := []net.IP{
+		net.ParseIP(natpmpCR.Spec.Gateway),
+		net.ParseIP(natpmpCR.Spec.IPv6Gateway),
+	}
+
+	if config != nil {
+		addresses = append(addresses, config.Address)
+	}
+
+	return reconciler.Shard.Serves(natpmpCR.Spec.GatewayRef, addresses...)
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// shutdownTimeout bounds releasing the port mappings on shutdown, keeping
+// it within the default termination grace period of the pods.
+const shutdownTimeout = 8 * time.Second
+
+// ErrInvalidOnShutdown is returned for an unknown shutdown policy.
+var ErrInvalidOnShutdown = errors.New("on-shutdown must be retain or release")
+
+// ValidateOnShutdown returns an error if the shutdown policy is unknown.
+func ValidateOnShutdown(policy string) error {
+	switch policy {
+	case networkv1.OnShutdownRetain, networkv1.OnShutdownRelease:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidOnShutdown, policy)
+	}
+}
+
+// ShutdownPolicy returns the shutdown policy for the NatPMP, the annotation
+// when it is valid and fallback otherwise.
+func ShutdownPolicy(natpmpCR networkv1.NatPMP, fallback string) string {
+	policy := natpmpCR.Annotations[networkv1.AnnotationOnShutdown]
+	if ValidateOnShutdown(policy) != nil {
+		return fallback
+	}
+
+	return policy
+}
+
+// ShutdownReleaser returns a Runnable that, once the manager stops, releases
+// the port mappings held by the reconciler whose shutdown policy is release.
+// It runs with the reconcilers, so the caches are still available.
+func (reconciler *NatPMPReconciler) ShutdownReleaser() manager.Runnable {
+	return manager.RunnableFunc(func(ctx context.Context) error {
+		<-ctx.Done()
+
+		releaseCtx, cancel := context.WithTimeout(
+			log.IntoContext(context.Background(), log.FromContext(ctx)),
+			shutdownTimeout,
+		)
+		defer cancel()
+
+		return reconciler.ReleaseHeld(releaseCtx)
+	})
+}
+
+// ReleaseHeld releases the port mappings held by the reconciler whose
+// shutdown policy is release, returning the NatPMPs that could not be
+// released.
+func (reconciler *NatPMPReconciler) ReleaseHeld(ctx context.Context) error {
+	var errs []error
+
+	released := 0
+
+	for _, name := range reconciler.leases.Names() {
+		ok, err := reconciler.releaseHeld(ctx, name)
+		if err != nil {
+			Error(ctx, err, "unable to release port mapping on shutdown", "natpmp", name)
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+
+			continue
+		}
+
+		if ok {
+			released++
+		}
+	}
+
+	Info(ctx, "released port mappings on shutdown", "released", released, "failed", len(errs))
+
+	if err := kerrors.NewAggregate(errs); err != nil {
+		return fmt.Errorf("unable to release port mappings: %w", err)
+	}
+
+	return nil
+}
+
+// releaseHeld releases the port mapping held for the NatPMP when its
+// shutdown policy is release, returning true if it was released.
+func (reconciler *NatPMPReconciler) releaseHeld(
+	ctx context.Context,
+	name types.NamespacedName,
+) (bool, error) {
+	var natpmpCR networkv1.NatPMP
+	if err := reconciler.Get(ctx, name, &natpmpCR); err != nil {
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("unable to fetch NatPMP: %w", err)
+	}
+
+	if ShutdownPolicy(natpmpCR, reconciler.OnShutdown) != networkv1.OnShutdownRelease {
+		return false, nil
+	}
+
+	if err := reconciler.release(ctx, &natpmpCR); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// finalize releases the port mapping the controller holds for a deleted
+// NatPMP and removes its hostnames from the nameserver. Failing to release
+// is only logged, since the ledger sweep releases the mapping once the
+// NatPMP is gone. A mapping held by an agent is released by that agent,
+// unless its node is gone.
+func (reconciler *NatPMPReconciler) finalize(ctx context.Context, natpmpCR *networkv1.NatPMP) error {
+	reconciler.leases.Forget(client.ObjectKeyFromObject(natpmpCR))
+
+	if natpmpCR.Status.MappedNode == "" && len(natpmpCR.Status.Mappings) > 0 {
+		if err := reconciler.release(ctx, natpmpCR); err != nil {
+			Error(ctx, err, "unable to release port mapping of deleted NatPMP")
+		}
+	}
+
+	if mappedNode := natpmpCR.Status.MappedNode; mappedNode != "" {
+		gone, err := reconciler.nodeGone(ctx, mappedNode)
+		if err != nil {
+			return err
+		}
+
+		if gone {
+			if err := reconciler.setAgentFinalizer(ctx, natpmpCR, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return reconciler.UpdateDNS(ctx, natpmpCR)
+}
+
+// release deletes the port mapping held for the NatPMP on its gateway, drops
+// its lease and clears the mappings from its status.
+func (reconciler *NatPMPReconciler) release(ctx context.Context, natpmpCR *networkv1.NatPMP) error {
+	config, err := reconciler.ResolveGateway(ctx, *natpmpCR)
+	if err != nil {
+		return err
+	}
+
+	addresses, protocol, errs := ValidateNatPMP(reconciler.Defaulted(*natpmpCR), config)
+	if len(errs) > 0 {
+		return errs.ToAggregate()
+	}
+
+	gateways := reconciler.gatewayClients(*natpmpCR, addresses, config)
+
+	if err := reconciler.ReleasePortMapping(ctx, natpmpCR, gateways, protocol); err != nil {
+		return err
+	}
+
+	reconciler.leases.Forget(client.ObjectKeyFromObject(natpmpCR))
+	reconciler.forgetMappings(ctx, *natpmpCR)
+
+	err = reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		ClearMappings(status)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update NatPMP status: %w", err)
+	}
+
+	return nil
+}
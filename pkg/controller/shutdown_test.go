@@ -0,0 +1,106 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+func TestShutdownPolicy(t *testing.T) {
+	require.NoError(t, ValidateOnShutdown(networkv1.OnShutdownRetain))
+	require.NoError(t, ValidateOnShutdown(networkv1.OnShutdownRelease))
+	require.ErrorIs(t, ValidateOnShutdown("drop"), ErrInvalidOnShutdown)
+
+	natpmpCR := mapped()
+	require.Equal(t, networkv1.OnShutdownRetain, ShutdownPolicy(*natpmpCR, networkv1.OnShutdownRetain))
+
+	natpmpCR.Annotations = map[string]string{networkv1.AnnotationOnShutdown: networkv1.OnShutdownRelease}
+	require.Equal(t, networkv1.OnShutdownRelease, ShutdownPolicy(*natpmpCR, networkv1.OnShutdownRetain))
+
+	natpmpCR.Annotations[networkv1.AnnotationOnShutdown] = "drop"
+	require.Equal(t, networkv1.OnShutdownRetain, ShutdownPolicy(*natpmpCR, networkv1.OnShutdownRetain))
+}
+
+func TestShutdownReleaser(t *testing.T) {
+	released := mapped()
+	released.Name = "released"
+	released.Spec.Templates = nil
+	released.Annotations = map[string]string{networkv1.AnnotationOnShutdown: networkv1.OnShutdownRelease}
+
+	retained := mapped()
+	retained.Name = "retained"
+	retained.Spec.Templates = nil
+	retained.Spec.ExternalPort = 2223
+
+	test := newTestReconciler(t, released, retained)
+	test.OnShutdown = networkv1.OnShutdownRetain
+
+	_, _ = test.reconcile(t, released)
+	_, _ = test.reconcile(t, retained)
+	require.Len(t, test.gateway.Requests(), 2)
+
+	// The releaser runs until the manager stops.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.NoError(t, test.ShutdownReleaser().Start(ctx))
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 3, "only the mapping with the release policy is released")
+	require.Equal(t, 22, requests[2].InternalPort)
+	require.Equal(t, requests[0].Nonce, requests[2].Nonce)
+	require.Zero(t, requests[2].Lifetime)
+
+	var stored networkv1.NatPMP
+	require.NoError(t, test.Get(context.Background(), client.ObjectKeyFromObject(released), &stored))
+	require.Empty(t, stored.Status.Mappings)
+
+	_, ok := test.leases.Get(client.ObjectKeyFromObject(released))
+	require.False(t, ok)
+
+	require.NoError(t, test.Get(context.Background(), client.ObjectKeyFromObject(retained), &stored))
+	require.Len(t, stored.Status.Mappings, 1)
+
+	_, ok = test.leases.Get(client.ObjectKeyFromObject(retained))
+	require.True(t, ok)
+}
+
+func TestReleaseHeldFailure(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+
+	test := newTestReconciler(t, natpmpCR)
+	test.OnShutdown = networkv1.OnShutdownRelease
+
+	_, _ = test.reconcile(t, natpmpCR)
+
+	test.gateway.err = context.DeadlineExceeded
+
+	err := test.ReleaseHeld(context.Background())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var stored networkv1.NatPMP
+	require.NoError(t, test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+	require.Len(t, stored.Status.Mappings, 1, "a mapping that could not be released stays recorded")
+}
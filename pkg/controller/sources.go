@@ -0,0 +1,314 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+const (
+	// sourcePolicyPrefix prefixes the name of the NetworkPolicy limiting
+	// the sources of a NatPMP.
+	sourcePolicyPrefix = "natpmp-"
+
+	// sourcesFieldOwner owns the source fields applied to Services.
+	sourcesFieldOwner = "natpmp-controller-sources"
+)
+
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;patch
+
+// ValidateAllowedSourceCIDRs returns the errors in the allowed source CIDRs.
+func ValidateAllowedSourceCIDRs(natpmpCR networkv1.NatPMP) field.ErrorList {
+	var allErrs field.ErrorList
+
+	path := field.NewPath("spec", "allowedSourceCIDRs")
+
+	for idx, cidr := range natpmpCR.Spec.AllowedSourceCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Index(idx), cidr, "invalid CIDR"))
+		}
+	}
+
+	return allErrs
+}
+
+// sourcePolicyName returns the name of the NetworkPolicy of the NatPMP.
+func sourcePolicyName(natpmpCR networkv1.NatPMP) types.NamespacedName {
+	return types.NamespacedName{
+		Namespace: natpmpCR.Namespace,
+		Name:      sourcePolicyPrefix + natpmpCR.Name,
+	}
+}
+
+// backendSelector returns the selector of the backend pods of the target,
+// nil if the target is not a pod selector or a Service with a selector.
+func (reconciler *NatPMPReconciler) backendSelector(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+) (*metav1.LabelSelector, error) {
+	target := natpmpCR.Spec.Target
+	if target == nil {
+		return nil, nil
+	}
+
+	if target.PodSelector != nil {
+		return target.PodSelector, nil
+	}
+
+	if target.ServiceName == "" {
+		return nil, nil
+	}
+
+	var service corev1.Service
+
+	name := types.NamespacedName{Namespace: natpmpCR.Namespace, Name: target.ServiceName}
+	if err := reconciler.Get(ctx, name, &service); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("unable to fetch Service %s: %w", name, err)
+	}
+
+	if len(service.Spec.Selector) == 0 {
+		return nil, nil
+	}
+
+	return &metav1.LabelSelector{MatchLabels: service.Spec.Selector}, nil
+}
+
+// otherPorts returns the policy ports of every TCP, UDP and SCTP port but
+// the port of the protocol.
+func otherPorts(protocol corev1.Protocol, port int) []networkingv1.NetworkPolicyPort {
+	const maxPort = 65535
+
+	var ports []networkingv1.NetworkPolicyPort
+
+	portRange := func(protocol corev1.Protocol, start int, end int) {
+		if start > end {
+			return
+		}
+
+		from := intstr.FromInt(start)
+		to := int32(end)
+
+		ports = append(ports, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &from, EndPort: &to})
+	}
+
+	for _, other := range []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP} {
+		if other != protocol {
+			portRange(other, 1, maxPort)
+
+			continue
+		}
+
+		portRange(other, 1, port-1)
+		portRange(other, port+1, maxPort)
+	}
+
+	return ports
+}
+
+// SourcePolicy returns the NetworkPolicy allowing the allowed source CIDRs
+// to reach the internal port of the backend pods, nil when the NatPMP has no
+// allowed sources or its target selects no pods. Selecting the pods denies
+// any ingress no policy allows, so the policy also allows traffic from pods
+// in the cluster, and from any source to every other TCP, UDP and SCTP port.
+// Ingress of other protocols, such as ICMP, from outside the cluster is
+// denied.
+func (reconciler *NatPMPReconciler) SourcePolicy(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+) (*unstructured.Unstructured, error) {
+	if len(natpmpCR.Spec.AllowedSourceCIDRs) == 0 {
+		return nil, nil
+	}
+
+	selector, err := reconciler.backendSelector(ctx, natpmpCR)
+	if err != nil || selector == nil {
+		return nil, err
+	}
+
+	peers := make([]networkingv1.NetworkPolicyPeer, 0, len(natpmpCR.Spec.AllowedSourceCIDRs))
+	for _, cidr := range natpmpCR.Spec.AllowedSourceCIDRs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{CIDR: cidr},
+		})
+	}
+
+	protocol := corev1.Protocol(strings.ToUpper(natpmpCR.Spec.Protocol))
+	port := intstr.FromInt(natpmpCR.Spec.InternalPort)
+	name := sourcePolicyName(natpmpCR)
+
+	policy := networkingv1.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: networkingv1.SchemeGroupVersion.String(),
+			Kind:       "NetworkPolicy",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: name.Namespace,
+			Name:      name.Name,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: *selector,
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{
+					From:  peers,
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &protocol, Port: &port}},
+				},
+				{
+					From: []networkingv1.NetworkPolicyPeer{
+						{NamespaceSelector: &metav1.LabelSelector{}},
+					},
+				},
+				{
+					Ports: otherPorts(protocol, natpmpCR.Spec.InternalPort),
+				},
+			},
+		},
+	}
+
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&policy)
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert NetworkPolicy: %w", err)
+	}
+
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// DeleteSourcePolicy deletes the NetworkPolicy of the NatPMP, if any.
+func (reconciler *NatPMPReconciler) DeleteSourcePolicy(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+) error {
+	policy := &metav1.PartialObjectMetadata{}
+	policy.SetGroupVersionKind(networkingv1.SchemeGroupVersion.WithKind("NetworkPolicy"))
+
+	if err := reconciler.Get(ctx, sourcePolicyName(natpmpCR), policy); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	if !metav1.IsControlledBy(policy, &natpmpCR) {
+		return nil
+	}
+
+	if err := reconciler.Delete(ctx, policy); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	return nil
+}
+
+// managesFields returns true if the field owner manages fields of the object.
+func managesFields(object metav1.Object, owner string) bool {
+	for _, entry := range object.GetManagedFields() {
+		if entry.Manager == owner {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ApplyServiceSourceRanges limits the sources of a NodePort or LoadBalancer
+// Service target to the allowed source CIDRs, setting the Local external
+// traffic policy so client addresses are preserved for the NetworkPolicy.
+// The fields are applied with their own field owner without forcing
+// ownership, so values set by the Service owner are never overwritten but
+// fail the apply with a conflict. Emptying the list drops the fields the
+// controller alone set, back to their defaults, and leaves those shared with
+// the Service owner as they were.
+func (reconciler *NatPMPReconciler) ApplyServiceSourceRanges(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+) error {
+	target := natpmpCR.Spec.Target
+	if target == nil || target.ServiceName == "" {
+		return nil
+	}
+
+	var service corev1.Service
+
+	name := types.NamespacedName{Namespace: natpmpCR.Namespace, Name: target.ServiceName}
+	if err := reconciler.Get(ctx, name, &service); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	serviceType := service.Spec.Type
+	if serviceType != corev1.ServiceTypeNodePort && serviceType != corev1.ServiceTypeLoadBalancer {
+		return nil
+	}
+
+	cidrs := natpmpCR.Spec.AllowedSourceCIDRs
+	if len(cidrs) == 0 && !managesFields(&service, sourcesFieldOwner) {
+		return nil
+	}
+
+	spec := map[string]interface{}{}
+
+	if len(cidrs) > 0 {
+		spec["externalTrafficPolicy"] = string(corev1.ServiceExternalTrafficPolicyLocal)
+
+		if serviceType == corev1.ServiceTypeLoadBalancer {
+			ranges := make([]interface{}, 0, len(cidrs))
+			for _, cidr := range cidrs {
+				ranges = append(ranges, cidr)
+			}
+
+			spec["loadBalancerSourceRanges"] = ranges
+		}
+	}
+
+	apply := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"namespace": name.Namespace,
+			"name":      name.Name,
+		},
+		"spec": spec,
+	}}
+
+	err := reconciler.Patch(ctx, apply, client.Apply, client.FieldOwner(sourcesFieldOwner))
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("unable to apply Service %s source ranges, set by another field manager: %w", name, err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to apply Service %s source ranges: %w", name, err)
+	}
+
+	return nil
+}
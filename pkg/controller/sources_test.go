@@ -0,0 +1,112 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// portRange is a protocol and its first and last port.
+type portRange struct {
+	protocol corev1.Protocol
+	start    int
+	end      int32
+}
+
+// portRanges returns the port ranges of the policy ports.
+func portRanges(ports []networkingv1.NetworkPolicyPort) []portRange {
+	ranges := make([]portRange, 0, len(ports))
+
+	for _, port := range ports {
+		ranges = append(ranges, portRange{protocol: *port.Protocol, start: port.Port.IntValue(), end: *port.EndPort})
+	}
+
+	return ranges
+}
+
+func TestOtherPorts(t *testing.T) {
+	require.Equal(t, []portRange{
+		{corev1.ProtocolTCP, 1, 21},
+		{corev1.ProtocolTCP, 23, 65535},
+		{corev1.ProtocolUDP, 1, 65535},
+		{corev1.ProtocolSCTP, 1, 65535},
+	}, portRanges(otherPorts(corev1.ProtocolTCP, 22)))
+
+	require.Equal(t, []portRange{
+		{corev1.ProtocolTCP, 1, 65535},
+		{corev1.ProtocolUDP, 2, 65535},
+		{corev1.ProtocolSCTP, 1, 65535},
+	}, portRanges(otherPorts(corev1.ProtocolUDP, 1)))
+
+	require.Equal(t, []portRange{
+		{corev1.ProtocolTCP, 1, 65534},
+		{corev1.ProtocolUDP, 1, 65535},
+		{corev1.ProtocolSCTP, 1, 65535},
+	}, portRanges(otherPorts(corev1.ProtocolTCP, 65535)))
+}
+
+func TestSourcePolicy(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Target = &networkv1.Target{
+		PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "ssh"}},
+	}
+
+	test := newTestReconciler(t, natpmpCR)
+
+	policy, err := test.SourcePolicy(context.Background(), *natpmpCR)
+	require.NoError(t, err)
+	require.Nil(t, policy, "no policy without allowed sources")
+
+	natpmpCR.Spec.AllowedSourceCIDRs = []string{"198.51.100.0/24"}
+
+	policy, err = test.SourcePolicy(context.Background(), *natpmpCR)
+	require.NoError(t, err)
+	require.NotNil(t, policy)
+
+	var networkPolicy networkingv1.NetworkPolicy
+	require.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(policy.Object, &networkPolicy))
+
+	require.Equal(t, "natpmp-"+natpmpCR.Name, networkPolicy.Name)
+	require.Equal(t, *natpmpCR.Spec.Target.PodSelector, networkPolicy.Spec.PodSelector)
+
+	rules := networkPolicy.Spec.Ingress
+	require.Len(t, rules, 3)
+
+	// The allowed sources reach the internal port.
+	require.Equal(t, "198.51.100.0/24", rules[0].From[0].IPBlock.CIDR)
+	require.Len(t, rules[0].Ports, 1)
+	require.Equal(t, 22, rules[0].Ports[0].Port.IntValue())
+	require.Equal(t, corev1.ProtocolTCP, *rules[0].Ports[0].Protocol)
+
+	// The pods of the cluster reach every port.
+	require.NotNil(t, rules[1].From[0].NamespaceSelector)
+	require.Empty(t, rules[1].Ports)
+
+	// Any source reaches every other port.
+	require.Empty(t, rules[2].From)
+	require.Equal(t, portRanges(otherPorts(corev1.ProtocolTCP, 22)), portRanges(rules[2].Ports))
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// PatchStatus applies mutate to the status of the NatPMP and writes it with a
+// merge patch computed against the unmodified object. The patch carries the
+// resourceVersion so concurrent writers conflict instead of clobbering each
+// other; on conflict the latest object is fetched from the API server, since
+// the cache may still hold the stale one, and mutate is applied again.
+// Nothing is written when mutate leaves the status unchanged.
+func (reconciler *NatPMPReconciler) PatchStatus(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	mutate func(status *networkv1.NatPMPStatus),
+) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		original := natpmpCR.DeepCopy()
+
+		mutate(&natpmpCR.Status)
+
+		if equality.Semantic.DeepEqual(original.Status, natpmpCR.Status) {
+			return nil
+		}
+
+		patch := client.MergeFromWithOptions(original, client.MergeFromWithOptimisticLock{})
+
+		err := reconciler.Status().Patch(ctx, natpmpCR, patch)
+		if errors.IsConflict(err) {
+			key := client.ObjectKeyFromObject(natpmpCR)
+			if err := reconciler.apiReader().Get(ctx, key, natpmpCR); err != nil {
+				return fmt.Errorf("unable to refetch NatPMP: %w", err)
+			}
+
+			return err
+		}
+
+		if err != nil {
+			return fmt.Errorf("unable to patch NatPMP status: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update NatPMP status: %w", err)
+	}
+
+	return nil
+}
+
+// apiReader returns the reader that bypasses the cache, the client if there
+// is none.
+func (reconciler *NatPMPReconciler) apiReader() client.Reader {
+	if reconciler.APIReader == nil {
+		return reconciler.Client
+	}
+
+	return reconciler.APIReader
+}
+
+// SetCondition sets the condition on the status of the NatPMP, only moving
+// the transition time when the condition status changes.
+func SetCondition(
+	natpmpCR *networkv1.NatPMP,
+	status *networkv1.NatPMPStatus,
+	conditionType string,
+	conditionStatus metav1.ConditionStatus,
+	reason string,
+	message string,
+) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: natpmpCR.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// countingReader counts the reads made through it.
+type countingReader struct {
+	client.Reader
+
+	gets int
+}
+
+func (reader *countingReader) Get(
+	ctx context.Context,
+	key client.ObjectKey,
+	obj client.Object,
+	opts ...client.GetOption,
+) error {
+	reader.gets++
+
+	return reader.Reader.Get(ctx, key, obj, opts...)
+}
+
+func TestPatchStatusRefetchesFromAPIServer(t *testing.T) {
+	natpmpCR := expiring(0)
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, networkv1.AddToScheme(scheme))
+
+	conflicts := 1
+
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(natpmpCR).
+		WithStatusSubresource(natpmpCR).
+		WithInterceptorFuncs(interceptor.Funcs{
+			SubResourcePatch: func(
+				ctx context.Context,
+				inner client.Client,
+				subResourceName string,
+				obj client.Object,
+				patch client.Patch,
+				opts ...client.SubResourcePatchOption,
+			) error {
+				if conflicts > 0 {
+					conflicts--
+
+					return apierrors.NewConflict(schema.GroupResource{}, obj.GetName(), nil)
+				}
+
+				return inner.Status().Patch(ctx, obj, patch, opts...)
+			},
+		}).
+		Build()
+
+	reader := &countingReader{Reader: fakeClient}
+	reconciler := &NatPMPReconciler{Client: fakeClient, Scheme: scheme, APIReader: reader}
+
+	var current networkv1.NatPMP
+	require.NoError(t, fakeClient.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &current))
+
+	err := reconciler.PatchStatus(context.Background(), &current, func(status *networkv1.NatPMPStatus) {
+		status.MappedExternalPort = 2222
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, reader.gets)
+
+	var stored networkv1.NatPMP
+	require.NoError(t, fakeClient.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+	require.Equal(t, 2222, stored.Status.MappedExternalPort)
+}
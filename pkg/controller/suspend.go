@@ -0,0 +1,118 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+// Suspend releases the port mapping of a suspended NatPMP and stops renewing
+// it. The external port stays claimed and the templates are still applied,
+// so resuming restores the mapping on the same port.
+func (reconciler *NatPMPReconciler) Suspend(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+) error {
+	return reconciler.pause(ctx, natpmpCR, gateways, protocol, func(status *networkv1.NatPMPStatus) {
+		SetCondition(
+			natpmpCR,
+			status,
+			networkv1.ConditionSuspended,
+			metav1.ConditionTrue,
+			networkv1.ReasonSuspended,
+			"port mapping is released while suspended",
+		)
+		SetCondition(
+			natpmpCR,
+			status,
+			networkv1.ConditionReady,
+			metav1.ConditionFalse,
+			networkv1.ReasonSuspended,
+			"NatPMP is suspended",
+		)
+	})
+}
+
+// pause releases the port mapping held by the controller and stops renewing
+// it, then records mutate in the status, applies the templates and removes
+// the hostnames from the nameserver once the mapping is released. A mapping
+// held by an agent is released by that agent once no node is active.
+func (reconciler *NatPMPReconciler) pause(
+	ctx context.Context,
+	natpmpCR *networkv1.NatPMP,
+	gateways map[corev1.IPFamily]gateway.Client,
+	protocol string,
+	mutate func(status *networkv1.NatPMPStatus),
+) error {
+	released := false
+
+	if natpmpCR.Status.MappedNode == "" && len(natpmpCR.Status.Mappings) > 0 {
+		if err := reconciler.ReleasePortMapping(ctx, natpmpCR, gateways, protocol); err != nil {
+			return err
+		}
+
+		reconciler.forgetMappings(ctx, *natpmpCR)
+
+		released = true
+	}
+
+	reconciler.leases.Forget(client.ObjectKeyFromObject(natpmpCR))
+
+	err := reconciler.PatchStatus(ctx, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		if released {
+			ClearMappings(status)
+		}
+
+		SetActiveNode(status, nil, Failover{})
+		mutate(status)
+	})
+	if err != nil {
+		return WrapError(ctx, err, "unable to update NatPMP status")
+	}
+
+	if err := reconciler.ApplyTemplates(ctx, *natpmpCR); err != nil {
+		return WrapError(ctx, err, "unable to apply templates")
+	}
+
+	return reconciler.UpdateDNS(ctx, natpmpCR)
+}
+
+// SetResumed marks a suspended NatPMP as resumed once it is mapped again.
+func SetResumed(natpmpCR *networkv1.NatPMP, status *networkv1.NatPMPStatus) {
+	if !meta.IsStatusConditionTrue(status.Conditions, networkv1.ConditionSuspended) {
+		return
+	}
+
+	SetCondition(
+		natpmpCR,
+		status,
+		networkv1.ConditionSuspended,
+		metav1.ConditionFalse,
+		networkv1.ReasonResumed,
+		"port mapping is held again",
+	)
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+// suspend sets spec.suspend of the stored NatPMP.
+func suspend(t *testing.T, test *testReconciler, natpmpCR *networkv1.NatPMP, suspended bool) {
+	t.Helper()
+
+	var stored networkv1.NatPMP
+	require.NoError(t, test.Get(context.Background(), client.ObjectKeyFromObject(natpmpCR), &stored))
+
+	stored.Spec.Suspend = suspended
+	require.NoError(t, test.Update(context.Background(), &stored))
+}
+
+func TestReconcileSuspend(t *testing.T) {
+	natpmpCR := mapped()
+
+	test := newTestReconciler(t, natpmpCR)
+
+	_, stored := test.reconcile(t, natpmpCR)
+	require.Len(t, stored.Status.Mappings, 1)
+
+	suspend(t, test, natpmpCR, true)
+
+	result, stored := test.reconcile(t, natpmpCR)
+	require.Zero(t, result.RequeueAfter, "a suspended NatPMP is not renewed")
+
+	requests := test.gateway.Requests()
+	require.Len(t, requests, 2)
+	require.Zero(t, requests[1].Lifetime)
+	require.Equal(t, requests[0].Nonce, requests[1].Nonce)
+
+	require.Empty(t, stored.Status.Mappings)
+	require.Zero(t, stored.Status.MappedExternalPort)
+	require.True(t, meta.IsStatusConditionTrue(stored.Status.Conditions, networkv1.ConditionSuspended))
+
+	ready := meta.FindStatusCondition(stored.Status.Conditions, networkv1.ConditionReady)
+	require.NotNil(t, ready)
+	require.Equal(t, networkv1.ReasonSuspended, ready.Reason)
+
+	_, ok := test.leases.Get(client.ObjectKeyFromObject(natpmpCR))
+	require.False(t, ok)
+
+	applied := test.Applied()
+	require.Equal(t, "true", applied[len(applied)-1].GetAnnotations()[networkv1.AnnotationSuspended])
+
+	// Reconciling again while suspended does not touch the gateway.
+	_, _ = test.reconcile(t, natpmpCR)
+	require.Len(t, test.gateway.Requests(), 2)
+
+	suspend(t, test, natpmpCR, false)
+
+	_, stored = test.reconcile(t, natpmpCR)
+
+	requests = test.gateway.Requests()
+	require.Len(t, requests, 3)
+	require.Equal(t, 2222, requests[2].ExternalPort, "resuming maps the same port")
+	require.Equal(t, requests[0].Nonce, requests[2].Nonce)
+
+	require.Len(t, stored.Status.Mappings, 1)
+	require.True(t, meta.IsStatusConditionTrue(stored.Status.Conditions, networkv1.ConditionReady))
+
+	suspended := meta.FindStatusCondition(stored.Status.Conditions, networkv1.ConditionSuspended)
+	require.NotNil(t, suspended)
+	require.Equal(t, networkv1.ReasonResumed, suspended.Reason)
+
+	applied = test.Applied()
+	require.NotContains(t, applied[len(applied)-1].GetAnnotations(), networkv1.AnnotationSuspended)
+}
+
+func TestReconcileSuspendAgentHeld(t *testing.T) {
+	natpmpCR := mapped()
+	natpmpCR.Spec.Templates = nil
+	natpmpCR.Spec.Suspend = true
+
+	test := newTestReconciler(t, natpmpCR)
+
+	setStatus(t, test, natpmpCR, func(status *networkv1.NatPMPStatus) {
+		status.MappedNode = "node-a"
+		status.ActiveNode = "node-a"
+		status.Mappings = []networkv1.MappingStatus{{MappedExternalPort: 2222}}
+	})
+
+	_, stored := test.reconcile(t, natpmpCR)
+
+	require.Empty(t, test.gateway.Requests(), "the agent releases its own mapping")
+	require.Len(t, stored.Status.Mappings, 1)
+	require.Empty(t, stored.Status.ActiveNode, "no node is active while suspended")
+	require.True(t, meta.IsStatusConditionTrue(stored.Status.Conditions, networkv1.ConditionSuspended))
+}
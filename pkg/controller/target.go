@@ -0,0 +1,346 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/gateway"
+)
+
+// ErrTargetUnavailable is returned when the target has no ready address.
+var ErrTargetUnavailable = errors.New("target has no ready address")
+
+// ResolvedTarget is the node and addresses a NatPMP target resolved to.
+type ResolvedTarget struct {
+	// NodeName is the node hosting the target, if known.
+	NodeName string
+
+	// IPs are the addresses of the target.
+	IPs []net.IP
+}
+
+// IP returns the address of the target for the family, nil if it has none.
+func (target *ResolvedTarget) IP(family corev1.IPFamily) net.IP {
+	if target == nil {
+		return nil
+	}
+
+	for _, ip := range target.IPs {
+		if IPFamilyOf(ip) == family {
+			return ip
+		}
+	}
+
+	return nil
+}
+
+// String returns the addresses of the target, used to detect changes.
+func (target *ResolvedTarget) String() string {
+	if target == nil {
+		return ""
+	}
+
+	ips := make([]string, 0, len(target.IPs))
+	for _, ip := range target.IPs {
+		ips = append(ips, ip.String())
+	}
+
+	return strings.Join(ips, ",")
+}
+
+// MappingFailedReason returns the condition reason for a failed mapping.
+func MappingFailedReason(err error) string {
+	switch {
+	case errors.Is(err, ErrTargetUnavailable):
+		return networkv1.ReasonTargetUnavailable
+	case errors.Is(err, gateway.ErrThirdPartyUnsupported):
+		return networkv1.ReasonThirdPartyUnsupported
+	default:
+		return networkv1.ReasonMappingFailed
+	}
+}
+
+// IPFamilyOf returns the address family of the IP.
+func IPFamilyOf(ip net.IP) corev1.IPFamily {
+	if ip.To4() != nil {
+		return corev1.IPv4Protocol
+	}
+
+	return corev1.IPv6Protocol
+}
+
+// parseIPs parses the addresses, skipping any that are invalid.
+func parseIPs(addresses ...string) []net.IP {
+	ips := make([]net.IP, 0, len(addresses))
+
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
+
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+
+// ResolveTarget returns the node and addresses of the NatPMP target. It
+// returns nil when no target is set and the mapping points at the host the
+// request is made from. Service and pod selector targets fail over between
+// backends as described by SelectBackend.
+func (reconciler *NatPMPReconciler) ResolveTarget(
+	ctx context.Context,
+	natpmpCR networkv1.NatPMP,
+	now time.Time,
+) (*ResolvedTarget, Failover, error) {
+	target := natpmpCR.Spec.Target
+
+	var (
+		backends []ResolvedTarget
+		err      error
+	)
+
+	switch {
+	case target == nil:
+		return nil, Failover{}, nil
+
+	case target.InternalIP != "":
+		return &ResolvedTarget{IPs: parseIPs(target.InternalIP)}, Failover{}, nil
+
+	case target.NodeName != "":
+		resolved, err := reconciler.resolveNode(ctx, target.NodeName)
+
+		return resolved, Failover{}, err
+
+	case target.PodSelector != nil:
+		backends, err = reconciler.ReadyPods(ctx, natpmpCR.Namespace, target.PodSelector)
+
+	case target.ServiceName != "":
+		backends, err = reconciler.ServiceEndpoints(ctx, natpmpCR.Namespace, target.ServiceName)
+
+	default:
+		return nil, Failover{}, nil
+	}
+
+	if err != nil {
+		return nil, Failover{}, err
+	}
+
+	hysteresis := time.Duration(target.HysteresisSeconds) * time.Second
+
+	return SelectBackend(backends, natpmpCR.Status, hysteresis, now)
+}
+
+func (reconciler *NatPMPReconciler) resolveNode(
+	ctx context.Context,
+	name string,
+) (*ResolvedTarget, error) {
+	if reconciler.Namespaced {
+		return nil, fmt.Errorf("%w: node %s", ErrNamespaced, name)
+	}
+
+	var node corev1.Node
+	if err := reconciler.Get(ctx, types.NamespacedName{Name: name}, &node); err != nil {
+		return nil, fmt.Errorf("unable to fetch node %s: %w", name, err)
+	}
+
+	resolved := &ResolvedTarget{NodeName: name}
+
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP {
+			resolved.IPs = append(resolved.IPs, parseIPs(address.Address)...)
+		}
+	}
+
+	if len(resolved.IPs) == 0 {
+		return nil, fmt.Errorf("%w: node %s has no internal IP", ErrTargetUnavailable, name)
+	}
+
+	return resolved, nil
+}
+
+// isPodReady returns true if the pod is running, ready and not terminating.
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// ReadyPods returns the ready pods in the namespace matching the selector,
+// each with the node it runs on and its addresses. The result is sorted by
+// node and name so that the choice of pod is stable.
+func (reconciler *NatPMPReconciler) ReadyPods(
+	ctx context.Context,
+	namespace string,
+	labelSelector *metav1.LabelSelector,
+) ([]ResolvedTarget, error) {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod selector: %w", err)
+	}
+
+	var pods corev1.PodList
+
+	err = reconciler.List(
+		ctx,
+		&pods,
+		client.InNamespace(namespace),
+		client.MatchingLabelsSelector{Selector: selector},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods: %w", err)
+	}
+
+	sort.Slice(pods.Items, func(i, j int) bool {
+		left, right := pods.Items[i], pods.Items[j]
+		if left.Spec.NodeName != right.Spec.NodeName {
+			return left.Spec.NodeName < right.Spec.NodeName
+		}
+
+		return left.Name < right.Name
+	})
+
+	ready := make([]ResolvedTarget, 0, len(pods.Items))
+
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		if !isPodReady(pod) {
+			continue
+		}
+
+		resolved := ResolvedTarget{NodeName: pod.Spec.NodeName}
+		for _, podIP := range pod.Status.PodIPs {
+			resolved.IPs = append(resolved.IPs, parseIPs(podIP.IP)...)
+		}
+
+		if len(resolved.IPs) > 0 {
+			ready = append(ready, resolved)
+		}
+	}
+
+	return ready, nil
+}
+
+// isEndpointReady returns true if the endpoint is ready, a nil condition is
+// considered ready.
+func isEndpointReady(endpoint discoveryv1.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// endpointKey identifies the backend of an endpoint across the slices of
+// each address family.
+func endpointKey(endpoint discoveryv1.Endpoint) string {
+	if endpoint.TargetRef != nil && endpoint.TargetRef.UID != "" {
+		return string(endpoint.TargetRef.UID)
+	}
+
+	if endpoint.NodeName != nil {
+		return *endpoint.NodeName
+	}
+
+	return strings.Join(endpoint.Addresses, ",")
+}
+
+// ServiceEndpoints returns the ready endpoints of the Service grouped by
+// backend, each with the node it runs on and its addresses. The result is
+// sorted by node and key so that the choice of endpoint is stable.
+func (reconciler *NatPMPReconciler) ServiceEndpoints(
+	ctx context.Context,
+	namespace string,
+	name string,
+) ([]ResolvedTarget, error) {
+	var slices discoveryv1.EndpointSliceList
+
+	err := reconciler.List(
+		ctx,
+		&slices,
+		client.InNamespace(namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: name},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list endpoint slices: %w", err)
+	}
+
+	backends := map[string]*ResolvedTarget{}
+
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			if !isEndpointReady(endpoint) {
+				continue
+			}
+
+			key := endpointKey(endpoint)
+
+			backend, ok := backends[key]
+			if !ok {
+				backend = &ResolvedTarget{}
+				if endpoint.NodeName != nil {
+					backend.NodeName = *endpoint.NodeName
+				}
+
+				backends[key] = backend
+			}
+
+			backend.IPs = append(backend.IPs, parseIPs(endpoint.Addresses...)...)
+		}
+	}
+
+	keys := make([]string, 0, len(backends))
+	for key := range backends {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		left, right := backends[keys[i]], backends[keys[j]]
+		if left.NodeName != right.NodeName {
+			return left.NodeName < right.NodeName
+		}
+
+		return keys[i] < keys[j]
+	})
+
+	endpoints := make([]ResolvedTarget, 0, len(keys))
+	for _, key := range keys {
+		endpoints = append(endpoints, *backends[key])
+	}
+
+	return endpoints, nil
+}
@@ -23,7 +23,9 @@ import (
 	"io"
 	texttemplate "text/template"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/yaml"
 
 	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
@@ -31,6 +33,32 @@ import (
 
 const decodeBufferSize = 4096
 
+// ErrKindNotAllowed is returned when a template creates an object of a kind
+// the configuration does not allow.
+var ErrKindNotAllowed = errors.New("kind is not allowed")
+
+// AllowedKinds returns an error if any of the objects is not of one of the
+// kinds, given as Kind.group. Every kind is allowed when there are none.
+func AllowedKinds(objects []*unstructured.Unstructured, kinds []string) error {
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	allowed := make(map[schema.GroupKind]struct{}, len(kinds))
+	for _, kind := range kinds {
+		allowed[schema.ParseGroupKind(kind)] = struct{}{}
+	}
+
+	for _, object := range objects {
+		groupKind := object.GroupVersionKind().GroupKind()
+		if _, ok := allowed[groupKind]; !ok {
+			return fmt.Errorf("%w: %s", ErrKindNotAllowed, groupKind)
+		}
+	}
+
+	return nil
+}
+
 // TemplateSpec is a template safe version of the NatPMP spec object.
 type TemplateSpec struct {
 	ExternalPort int
@@ -38,11 +66,14 @@ type TemplateSpec struct {
 	Lifetime     int
 	Gateway      string
 	Protocol     string
+	Suspend      bool
 }
 
 // TemplateStatus is a template safe version of the NatPMP status object.
 type TemplateStatus struct {
 	ExternalIP               string
+	ExternalIPv4             string
+	ExternalIPv6             string
 	MappedInternalPort       int
 	MappedExternalPort       int
 	MappedLifetime           int
@@ -55,6 +86,17 @@ type TemplateDot struct {
 	Status TemplateStatus
 }
 
+// externalIP returns the external IP of the mapping for the family, if any.
+func externalIP(natpmpCR networkv1.NatPMP, family corev1.IPFamily) string {
+	for _, mapping := range natpmpCR.Status.Mappings {
+		if mapping.IPFamily == family {
+			return mapping.ExternalIP
+		}
+	}
+
+	return ""
+}
+
 // ProcessTemplate takes a template string and a NatPMP object and returns
 // a list of unstructured objects. The template is either a yaml or json
 // template.
@@ -74,9 +116,12 @@ func ProcessTemplate(
 			Lifetime:     natpmpCR.Spec.Lifetime,
 			Gateway:      natpmpCR.Spec.Gateway,
 			Protocol:     natpmpCR.Spec.Protocol,
+			Suspend:      natpmpCR.Spec.Suspend,
 		},
 		Status: TemplateStatus{
 			ExternalIP:               natpmpCR.Status.ExternalIP,
+			ExternalIPv4:             externalIP(natpmpCR, corev1.IPv4Protocol),
+			ExternalIPv6:             externalIP(natpmpCR, corev1.IPv6Protocol),
 			MappedInternalPort:       natpmpCR.Status.MappedInternalPort,
 			MappedExternalPort:       natpmpCR.Status.MappedExternalPort,
 			MappedLifetime:           natpmpCR.Status.MappedLifetime,
@@ -20,6 +20,8 @@ import (
 	"net"
 	"strings"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 
 	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
@@ -46,6 +48,153 @@ func ValidateGateway(gateway string, path ...string) (net.IP, *field.Error) {
 	return ip, nil
 }
 
+// ValidateIPFamilies returns the gateway to use for each of the IP families
+// and a list of errors if any. IPv4 mappings use the gateway, IPv6 mappings
+// use the IPv6 gateway falling back to the gateway.
+func ValidateIPFamilies(
+	families []corev1.IPFamily,
+	gateway net.IP,
+	ipv6Gateway net.IP,
+) (map[corev1.IPFamily]net.IP, field.ErrorList) {
+	var allErrs field.ErrorList
+
+	if ipv6Gateway == nil && gateway != nil && gateway.To4() == nil {
+		ipv6Gateway = gateway
+	}
+
+	gateways := map[corev1.IPFamily]net.IP{}
+
+	for idx, family := range families {
+		path := field.NewPath("spec", "ipFamilies").Index(idx)
+
+		if _, ok := gateways[family]; ok {
+			allErrs = append(allErrs, field.Duplicate(path, family))
+
+			continue
+		}
+
+		switch family {
+		case corev1.IPv4Protocol:
+			if gateway != nil && gateway.To4() == nil {
+				allErrs = append(allErrs, field.Invalid(
+					field.NewPath("spec", "gateway"),
+					gateway.String(),
+					"IPv4 mappings require an IPv4 gateway",
+				))
+			}
+
+			gateways[family] = gateway
+
+		case corev1.IPv6Protocol:
+			if ipv6Gateway == nil || ipv6Gateway.To4() != nil {
+				allErrs = append(allErrs, field.Required(
+					field.NewPath("spec", "ipv6Gateway"),
+					"IPv6 mappings require an IPv6 gateway",
+				))
+			}
+
+			gateways[family] = ipv6Gateway
+
+		default:
+			allErrs = append(allErrs, field.NotSupported(
+				path,
+				family,
+				[]string{string(corev1.IPv4Protocol), string(corev1.IPv6Protocol)},
+			))
+		}
+	}
+
+	return gateways, allErrs
+}
+
+// IPFamilies returns the IP families of the NatPMP in order, defaulting to
+// IPv4.
+func IPFamilies(natpmpCR networkv1.NatPMP) []corev1.IPFamily {
+	if len(natpmpCR.Spec.IPFamilies) == 0 {
+		return []corev1.IPFamily{corev1.IPv4Protocol}
+	}
+
+	return natpmpCR.Spec.IPFamilies
+}
+
+// ValidateTarget returns a list of errors if the target sets other than
+// exactly one field or the field is invalid.
+func ValidateTarget(target *networkv1.Target) field.ErrorList {
+	if target == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	path := field.NewPath("spec", "target")
+	set := 0
+
+	if target.NodeName != "" {
+		set++
+	}
+
+	if target.PodSelector != nil {
+		set++
+
+		if _, err := metav1.LabelSelectorAsSelector(target.PodSelector); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("podSelector"), target.PodSelector, err.Error()))
+		}
+	}
+
+	if target.ServiceName != "" {
+		set++
+	}
+
+	if target.InternalIP != "" {
+		set++
+
+		if _, err := ValidateGateway(target.InternalIP, "target", "internalIP"); err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	if set != 1 {
+		allErrs = append(allErrs, field.Invalid(path, target, "exactly one target must be set"))
+	}
+
+	return allErrs
+}
+
+// ValidateExternalPortRange returns a list of errors if the range is set
+// along with an external port or is invalid.
+func ValidateExternalPortRange(natpmpCR networkv1.NatPMP) field.ErrorList {
+	portRange := natpmpCR.Spec.ExternalPortRange
+	if portRange == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	path := field.NewPath("spec", "externalPortRange")
+
+	if natpmpCR.Spec.ExternalPort != 0 {
+		allErrs = append(allErrs, field.Invalid(
+			path,
+			portRange,
+			"externalPortRange requires externalPort to be 0",
+		))
+	}
+
+	if err := ValidatePort(portRange.Start, "externalPortRange", "start"); err != nil {
+		allErrs = append(allErrs, err)
+	}
+
+	if portRange.End != 0 && portRange.End < portRange.Start {
+		allErrs = append(allErrs, field.Invalid(path.Child("end"), portRange.End, "end is before start"))
+	}
+
+	if err := ValidatePort(portRange.End, "externalPortRange", "end"); err != nil {
+		allErrs = append(allErrs, err)
+	}
+
+	return allErrs
+}
+
 // ValidateLifetime returns an error if the lifetime is less than 1.
 func ValidateLifetime(lifetime int, path ...string) *field.Error {
 	if lifetime < 1 {
@@ -73,15 +222,74 @@ func ValidateProtocol(protocol string, path ...string) *field.Error {
 	return nil
 }
 
-// ValidateNatPMP returns the gateway IP, protocol, and a list of errors if any.
-func ValidateNatPMP(natpmpCR networkv1.NatPMP) (net.IP, string, field.ErrorList) {
+// ValidateGatewayRef returns the gateway address of the NatPMP and a list of
+// errors if any. Exactly one of the gateway and the gateway reference must
+// be set, the address of a referenced gateway comes from its config.
+func ValidateGatewayRef(natpmpCR networkv1.NatPMP, config *GatewayConfig) (net.IP, field.ErrorList) {
 	var allErrs field.ErrorList
 
+	switch {
+	case natpmpCR.Spec.Gateway != "" && natpmpCR.Spec.GatewayRef != "":
+		allErrs = append(allErrs, field.Invalid(
+			field.NewPath("spec", "gatewayRef"),
+			natpmpCR.Spec.GatewayRef,
+			"only one of gateway and gatewayRef may be set",
+		))
+
+	case natpmpCR.Spec.GatewayRef != "":
+		if config == nil {
+			allErrs = append(allErrs, field.NotFound(
+				field.NewPath("spec", "gatewayRef"),
+				natpmpCR.Spec.GatewayRef,
+			))
+
+			return nil, allErrs
+		}
+
+		if natpmpCR.Spec.ExternalPort != 0 &&
+			!PortAllowed(natpmpCR.Spec.ExternalPort, config.AllowedPortRanges) {
+			allErrs = append(allErrs, field.Forbidden(
+				field.NewPath("spec", "externalPort"),
+				"port is not allowed by NatPMPGateway "+config.Name,
+			))
+		}
+
+		return config.Address, allErrs
+	}
+
 	gateway, err := ValidateGateway(natpmpCR.Spec.Gateway, "gateway")
 	if err != nil {
 		allErrs = append(allErrs, err)
 	}
 
+	return gateway, allErrs
+}
+
+// ValidateNatPMP returns the gateway IP for each IP family, protocol, and a
+// list of errors if any. The config is the NatPMPGateway the NatPMP
+// references, if any. Violations of the NatPMPPolicies are returned by
+// ValidatePolicies instead, since they deny a valid NatPMP.
+func ValidateNatPMP(
+	natpmpCR networkv1.NatPMP,
+	config *GatewayConfig,
+) (map[corev1.IPFamily]net.IP, string, field.ErrorList) {
+	gateway, allErrs := ValidateGatewayRef(natpmpCR, config)
+
+	var err *field.Error
+
+	var ipv6Gateway net.IP
+
+	if natpmpCR.Spec.IPv6Gateway != "" {
+		ipv6Gateway, err = ValidateGateway(natpmpCR.Spec.IPv6Gateway, "ipv6Gateway")
+		if err != nil {
+			allErrs = append(allErrs, err)
+		}
+	}
+
+	gateways, errs := ValidateIPFamilies(IPFamilies(natpmpCR), gateway, ipv6Gateway)
+	allErrs = append(allErrs, errs...)
+	allErrs = append(allErrs, ValidateTarget(natpmpCR.Spec.Target)...)
+
 	protocol := strings.ToLower(natpmpCR.Spec.Protocol)
 	if err := ValidateProtocol(protocol, "protocol"); err != nil {
 		allErrs = append(allErrs, err)
@@ -91,6 +299,8 @@ func ValidateNatPMP(natpmpCR networkv1.NatPMP) (net.IP, string, field.ErrorList)
 		allErrs = append(allErrs, err)
 	}
 
+	allErrs = append(allErrs, ValidateExternalPortRange(natpmpCR)...)
+
 	if err := ValidatePort(natpmpCR.Spec.InternalPort, "internalPort"); err != nil {
 		allErrs = append(allErrs, err)
 	}
@@ -99,5 +309,8 @@ func ValidateNatPMP(natpmpCR networkv1.NatPMP) (net.IP, string, field.ErrorList)
 		allErrs = append(allErrs, err)
 	}
 
-	return gateway, protocol, allErrs
+	allErrs = append(allErrs, ValidateSchedule(natpmpCR)...)
+	allErrs = append(allErrs, ValidateAllowedSourceCIDRs(natpmpCR)...)
+
+	return gateways, protocol, allErrs
 }
@@ -0,0 +1,78 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Watcher starts metadata-only watches on demand for the kinds created by
+// the templates, so that drift or deletion of an owned object is mapped back
+// to the owning NatPMP and corrected without waiting for a lease renewal.
+type Watcher struct {
+	controller controller.Controller
+	cache      cache.Cache
+	handler    handler.EventHandler
+
+	mu      sync.Mutex
+	watched map[schema.GroupVersionKind]struct{}
+}
+
+// NewWatcher returns a Watcher that adds watches to the controller using the
+// cache, enqueuing the controlling owner of each event.
+func NewWatcher(
+	ctrl controller.Controller,
+	cache cache.Cache,
+	handler handler.EventHandler,
+) *Watcher {
+	return &Watcher{
+		controller: ctrl,
+		cache:      cache,
+		handler:    handler,
+		watched:    map[schema.GroupVersionKind]struct{}{},
+	}
+}
+
+// Watch ensures a watch is running for the GroupVersionKind. It is safe to
+// call repeatedly, only the first call for a kind starts an informer.
+func (watcher *Watcher) Watch(gvk schema.GroupVersionKind) error {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	if _, ok := watcher.watched[gvk]; ok {
+		return nil
+	}
+
+	object := &metav1.PartialObjectMetadata{}
+	object.SetGroupVersionKind(gvk)
+
+	if err := watcher.controller.Watch(source.Kind(watcher.cache, object), watcher.handler); err != nil {
+		return fmt.Errorf("unable to watch %s: %w", gvk, err)
+	}
+
+	watcher.watched[gvk] = struct{}{}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+	"github.com/jkoelker/natpmp-controller/pkg/settings"
+)
+
+// NatPMPValidator rejects NatPMPs at admission that request an external port
+// an older NatPMP already claims on the same gateway, that a NatPMPPolicy
+// forbids or that would exceed a NatPMPQuota.
+type NatPMPValidator struct {
+	client.Reader
+
+	// Settings hold the configuration of the manager, the defaults if nil.
+	Settings *settings.Store
+}
+
+//+kubebuilder:webhook:path=/validate-network-natpmp-jkoelker-github-io-v1-natpmp,mutating=false,failurePolicy=fail,sideEffects=None,groups=network.natpmp.jkoelker.github.io,resources=natpmps,verbs=create;update,versions=v1,name=vnatpmp.kb.io,admissionReviewVersions=v1
+
+// ValidateCreate implements admission.CustomValidator.
+func (validator *NatPMPValidator) ValidateCreate(
+	ctx context.Context,
+	obj runtime.Object,
+) (admission.Warnings, error) {
+	return nil, validator.validate(ctx, obj)
+}
+
+// ValidateUpdate implements admission.CustomValidator. Only a changed spec is
+// validated, so updates of the metadata are not refused for a policy or
+// quota that changed since the NatPMP was admitted.
+func (validator *NatPMPValidator) ValidateUpdate(
+	ctx context.Context,
+	oldObj runtime.Object,
+	newObj runtime.Object,
+) (admission.Warnings, error) {
+	oldNatPMP, oldOK := oldObj.(*networkv1.NatPMP)
+	newNatPMP, newOK := newObj.(*networkv1.NatPMP)
+
+	if oldOK && newOK && equality.Semantic.DeepEqual(oldNatPMP.Spec, newNatPMP.Spec) {
+		return nil, nil
+	}
+
+	return nil, validator.validate(ctx, newObj)
+}
+
+// ValidateDelete implements admission.CustomValidator.
+func (validator *NatPMPValidator) ValidateDelete(
+	_ context.Context,
+	_ runtime.Object,
+) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (validator *NatPMPValidator) validate(ctx context.Context, obj runtime.Object) error {
+	natpmpCR, ok := obj.(*networkv1.NatPMP)
+	if !ok {
+		return fmt.Errorf("expected a NatPMP but got %T", obj)
+	}
+
+	allErrs := ValidateExternalPortRange(*natpmpCR)
+	allErrs = append(allErrs, ValidateSchedule(*natpmpCR)...)
+	allErrs = append(allErrs, ValidateAllowedSourceCIDRs(*natpmpCR)...)
+
+	policies, err := ListPolicies(ctx, validator, *natpmpCR)
+	if err != nil {
+		return err
+	}
+
+	allErrs = append(allErrs, ValidatePolicies(*natpmpCR, policies)...)
+
+	quotas, err := ListQuotas(ctx, validator, *natpmpCR)
+	if err != nil {
+		return err
+	}
+
+	allErrs = append(allErrs, ValidateQuotas(*natpmpCR, quotas)...)
+
+	if port := natpmpCR.Spec.ExternalPort; port != 0 {
+		var natpmps networkv1.NatPMPList
+		if err := validator.List(ctx, &natpmps); err != nil {
+			return fmt.Errorf("unable to list NatPMPs: %w", err)
+		}
+
+		keys, err := ListGatewayKeys(ctx, validator, validator.Settings.Get().Defaults.Gateway)
+		if err != nil {
+			return err
+		}
+
+		// Only an older claimant refuses the port, as in AllocatePort.
+		claimant, ok := PortClaims(*natpmpCR, natpmps.Items, keys)[port]
+		if ok && claimsBefore(claimant, *natpmpCR) {
+			allErrs = append(allErrs, field.Duplicate(
+				field.NewPath("spec", "externalPort"),
+				fmt.Sprintf("%d is claimed by %s/%s", port, claimant.Namespace, claimant.Name),
+			))
+		}
+	}
+
+	if len(allErrs) > 0 {
+		gvk := networkv1.GroupVersionKind()
+
+		return errors.NewInvalid(gvk.GroupKind(), natpmpCR.Name, allErrs)
+	}
+
+	return nil
+}
+
+// SetupWebhookWithManager registers the validating webhook with the Manager.
+func (validator *NatPMPValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	err := ctrl.NewWebhookManagedBy(mgr).
+		For(&networkv1.NatPMP{}).
+		WithValidator(validator).
+		Complete()
+	if err != nil {
+		return fmt.Errorf("unable to complete webhook: %w", err)
+	}
+
+	return nil
+}
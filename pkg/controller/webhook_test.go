@@ -0,0 +1,80 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+func TestValidatePortClaims(t *testing.T) {
+	older := claiming("older", 0, "", 2222)
+	older.Spec.GatewayRef = "home"
+
+	newer := claiming("newer", 2*time.Minute, "192.0.2.1", 2223)
+
+	test := newTestReconciler(t, older, newer, &networkv1.NatPMPGateway{
+		ObjectMeta: metav1.ObjectMeta{Name: "home"},
+		Spec:       networkv1.NatPMPGatewaySpec{Address: "192.0.2.1"},
+	})
+	validator := &NatPMPValidator{Reader: test.Client}
+
+	// The port claimed through the reference to the same router is refused.
+	pending := claiming("pending", 0, "192.0.2.1", 2222)
+	pending.CreationTimestamp = metav1.Time{}
+
+	_, err := validator.ValidateCreate(context.Background(), pending)
+	require.True(t, apierrors.IsInvalid(err))
+
+	// A newer claimant does not refuse the port of an older NatPMP.
+	existing := claiming("existing", time.Minute, "192.0.2.1", 2224)
+
+	moved := existing.DeepCopy()
+	moved.Spec.ExternalPort = 2223
+
+	_, err = validator.ValidateUpdate(context.Background(), existing, moved)
+	require.NoError(t, err)
+
+	changed := existing.DeepCopy()
+	changed.Spec.ExternalPort = 2222
+
+	_, err = validator.ValidateUpdate(context.Background(), existing, changed)
+	require.True(t, apierrors.IsInvalid(err))
+}
+
+func TestValidateUpdateUnchangedSpec(t *testing.T) {
+	older := claiming("older", 0, "192.0.2.1", 2222)
+	test := newTestReconciler(t, older)
+	validator := &NatPMPValidator{Reader: test.Client}
+
+	// A NatPMP admitted before a conflicting claim appeared may still be
+	// relabeled.
+	newer := claiming("newer", time.Minute, "192.0.2.1", 2222)
+	relabeled := newer.DeepCopy()
+	relabeled.Labels = map[string]string{"team": "web"}
+
+	_, err := validator.ValidateUpdate(context.Background(), newer, relabeled)
+	require.NoError(t, err)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gateway
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// routeTable is the IPv4 routing table of the host on Linux.
+const routeTable = "/proc/net/route"
+
+// ErrNoDefaultRoute is returned when the host has no IPv4 default route.
+var ErrNoDefaultRoute = errors.New("no default route")
+
+// Discover returns the IPv4 default gateway of the host.
+func Discover() (net.IP, error) {
+	file, err := os.Open(routeTable)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read routing table: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	// Skip the header.
+	scanner.Scan()
+
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != net.IPv4len {
+			continue
+		}
+
+		// The kernel writes the address in host byte order.
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+
+		if !ip.IsUnspecified() {
+			return ip, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read routing table: %w", err)
+	}
+
+	return nil, ErrNoDefaultRoute
+}
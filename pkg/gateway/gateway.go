@@ -0,0 +1,211 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gateway provides a common client for the port mapping protocols
+// spoken by gateways.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/jkoelker/natpmp-controller/pkg/pcp"
+)
+
+// Port is the port NAT-PMP and PCP servers listen on.
+const Port = 5351
+
+// Backends select the protocols spoken to a gateway.
+const (
+	// BackendAuto picks the protocols by the family of the gateway address.
+	BackendAuto = "Auto"
+
+	// BackendNatPMP only speaks NAT-PMP.
+	BackendNatPMP = "NatPMP"
+
+	// BackendPCP only speaks PCP.
+	BackendPCP = "PCP"
+)
+
+// ErrThirdPartyUnsupported is returned when a mapping to a host other than
+// the requesting host is asked of a gateway that cannot make one.
+var ErrThirdPartyUnsupported = errors.New("gateway does not support third party mappings")
+
+// Request is a request to map a port on the gateway.
+type Request struct {
+	// Protocol is "tcp" or "udp".
+	Protocol string
+
+	// InternalPort is the port on the internal host.
+	InternalPort int
+
+	// ExternalPort is the requested external port.
+	ExternalPort int
+
+	// Lifetime is the requested lifetime in seconds, 0 deletes the mapping.
+	Lifetime int
+
+	// InternalIP is the internal host to map to, nil maps to the requesting
+	// host.
+	InternalIP net.IP
+
+	// Nonce identifies the mapping to PCP gateways. It must be the same for
+	// every request for the mapping, including the one deleting it.
+	Nonce []byte
+}
+
+// Mapping is a port mapping held on the gateway.
+type Mapping struct {
+	// ExternalIP is the external address of the mapping.
+	ExternalIP net.IP
+
+	// InternalIP is the internal address of the mapping, if known.
+	InternalIP net.IP
+
+	// InternalPort is the port on the internal host.
+	InternalPort int
+
+	// ExternalPort is the external port assigned by the gateway.
+	ExternalPort int
+
+	// Lifetime is the lifetime in seconds assigned by the gateway.
+	Lifetime int
+
+	// SecondsSinceStartOfEpoch is the gateway's epoch time.
+	SecondsSinceStartOfEpoch int
+}
+
+// Client maps ports on a gateway.
+type Client interface {
+	// AddPortMapping creates, renews or deletes a port mapping.
+	AddPortMapping(ctx context.Context, req Request) (*Mapping, error)
+}
+
+// Chain is a Client that tries each Client in order, moving on to the next
+// when one does not support third party mappings.
+type Chain []Client
+
+// AddPortMapping implements Client.
+func (chain Chain) AddPortMapping(ctx context.Context, req Request) (*Mapping, error) {
+	err := ErrThirdPartyUnsupported
+
+	for _, client := range chain {
+		var mapping *Mapping
+
+		mapping, err = client.AddPortMapping(ctx, req)
+		if !errors.Is(err, ErrThirdPartyUnsupported) {
+			return mapping, err
+		}
+	}
+
+	return nil, err
+}
+
+// Options configure the Client for a gateway.
+type Options struct {
+	// Backend is the protocol spoken to the gateway, BackendAuto if empty.
+	Backend string
+
+	// Timeout bounds each request, zero uses the protocol's own
+	// retransmission limits.
+	Timeout time.Duration
+
+	// Limiter limits the requests sent to the gateway, nil is unlimited.
+	Limiter *rate.Limiter
+}
+
+// New returns the Client for the family of the gateway address. IPv4 uses
+// NAT-PMP, falling back to PCP for third party mappings, and IPv6 uses PCP.
+func New(gateway net.IP) Client {
+	return NewWithOptions(gateway, Options{})
+}
+
+// NewWithOptions returns the Client for the gateway configured by the
+// options.
+func NewWithOptions(gateway net.IP, opts Options) Client {
+	var client Client
+
+	switch {
+	case opts.Backend == BackendNatPMP:
+		client = NewNatPMPWithTimeout(gateway, opts.Timeout)
+	case opts.Backend == BackendPCP || gateway.To4() == nil:
+		client = NewPCP(gateway)
+	default:
+		client = Chain{NewNatPMPWithTimeout(gateway, opts.Timeout), NewPCP(gateway)}
+	}
+
+	if opts.Timeout > 0 || opts.Limiter != nil {
+		client = &Limited{Client: client, Timeout: opts.Timeout, Limiter: opts.Limiter}
+	}
+
+	return client
+}
+
+// Status is the state of a gateway reported by a probe.
+type Status struct {
+	// ExternalIP is the external address of the gateway, if the protocol
+	// reports it.
+	ExternalIP net.IP
+
+	// SecondsSinceStartOfEpoch is the gateway's epoch time.
+	SecondsSinceStartOfEpoch int
+}
+
+// Probe checks the gateway is reachable. NAT-PMP gateways report their
+// external address, PCP gateways only their epoch.
+func Probe(ctx context.Context, gateway net.IP, opts Options) (*Status, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	if opts.Backend == BackendPCP || gateway.To4() == nil {
+		epoch, err := pcp.NewClient(gateway).Announce(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to probe gateway: %w", err)
+		}
+
+		return &Status{SecondsSinceStartOfEpoch: int(epoch)}, nil
+	}
+
+	return NewNatPMPWithTimeout(gateway, opts.Timeout).Probe(ctx)
+}
+
+// LocalAddress returns the address of the local host used to reach the
+// gateway, which is the internal address of mappings it requests.
+func LocalAddress(gateway net.IP) (net.IP, error) {
+	// Connecting a UDP socket selects the route without sending anything.
+	conn, err := net.Dial("udp", net.JoinHostPort(gateway.String(), strconv.Itoa(Port)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to find route to gateway: %w", err)
+	}
+	defer conn.Close()
+
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address %s", conn.LocalAddr())
+	}
+
+	return local.IP, nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limited is a Client that bounds each request by a timeout and waits for
+// the rate limiter before sending it.
+type Limited struct {
+	Client
+
+	// Timeout bounds each request, zero is unbounded.
+	Timeout time.Duration
+
+	// Limiter limits the requests sent, nil is unlimited.
+	Limiter *rate.Limiter
+}
+
+// AddPortMapping implements Client.
+func (limited *Limited) AddPortMapping(ctx context.Context, req Request) (*Mapping, error) {
+	if limited.Limiter != nil {
+		if err := limited.Limiter.Wait(ctx); err != nil {
+			return nil, fmt.Errorf("rate limited: %w", err)
+		}
+	}
+
+	if limited.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, limited.Timeout)
+		defer cancel()
+	}
+
+	return limited.Client.AddPortMapping(ctx, req)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	natpmp "github.com/jackpal/go-nat-pmp"
+)
+
+// NatPMP is a Client speaking NAT-PMP, which only supports IPv4.
+// NAT-PMP always maps to the requesting host, so third party requests return
+// ErrThirdPartyUnsupported.
+type NatPMP struct {
+	gateway net.IP
+	client  *natpmp.Client
+}
+
+// NewNatPMP returns a NAT-PMP client for the gateway.
+func NewNatPMP(gateway net.IP) *NatPMP {
+	return &NatPMP{gateway: gateway, client: natpmp.NewClient(gateway)}
+}
+
+// NewNatPMPWithTimeout returns a NAT-PMP client for the gateway giving up on
+// each request after the timeout, zero uses the protocol's retransmission
+// limit.
+func NewNatPMPWithTimeout(gateway net.IP, timeout time.Duration) *NatPMP {
+	if timeout <= 0 {
+		return NewNatPMP(gateway)
+	}
+
+	return &NatPMP{gateway: gateway, client: natpmp.NewClientWithTimeout(gateway, timeout)}
+}
+
+// Probe requests the external address of the gateway.
+func (gateway *NatPMP) Probe(_ context.Context) (*Status, error) {
+	external, err := gateway.client.GetExternalAddress()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get external IP: %w", err)
+	}
+
+	return &Status{
+		ExternalIP:               net.IP(external.ExternalIPAddress[:]),
+		SecondsSinceStartOfEpoch: int(external.SecondsSinceStartOfEpoc),
+	}, nil
+}
+
+// AddPortMapping implements Client.
+func (gateway *NatPMP) AddPortMapping(_ context.Context, req Request) (*Mapping, error) {
+	local, err := LocalAddress(gateway.gateway)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.InternalIP != nil && !local.Equal(req.InternalIP) {
+		return nil, fmt.Errorf("%w: %s is not the local host", ErrThirdPartyUnsupported, req.InternalIP)
+	}
+
+	external, err := gateway.client.GetExternalAddress()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get external IP: %w", err)
+	}
+
+	response, err := gateway.client.AddPortMapping(
+		req.Protocol,
+		req.InternalPort,
+		req.ExternalPort,
+		req.Lifetime,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to add port mapping: %w", err)
+	}
+
+	return &Mapping{
+		ExternalIP:               net.IP(external.ExternalIPAddress[:]),
+		InternalIP:               local,
+		InternalPort:             int(response.InternalPort),
+		ExternalPort:             int(response.MappedExternalPort),
+		Lifetime:                 int(response.PortMappingLifetimeInSeconds),
+		SecondsSinceStartOfEpoch: int(response.SecondsSinceStartOfEpoc),
+	}, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/jkoelker/natpmp-controller/pkg/pcp"
+)
+
+// PCP is a Client speaking the Port Control Protocol. For IPv6 the gateway
+// opens a firewall pinhole, so the external address of the mapping is the
+// internal address of the host. Mappings for other hosts are requested with
+// the THIRD_PARTY option.
+type PCP struct {
+	gateway net.IP
+	client  *pcp.Client
+}
+
+// NewPCP returns a PCP client for the gateway.
+func NewPCP(gateway net.IP) *PCP {
+	return &PCP{gateway: gateway, client: pcp.NewClient(gateway)}
+}
+
+// AddPortMapping implements Client.
+func (gateway *PCP) AddPortMapping(ctx context.Context, req Request) (*Mapping, error) {
+	local, err := LocalAddress(gateway.gateway)
+	if err != nil {
+		return nil, err
+	}
+
+	thirdParty := req.InternalIP != nil && !local.Equal(req.InternalIP)
+
+	mapReq := pcp.MapRequest{
+		Protocol:              req.Protocol,
+		InternalPort:          uint16(req.InternalPort),
+		SuggestedExternalPort: uint16(req.ExternalPort),
+		Lifetime:              uint32(req.Lifetime),
+		Nonce:                 req.Nonce,
+	}
+
+	if thirdParty {
+		mapReq.ThirdParty = req.InternalIP
+	}
+
+	response, err := gateway.client.Map(ctx, mapReq)
+	if err != nil {
+		var resultErr *pcp.ResultError
+		if thirdParty && errors.As(err, &resultErr) &&
+			(resultErr.Code == pcp.UnsuppVersion || resultErr.Code == pcp.UnsuppOption) {
+			return nil, fmt.Errorf("%w: %w", ErrThirdPartyUnsupported, err)
+		}
+
+		return nil, fmt.Errorf("unable to map port: %w", err)
+	}
+
+	return &Mapping{
+		ExternalIP:               response.ExternalIP,
+		InternalIP:               response.InternalIP,
+		InternalPort:             int(response.InternalPort),
+		ExternalPort:             int(response.ExternalPort),
+		Lifetime:                 int(response.Lifetime),
+		SecondsSinceStartOfEpoch: int(response.Epoch),
+	}, nil
+}
@@ -0,0 +1,431 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pcp implements the MAP opcode of the Port Control Protocol.
+//
+// See https://tools.ietf.org/rfc/rfc6887.txt
+package pcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// Port is the port PCP servers listen on.
+	Port = 5351
+
+	version = 2
+
+	opcodeAnnounce = 0
+	opcodeMap      = 1
+	opResponse     = 0x80
+
+	optionThirdParty = 1
+
+	headerSize       = 24
+	mapPayloadSize   = 36
+	optionHeaderSize = 4
+	nonceSize        = 12
+	addressSize      = 16
+	maxPacketSize    = 1100
+
+	protocolTCP = 6
+	protocolUDP = 17
+
+	initialRetransmit = 250 * time.Millisecond
+	maxAttempts       = 9
+)
+
+var (
+	// ErrUnknownProtocol is returned when the mapping protocol is not TCP
+	// or UDP.
+	ErrUnknownProtocol = errors.New("unknown protocol")
+
+	// ErrMalformedResponse is returned when the server response cannot be
+	// parsed or does not match the request.
+	ErrMalformedResponse = errors.New("malformed response")
+
+	// ErrInvalidNonce is returned when a MAP request does not carry a 12
+	// byte nonce.
+	ErrInvalidNonce = errors.New("invalid nonce")
+)
+
+// ResultCode is the result of a PCP request.
+type ResultCode uint8
+
+// Result codes from RFC 6887 section 7.4.
+const (
+	Success ResultCode = iota
+	UnsuppVersion
+	NotAuthorized
+	MalformedRequest
+	UnsuppOpcode
+	UnsuppOption
+	MalformedOption
+	NetworkFailure
+	NoResources
+	UnsuppProtocol
+	UserExQuota
+	CannotProvideExternal
+	AddressMismatch
+	ExcessiveRemotePeers
+)
+
+// ResultError is returned when the server responds with a non-success
+// result code.
+type ResultError struct {
+	Code ResultCode
+}
+
+func (err *ResultError) Error() string {
+	return "pcp result code " + strconv.Itoa(int(err.Code))
+}
+
+// MapRequest is a request to create, renew or delete a mapping.
+type MapRequest struct {
+	// Protocol is "tcp" or "udp".
+	Protocol string
+
+	// InternalPort is the port on the client.
+	InternalPort uint16
+
+	// SuggestedExternalPort is the external port the client would like.
+	SuggestedExternalPort uint16
+
+	// SuggestedExternalIP is the external address the client would like,
+	// nil lets the server choose.
+	SuggestedExternalIP net.IP
+
+	// Lifetime is the requested lifetime in seconds, 0 deletes the mapping.
+	Lifetime uint32
+
+	// ThirdParty is the internal address to map to when it is not the
+	// client, sent with the THIRD_PARTY option.
+	ThirdParty net.IP
+
+	// Nonce is the 12 byte mapping nonce from NewNonce. Servers only renew
+	// or delete a mapping when the nonce matches the one it was created
+	// with, so it must be kept for the lifetime of the mapping.
+	Nonce []byte
+}
+
+// MapResponse is the server's response to a MapRequest.
+type MapResponse struct {
+	// Lifetime is the assigned lifetime in seconds.
+	Lifetime uint32
+
+	// Epoch is the server's epoch time in seconds.
+	Epoch uint32
+
+	// InternalIP is the client address the mapping points at.
+	InternalIP net.IP
+
+	// InternalPort is the port on the client.
+	InternalPort uint16
+
+	// ExternalPort is the assigned external port.
+	ExternalPort uint16
+
+	// ExternalIP is the assigned external address.
+	ExternalIP net.IP
+}
+
+// Client is a PCP client for the server at the gateway.
+type Client struct {
+	gateway net.IP
+	port    int
+}
+
+// NewClient creates a PCP client for the PCP server at the gateway.
+func NewClient(gateway net.IP) *Client {
+	return &Client{gateway: gateway, port: Port}
+}
+
+// NewClientWithPort creates a PCP client for the PCP server at the gateway
+// listening on port.
+func NewClientWithPort(gateway net.IP, port int) *Client {
+	return &Client{gateway: gateway, port: port}
+}
+
+// NewNonce returns a random mapping nonce.
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return nonce, nil
+}
+
+// Map sends a MAP request, retransmitting until a response is received, the
+// context is done or the retries are exhausted.
+func (client *Client) Map(ctx context.Context, req MapRequest) (*MapResponse, error) {
+	protocol, err := protocolNumber(req.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.Nonce) != nonceSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidNonce, len(req.Nonce))
+	}
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(
+		ctx,
+		"udp",
+		net.JoinHostPort(client.gateway.String(), strconv.Itoa(client.port)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial gateway: %w", err)
+	}
+	defer conn.Close()
+
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address %s", conn.LocalAddr())
+	}
+
+	msg := encodeMap(req, protocol, local.IP, req.Nonce)
+
+	response, err := call(ctx, conn, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := decodeMap(response, protocol, req.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	result.InternalIP = local.IP
+	if req.ThirdParty != nil {
+		result.InternalIP = req.ThirdParty
+	}
+
+	return result, nil
+}
+
+// Announce sends an ANNOUNCE request, returning the server's epoch time. It
+// is used to check the server is reachable.
+func (client *Client) Announce(ctx context.Context) (uint32, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(
+		ctx,
+		"udp",
+		net.JoinHostPort(client.gateway.String(), strconv.Itoa(client.port)),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("unable to dial gateway: %w", err)
+	}
+	defer conn.Close()
+
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unexpected local address %s", conn.LocalAddr())
+	}
+
+	msg := make([]byte, headerSize)
+	msg[0] = version
+	msg[1] = opcodeAnnounce
+	copy(msg[8:24], address(local.IP, local.IP))
+
+	response, err := call(ctx, conn, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeAnnounce(response)
+}
+
+func decodeAnnounce(msg []byte) (uint32, error) {
+	if len(msg) > 0 && msg[0] == 0 {
+		return 0, &ResultError{Code: UnsuppVersion}
+	}
+
+	if len(msg) < headerSize {
+		return 0, fmt.Errorf("%w: short response of %d bytes", ErrMalformedResponse, len(msg))
+	}
+
+	if msg[0] != version {
+		return 0, fmt.Errorf("%w: version %d", ErrMalformedResponse, msg[0])
+	}
+
+	if msg[1] != opcodeAnnounce|opResponse {
+		return 0, fmt.Errorf("%w: opcode %d", ErrMalformedResponse, msg[1])
+	}
+
+	if code := ResultCode(msg[3]); code != Success {
+		return 0, &ResultError{Code: code}
+	}
+
+	return binary.BigEndian.Uint32(msg[8:12]), nil
+}
+
+func protocolNumber(protocol string) (uint8, error) {
+	switch protocol {
+	case "tcp":
+		return protocolTCP, nil
+	case "udp":
+		return protocolUDP, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrUnknownProtocol, protocol)
+	}
+}
+
+// address returns the 128 bit form of ip used on the wire, IPv4 addresses
+// are IPv4-mapped and nil is the unspecified address of the same family as
+// like.
+func address(ip, like net.IP) []byte {
+	if ip == nil {
+		if like.To4() != nil {
+			return net.IPv4zero.To16()
+		}
+
+		return net.IPv6zero
+	}
+
+	return ip.To16()
+}
+
+func encodeMap(req MapRequest, protocol uint8, client net.IP, nonce []byte) []byte {
+	size := headerSize + mapPayloadSize
+	if req.ThirdParty != nil {
+		size += optionHeaderSize + addressSize
+	}
+
+	msg := make([]byte, size)
+
+	msg[0] = version
+	msg[1] = opcodeMap
+	binary.BigEndian.PutUint32(msg[4:8], req.Lifetime)
+	copy(msg[8:24], address(client, client))
+
+	payload := msg[headerSize:]
+	copy(payload[0:12], nonce)
+	payload[12] = protocol
+	binary.BigEndian.PutUint16(payload[16:18], req.InternalPort)
+	binary.BigEndian.PutUint16(payload[18:20], req.SuggestedExternalPort)
+	copy(payload[20:36], address(req.SuggestedExternalIP, client))
+
+	if req.ThirdParty != nil {
+		option := payload[mapPayloadSize:]
+		option[0] = optionThirdParty
+		binary.BigEndian.PutUint16(option[2:4], addressSize)
+		copy(option[optionHeaderSize:], address(req.ThirdParty, client))
+	}
+
+	return msg
+}
+
+func decodeMap(msg []byte, protocol uint8, nonce []byte) (*MapResponse, error) {
+	// A NAT-PMP only server answers with a version 0 response, see RFC
+	// 6887 section 9.
+	if len(msg) > 0 && msg[0] == 0 {
+		return nil, &ResultError{Code: UnsuppVersion}
+	}
+
+	if len(msg) < headerSize+mapPayloadSize {
+		return nil, fmt.Errorf("%w: short response of %d bytes", ErrMalformedResponse, len(msg))
+	}
+
+	if msg[0] != version {
+		return nil, fmt.Errorf("%w: version %d", ErrMalformedResponse, msg[0])
+	}
+
+	if msg[1] != opcodeMap|opResponse {
+		return nil, fmt.Errorf("%w: opcode %d", ErrMalformedResponse, msg[1])
+	}
+
+	if code := ResultCode(msg[3]); code != Success {
+		return nil, &ResultError{Code: code}
+	}
+
+	payload := msg[headerSize:]
+	if !bytes.Equal(payload[0:12], nonce) {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrMalformedResponse)
+	}
+
+	if payload[12] != protocol {
+		return nil, fmt.Errorf("%w: protocol %d", ErrMalformedResponse, payload[12])
+	}
+
+	externalIP := net.IP(append([]byte{}, payload[20:36]...))
+	if ip4 := externalIP.To4(); ip4 != nil {
+		externalIP = ip4
+	}
+
+	return &MapResponse{
+		Lifetime:     binary.BigEndian.Uint32(msg[4:8]),
+		Epoch:        binary.BigEndian.Uint32(msg[8:12]),
+		InternalPort: binary.BigEndian.Uint16(payload[16:18]),
+		ExternalPort: binary.BigEndian.Uint16(payload[18:20]),
+		ExternalIP:   externalIP,
+	}, nil
+}
+
+// call sends msg, doubling the retransmission timeout after each attempt as
+// RFC 6887 section 8.1.1 recommends.
+func call(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	response := make([]byte, maxPacketSize)
+	timeout := initialRetransmit
+
+	var err error
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("pcp request cancelled: %w", ctxErr)
+		}
+
+		if _, err = conn.Write(msg); err != nil {
+			return nil, fmt.Errorf("unable to send request: %w", err)
+		}
+
+		deadline := time.Now().Add(timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("unable to set deadline: %w", err)
+		}
+
+		var size int
+
+		size, err = conn.Read(response)
+		if err == nil {
+			return response[:size], nil
+		}
+
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return nil, fmt.Errorf("unable to read response: %w", err)
+		}
+
+		timeout *= 2
+	}
+
+	return nil, fmt.Errorf("timed out waiting for response: %w", err)
+}
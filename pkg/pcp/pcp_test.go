@@ -0,0 +1,152 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pcp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serve answers a single MAP request on conn with the result code, echoing
+// the request and assigning externalPort.
+func serve(t *testing.T, conn net.PacketConn, code ResultCode, externalPort uint16) {
+	t.Helper()
+
+	buf := make([]byte, maxPacketSize)
+
+	size, addr, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, size, headerSize+mapPayloadSize)
+
+	response := make([]byte, headerSize+mapPayloadSize)
+	response[0] = version
+	response[1] = buf[1] | opResponse
+	response[3] = byte(code)
+	copy(response[4:8], buf[4:8])
+	binary.BigEndian.PutUint32(response[8:12], 42)
+
+	copy(response[headerSize:], buf[headerSize:headerSize+mapPayloadSize])
+	binary.BigEndian.PutUint16(response[headerSize+18:headerSize+20], externalPort)
+	copy(response[headerSize+20:], net.ParseIP("203.0.113.1").To16())
+
+	_, err = conn.WriteTo(response, addr)
+	require.NoError(t, err)
+}
+
+// nonce returns a new mapping nonce.
+func nonce(t *testing.T) []byte {
+	t.Helper()
+
+	nonce, err := NewNonce()
+	require.NoError(t, err)
+	require.Len(t, nonce, nonceSize)
+
+	return nonce
+}
+
+func TestMap(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	go serve(t, conn, Success, 8443)
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	client := NewClientWithPort(net.ParseIP("127.0.0.1"), port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	response, err := client.Map(ctx, MapRequest{
+		Protocol:              "tcp",
+		InternalPort:          443,
+		SuggestedExternalPort: 443,
+		Lifetime:              3600,
+		Nonce:                 nonce(t),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3600), response.Lifetime)
+	require.Equal(t, uint32(42), response.Epoch)
+	require.Equal(t, uint16(443), response.InternalPort)
+	require.Equal(t, uint16(8443), response.ExternalPort)
+	require.Equal(t, "203.0.113.1", response.ExternalIP.String())
+	require.Equal(t, "127.0.0.1", response.InternalIP.String())
+}
+
+func TestMapThirdParty(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	go serve(t, conn, Success, 8080)
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	client := NewClientWithPort(net.ParseIP("127.0.0.1"), port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	response, err := client.Map(ctx, MapRequest{
+		Protocol:     "tcp",
+		InternalPort: 80,
+		Lifetime:     60,
+		ThirdParty:   net.ParseIP("192.0.2.10"),
+		Nonce:        nonce(t),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.10", response.InternalIP.String())
+}
+
+func TestMapResultError(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	go serve(t, conn, NotAuthorized, 0)
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	client := NewClientWithPort(net.ParseIP("127.0.0.1"), port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.Map(ctx, MapRequest{
+		Protocol:     "udp",
+		InternalPort: 53,
+		Lifetime:     60,
+		Nonce:        nonce(t),
+	})
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, NotAuthorized, resultErr.Code)
+}
+
+func TestMapRequiresNonce(t *testing.T) {
+	client := NewClient(net.ParseIP("127.0.0.1"))
+
+	_, err := client.Map(context.Background(), MapRequest{Protocol: "tcp", InternalPort: 443, Lifetime: 60})
+	require.ErrorIs(t, err, ErrInvalidNonce)
+}
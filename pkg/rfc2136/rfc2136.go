@@ -0,0 +1,192 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rfc2136 implements a dynamic DNS update client.
+//
+// See https://tools.ietf.org/rfc/rfc2136.txt
+package rfc2136
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigFudge is the allowed clock skew between the client and the server in
+// seconds.
+const tsigFudge = 300
+
+var (
+	// ErrUnknownAlgorithm is returned when the TSIG algorithm is not
+	// supported.
+	ErrUnknownAlgorithm = errors.New("unknown TSIG algorithm")
+
+	// ErrUpdateRefused is returned when the server responds with a
+	// non-success rcode.
+	ErrUpdateRefused = errors.New("update refused")
+)
+
+// algorithms maps the TSIG algorithm names to their wire names.
+var algorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// TSIG is the key used to sign updates.
+type TSIG struct {
+	// KeyName is the name of the key.
+	KeyName string
+
+	// Algorithm is the HMAC algorithm of the key, such as hmac-sha256.
+	Algorithm string
+
+	// Secret is the base64 encoded key.
+	Secret string
+}
+
+// Client sends dynamic updates to a nameserver.
+type Client struct {
+	server string
+	zone   string
+	tsig   *TSIG
+}
+
+// NewClient returns a Client updating the zone on the server, given as
+// host:port. A nil tsig sends unsigned updates.
+func NewClient(server string, zone string, tsig *TSIG) *Client {
+	return &Client{server: server, zone: dns.Fqdn(zone), tsig: tsig}
+}
+
+// Update replaces the A and AAAA records of the hostnames with the addresses.
+// Only the record types of the addresses given are replaced.
+func (client *Client) Update(
+	ctx context.Context,
+	hostnames []string,
+	ttl uint32,
+	ips []net.IP,
+) error {
+	msg := new(dns.Msg)
+	msg.SetUpdate(client.zone)
+
+	for _, hostname := range hostnames {
+		name := dns.Fqdn(hostname)
+
+		var (
+			removed = map[uint16]bool{}
+			inserts []dns.RR
+		)
+
+		for _, ip := range ips {
+			header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+
+			var record dns.RR
+
+			if ip4 := ip.To4(); ip4 != nil {
+				header.Rrtype = dns.TypeA
+				record = &dns.A{Hdr: header, A: ip4}
+			} else {
+				header.Rrtype = dns.TypeAAAA
+				record = &dns.AAAA{Hdr: header, AAAA: ip}
+			}
+
+			if !removed[header.Rrtype] {
+				removed[header.Rrtype] = true
+
+				msg.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: header.Rrtype,
+					Class:  dns.ClassINET,
+				}}})
+			}
+
+			inserts = append(inserts, record)
+		}
+
+		msg.Insert(inserts)
+	}
+
+	return client.exchange(ctx, msg)
+}
+
+// Delete removes the A and AAAA records of the hostnames. Only the record
+// types of the addresses given are removed, matching Update.
+func (client *Client) Delete(ctx context.Context, hostnames []string, ips []net.IP) error {
+	msg := new(dns.Msg)
+	msg.SetUpdate(client.zone)
+
+	for _, hostname := range hostnames {
+		name := dns.Fqdn(hostname)
+		removed := map[uint16]bool{}
+
+		for _, ip := range ips {
+			rrtype := dns.TypeAAAA
+			if ip.To4() != nil {
+				rrtype = dns.TypeA
+			}
+
+			if removed[rrtype] {
+				continue
+			}
+
+			removed[rrtype] = true
+
+			msg.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: rrtype,
+				Class:  dns.ClassINET,
+			}}})
+		}
+	}
+
+	if len(msg.Ns) == 0 {
+		return nil
+	}
+
+	return client.exchange(ctx, msg)
+}
+
+func (client *Client) exchange(ctx context.Context, msg *dns.Msg) error {
+	dnsClient := &dns.Client{Net: "udp"}
+
+	if client.tsig != nil {
+		algorithm, ok := algorithms[client.tsig.Algorithm]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownAlgorithm, client.tsig.Algorithm)
+		}
+
+		keyName := dns.Fqdn(client.tsig.KeyName)
+		dnsClient.TsigSecret = map[string]string{keyName: client.tsig.Secret}
+		msg.SetTsig(keyName, algorithm, tsigFudge, time.Now().Unix())
+	}
+
+	response, _, err := dnsClient.ExchangeContext(ctx, msg, client.server)
+	if err != nil {
+		return fmt.Errorf("unable to send update: %w", err)
+	}
+
+	if response.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%w: %s", ErrUpdateRefused, dns.RcodeToString[response.Rcode])
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rfc2136
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testKeyName = "natpmp."
+	testSecret  = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// serve starts an in-process nameserver recording the updates it accepts.
+// Updates failing TSIG verification are answered with NOTAUTH.
+func serve(t *testing.T) (string, <-chan *dns.Msg) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	updates := make(chan *dns.Msg, 1)
+	started := make(chan struct{})
+
+	server := &dns.Server{
+		PacketConn:        conn,
+		TsigSecret:        map[string]string{testKeyName: testSecret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+		Handler: dns.HandlerFunc(func(writer dns.ResponseWriter, req *dns.Msg) {
+			response := new(dns.Msg)
+			response.SetReply(req)
+
+			if req.IsTsig() == nil || writer.TsigStatus() != nil {
+				response.Rcode = dns.RcodeNotAuth
+			} else {
+				updates <- req
+			}
+
+			_ = writer.WriteMsg(response)
+		}),
+	}
+
+	go func() { _ = server.ActivateAndServe() }()
+
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	<-started
+
+	return conn.LocalAddr().String(), updates
+}
+
+func TestUpdate(t *testing.T) {
+	server, updates := serve(t)
+
+	client := NewClient(server, "example.com", &TSIG{
+		KeyName:   "natpmp",
+		Algorithm: "hmac-sha256",
+		Secret:    testSecret,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := client.Update(
+		ctx,
+		[]string{"home.example.com"},
+		60,
+		[]net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8::1")},
+	)
+	require.NoError(t, err)
+
+	update := <-updates
+	require.Equal(t, "example.com.", update.Question[0].Name)
+
+	var (
+		removed  []uint16
+		inserted []string
+	)
+
+	for _, record := range update.Ns {
+		header := record.Header()
+		if header.Class == dns.ClassANY {
+			removed = append(removed, header.Rrtype)
+
+			continue
+		}
+
+		require.Equal(t, "home.example.com.", header.Name)
+		require.Equal(t, uint32(60), header.Ttl)
+
+		switch record := record.(type) {
+		case *dns.A:
+			inserted = append(inserted, record.A.String())
+		case *dns.AAAA:
+			inserted = append(inserted, record.AAAA.String())
+		}
+	}
+
+	require.ElementsMatch(t, []uint16{dns.TypeA, dns.TypeAAAA}, removed)
+	require.ElementsMatch(t, []string{"203.0.113.1", "2001:db8::1"}, inserted)
+}
+
+func TestDelete(t *testing.T) {
+	server, updates := serve(t)
+
+	client := NewClient(server, "example.com", &TSIG{
+		KeyName:   "natpmp",
+		Algorithm: "hmac-sha256",
+		Secret:    testSecret,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := client.Delete(
+		ctx,
+		[]string{"home.example.com", "www.example.com"},
+		[]net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("198.51.100.1")},
+	)
+	require.NoError(t, err)
+
+	update := <-updates
+	require.Equal(t, "example.com.", update.Question[0].Name)
+
+	removed := make([]string, 0, len(update.Ns))
+
+	for _, record := range update.Ns {
+		header := record.Header()
+		require.Equal(t, uint16(dns.ClassANY), header.Class)
+		require.Equal(t, dns.TypeA, header.Rrtype)
+
+		removed = append(removed, header.Name)
+	}
+
+	require.Equal(t, []string{"home.example.com.", "www.example.com."}, removed)
+
+	// Nothing is sent without hostnames or addresses.
+	require.NoError(t, client.Delete(ctx, nil, []net.IP{net.ParseIP("203.0.113.1")}))
+	require.NoError(t, client.Delete(ctx, []string{"home.example.com"}, nil))
+	require.Empty(t, updates)
+}
+
+func TestUpdateBadKey(t *testing.T) {
+	server, _ := serve(t)
+
+	client := NewClient(server, "example.com", &TSIG{
+		KeyName:   "natpmp",
+		Algorithm: "hmac-sha256",
+		Secret:    "d3JvbmdrZXk=",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := client.Update(ctx, []string{"home.example.com"}, 60, []net.IP{net.ParseIP("203.0.113.1")})
+	require.Error(t, err)
+}
+
+func TestUpdateUnknownAlgorithm(t *testing.T) {
+	client := NewClient("127.0.0.1:53", "example.com", &TSIG{
+		KeyName:   "natpmp",
+		Algorithm: "md5",
+		Secret:    testSecret,
+	})
+
+	err := client.Update(context.Background(), []string{"home.example.com"}, 60, nil)
+	require.ErrorIs(t, err, ErrUnknownAlgorithm)
+}
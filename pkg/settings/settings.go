@@ -0,0 +1,393 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package settings loads the configuration file of the manager and reloads
+// it when the file changes.
+package settings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	configv1alpha1 "github.com/jkoelker/natpmp-controller/api/config/v1alpha1"
+	networkv1 "github.com/jkoelker/natpmp-controller/api/v1"
+)
+
+const (
+	DefaultMetricsBindAddress      = ":8080"
+	DefaultHealthBindAddress       = ":8081"
+	DefaultStallTimeout            = 10 * time.Minute
+	DefaultLeaderElectionID        = "6ebc5733.natpmp.jkoelker.github.io"
+	DefaultMaxConcurrentReconciles = 1
+	DefaultLifetime                = 7200
+	DefaultRenewalFraction         = 0.75
+)
+
+// ErrInvalidConfig is returned when the configuration file is invalid.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Default sets the unset fields of the configuration to their defaults.
+func Default(cfg *configv1alpha1.ManagerConfig) {
+	if cfg.APIVersion == "" {
+		cfg.APIVersion = configv1alpha1.APIVersion
+	}
+
+	if cfg.Kind == "" {
+		cfg.Kind = configv1alpha1.Kind
+	}
+
+	if cfg.Metrics.BindAddress == "" {
+		cfg.Metrics.BindAddress = DefaultMetricsBindAddress
+	}
+
+	if cfg.Health.BindAddress == "" {
+		cfg.Health.BindAddress = DefaultHealthBindAddress
+	}
+
+	if cfg.Health.StallTimeout.Duration == 0 {
+		cfg.Health.StallTimeout.Duration = DefaultStallTimeout
+	}
+
+	if cfg.LeaderElection.LeaderElect == nil {
+		leaderElect := false
+		cfg.LeaderElection.LeaderElect = &leaderElect
+	}
+
+	if cfg.LeaderElection.ResourceName == "" {
+		cfg.LeaderElection.ResourceName = DefaultLeaderElectionID
+	}
+
+	if cfg.Controller.MaxConcurrentReconciles == 0 {
+		cfg.Controller.MaxConcurrentReconciles = DefaultMaxConcurrentReconciles
+	}
+
+	if cfg.Defaults.Lifetime == 0 {
+		cfg.Defaults.Lifetime = DefaultLifetime
+	}
+
+	if cfg.Gateway.RenewalFraction == 0 {
+		cfg.Gateway.RenewalFraction = DefaultRenewalFraction
+	}
+
+	if cfg.Templates.ForceOwnership == nil {
+		forceOwnership := true
+		cfg.Templates.ForceOwnership = &forceOwnership
+	}
+}
+
+// Defaults returns the configuration used without a configuration file.
+func Defaults() *configv1alpha1.ManagerConfig {
+	cfg := &configv1alpha1.ManagerConfig{}
+	Default(cfg)
+
+	return cfg
+}
+
+// Validate returns a list of errors if the configuration is invalid.
+func Validate(cfg *configv1alpha1.ManagerConfig) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if cfg.APIVersion != configv1alpha1.APIVersion {
+		allErrs = append(allErrs, field.NotSupported(
+			field.NewPath("apiVersion"),
+			cfg.APIVersion,
+			[]string{configv1alpha1.APIVersion},
+		))
+	}
+
+	if cfg.Kind != configv1alpha1.Kind {
+		allErrs = append(allErrs, field.NotSupported(
+			field.NewPath("kind"),
+			cfg.Kind,
+			[]string{configv1alpha1.Kind},
+		))
+	}
+
+	if cfg.Health.StallTimeout.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(
+			field.NewPath("health", "stallTimeout"),
+			cfg.Health.StallTimeout.Duration.String(),
+			"must not be negative",
+		))
+	}
+
+	allErrs = append(allErrs, validateController(cfg.Controller)...)
+
+	defaults := field.NewPath("defaults")
+
+	if cfg.Defaults.Gateway != "" && net.ParseIP(cfg.Defaults.Gateway) == nil {
+		allErrs = append(allErrs, field.Invalid(
+			defaults.Child("gateway"),
+			cfg.Defaults.Gateway,
+			"invalid IP address",
+		))
+	}
+
+	if cfg.Defaults.Lifetime < 1 {
+		allErrs = append(allErrs, field.Invalid(defaults.Child("lifetime"), cfg.Defaults.Lifetime, "invalid lifetime"))
+	}
+
+	gateway := field.NewPath("gateway")
+
+	if cfg.Gateway.RequestTimeout.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(
+			gateway.Child("requestTimeout"),
+			cfg.Gateway.RequestTimeout.Duration.String(),
+			"must not be negative",
+		))
+	}
+
+	if cfg.Gateway.RenewalFraction <= 0 || cfg.Gateway.RenewalFraction >= 1 {
+		allErrs = append(allErrs, field.Invalid(
+			gateway.Child("renewalFraction"),
+			cfg.Gateway.RenewalFraction,
+			"must be between 0 and 1",
+		))
+	}
+
+	for idx, kind := range cfg.Templates.AllowedKinds {
+		if schema.ParseGroupKind(kind).Kind == "" {
+			allErrs = append(allErrs, field.Invalid(
+				field.NewPath("templates", "allowedKinds").Index(idx),
+				kind,
+				"must be Kind or Kind.group",
+			))
+		}
+	}
+
+	return allErrs
+}
+
+// validateController returns the errors in the controller configuration.
+func validateController(controller configv1alpha1.Controller) field.ErrorList {
+	var allErrs field.ErrorList
+
+	path := field.NewPath("controller")
+
+	if controller.MaxConcurrentReconciles < 1 {
+		allErrs = append(allErrs, field.Invalid(
+			path.Child("maxConcurrentReconciles"),
+			controller.MaxConcurrentReconciles,
+			"must be at least 1",
+		))
+	}
+
+	for idx, namespace := range controller.Namespaces {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			allErrs = append(allErrs, field.Invalid(path.Child("namespaces").Index(idx), namespace, msg))
+		}
+	}
+
+	if _, err := labels.Parse(controller.Selector); err != nil {
+		allErrs = append(allErrs, field.Invalid(path.Child("selector"), controller.Selector, err.Error()))
+	}
+
+	for idx, gateway := range controller.Gateways {
+		if _, err := parseGateway(gateway); err != nil {
+			allErrs = append(allErrs, field.Invalid(path.Child("gateways").Index(idx), gateway, err.Error()))
+		}
+	}
+
+	if controller.Namespaced && len(controller.Namespaces) == 0 {
+		allErrs = append(allErrs, field.Required(
+			path.Child("namespaces"),
+			"a namespaced manager requires namespaces",
+		))
+	}
+
+	return allErrs
+}
+
+// CacheOptions returns the cache options that scope the manager to the
+// namespaces and NatPMP selector of the configuration.
+func CacheOptions(cfg *configv1alpha1.ManagerConfig) (cache.Options, error) {
+	var opts cache.Options
+
+	if len(cfg.Controller.Namespaces) > 0 {
+		opts.DefaultNamespaces = make(map[string]cache.Config, len(cfg.Controller.Namespaces))
+		for _, namespace := range cfg.Controller.Namespaces {
+			opts.DefaultNamespaces[namespace] = cache.Config{}
+		}
+	}
+
+	if cfg.Controller.Selector != "" {
+		selector, err := labels.Parse(cfg.Controller.Selector)
+		if err != nil {
+			return opts, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+
+		opts.ByObject = map[client.Object]cache.ByObject{
+			&networkv1.NatPMP{}: {Label: selector},
+		}
+	}
+
+	return opts, nil
+}
+
+// Load reads the configuration file, defaulting and validating it.
+func Load(path string) (*configv1alpha1.ManagerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration: %w", err)
+	}
+
+	cfg := &configv1alpha1.ManagerConfig{}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	Default(cfg)
+
+	if errs := Validate(cfg); len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, errs.ToAggregate())
+	}
+
+	return cfg, nil
+}
+
+// Store holds the configuration of the manager. Once started it reloads the
+// configuration when the file changes, keeping the options that are only read
+// at start.
+type Store struct {
+	path    string
+	current atomic.Pointer[configv1alpha1.ManagerConfig]
+}
+
+// NewStore returns a store holding the configuration loaded from the path.
+// An empty path is never reloaded.
+func NewStore(path string, cfg *configv1alpha1.ManagerConfig) *Store {
+	store := &Store{path: path}
+	store.current.Store(cfg)
+
+	return store
+}
+
+// Get returns the current configuration, the defaults for a nil store.
+func (store *Store) Get() *configv1alpha1.ManagerConfig {
+	if store == nil {
+		return Defaults()
+	}
+
+	if cfg := store.current.Load(); cfg != nil {
+		return cfg
+	}
+
+	return Defaults()
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every
+// replica reloads its configuration.
+func (store *Store) NeedLeaderElection() bool {
+	return false
+}
+
+// Start reloads the configuration when the file changes until the context is
+// done. The directory is watched since a mounted ConfigMap replaces the file
+// through a symlink.
+func (store *Store) Start(ctx context.Context) error {
+	if store.path == "" {
+		<-ctx.Done()
+
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to watch configuration: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(store.path)); err != nil {
+		return fmt.Errorf("unable to watch configuration: %w", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+
+			store.reload(ctx)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			log.FromContext(ctx).Error(err, "unable to watch configuration")
+		}
+	}
+}
+
+// reload loads the configuration file, keeping the current configuration if
+// it is invalid.
+func (store *Store) reload(ctx context.Context) {
+	logger := log.FromContext(ctx).WithValues("path", store.path)
+
+	cfg, err := Load(store.path)
+	if err != nil {
+		logger.Error(err, "unable to reload configuration")
+
+		return
+	}
+
+	current := store.Get()
+	if equality.Semantic.DeepEqual(current, cfg) {
+		return
+	}
+
+	if !equality.Semantic.DeepEqual(current.Metrics, cfg.Metrics) ||
+		!equality.Semantic.DeepEqual(current.Health, cfg.Health) ||
+		!equality.Semantic.DeepEqual(current.Debug, cfg.Debug) ||
+		!equality.Semantic.DeepEqual(current.LeaderElection, cfg.LeaderElection) ||
+		!equality.Semantic.DeepEqual(current.Controller, cfg.Controller) {
+		logger.Info("restart the manager to apply the metrics, health, debug, leaderElection and controller options")
+
+		cfg.Metrics = current.Metrics
+		cfg.Health = current.Health
+		cfg.Debug = current.Debug
+		cfg.LeaderElection = current.LeaderElection
+		cfg.Controller = current.Controller
+	}
+
+	store.current.Store(cfg)
+	logger.Info("reloaded configuration")
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	configv1alpha1 "github.com/jkoelker/natpmp-controller/api/config/v1alpha1"
+)
+
+func write(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load(write(t, `
+apiVersion: config.natpmp.jkoelker.github.io/v1alpha1
+kind: ManagerConfig
+defaults:
+  gateway: 192.0.2.1
+gateway:
+  requestTimeout: 5s
+`))
+	require.NoError(t, err)
+
+	require.Equal(t, "192.0.2.1", cfg.Defaults.Gateway)
+	require.Equal(t, DefaultLifetime, cfg.Defaults.Lifetime)
+	require.Equal(t, 5*time.Second, cfg.Gateway.RequestTimeout.Duration)
+	require.InDelta(t, DefaultRenewalFraction, cfg.Gateway.RenewalFraction, 0)
+	require.Equal(t, DefaultMetricsBindAddress, cfg.Metrics.BindAddress)
+	require.True(t, *cfg.Templates.ForceOwnership)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field": "apiVersion: " + configv1alpha1.APIVersion + "\nkind: ManagerConfig\nunknown: true\n",
+		"wrong kind":    "apiVersion: " + configv1alpha1.APIVersion + "\nkind: NatPMP\n",
+		"fraction":      "gateway:\n  renewalFraction: 1.5\n",
+		"gateway":       "defaults:\n  gateway: router\n",
+		"allowed kinds": "templates:\n  allowedKinds: [\"\"]\n",
+		"selector":      "controller:\n  selector: \"app in (\"\n",
+		"namespaced":    "controller:\n  namespaced: true\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load(write(t, content))
+			require.ErrorIs(t, err, ErrInvalidConfig)
+		})
+	}
+}
+
+func TestStoreGet(t *testing.T) {
+	var store *Store
+
+	require.Equal(t, Defaults(), store.Get())
+
+	cfg := Defaults()
+	cfg.Defaults.Lifetime = 60
+
+	require.Equal(t, 60, NewStore("", cfg).Get().Defaults.Lifetime)
+}
+
+func TestCacheOptions(t *testing.T) {
+	cfg := Defaults()
+
+	opts, err := CacheOptions(cfg)
+	require.NoError(t, err)
+	require.Empty(t, opts.DefaultNamespaces)
+	require.Empty(t, opts.ByObject)
+
+	cfg.Controller.Namespaces = []string{"site-a", "site-b"}
+	cfg.Controller.Selector = "site=a"
+
+	opts, err = CacheOptions(cfg)
+	require.NoError(t, err)
+	require.Len(t, opts.DefaultNamespaces, 2)
+	require.Contains(t, opts.DefaultNamespaces, "site-a")
+
+	require.Len(t, opts.ByObject, 1)
+
+	for _, byObject := range opts.ByObject {
+		require.Equal(t, "site=a", byObject.Label.String())
+	}
+}
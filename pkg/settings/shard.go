@@ -0,0 +1,135 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ErrInvalidGateway is returned for a shard gateway that cannot be parsed.
+var ErrInvalidGateway = errors.New("invalid gateway")
+
+// Shard is the set of gateways a manager serves, given as addresses, CIDRs
+// or NatPMPGateway names. A nil shard serves every gateway.
+type Shard struct {
+	gateways []string
+	names    map[string]struct{}
+	networks []*net.IPNet
+}
+
+// NewShard returns the shard serving the gateways, nil if there are none.
+func NewShard(gateways []string) (*Shard, error) {
+	if len(gateways) == 0 {
+		return nil, nil
+	}
+
+	shard := &Shard{names: map[string]struct{}{}}
+
+	for _, gateway := range gateways {
+		network, err := parseGateway(gateway)
+		if err != nil {
+			return nil, err
+		}
+
+		if network == nil {
+			shard.names[gateway] = struct{}{}
+		} else {
+			shard.networks = append(shard.networks, network)
+		}
+
+		shard.gateways = append(shard.gateways, gateway)
+	}
+
+	sort.Strings(shard.gateways)
+
+	return shard, nil
+}
+
+// parseGateway returns the network of an address or CIDR, nil for the name
+// of a NatPMPGateway.
+func parseGateway(gateway string) (*net.IPNet, error) {
+	if ip := net.ParseIP(gateway); ip != nil {
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = net.IPv4len * 8
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	if _, network, err := net.ParseCIDR(gateway); err == nil {
+		return network, nil
+	}
+
+	if msgs := validation.IsDNS1123Subdomain(gateway); len(msgs) > 0 {
+		return nil, fmt.Errorf(
+			"%w %q, not an address, CIDR or NatPMPGateway name: %s",
+			ErrInvalidGateway,
+			gateway,
+			strings.Join(msgs, ", "),
+		)
+	}
+
+	return nil, nil
+}
+
+// Serves returns true if the shard includes the NatPMPGateway or any of the
+// addresses.
+func (shard *Shard) Serves(gatewayRef string, addresses ...net.IP) bool {
+	if shard == nil {
+		return true
+	}
+
+	if _, ok := shard.names[gatewayRef]; ok && gatewayRef != "" {
+		return true
+	}
+
+	for _, address := range addresses {
+		if address == nil {
+			continue
+		}
+
+		for _, network := range shard.networks {
+			if network.Contains(address) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// LeaderElectionID returns the leader election ID of the shard, derived from
+// the base ID so that each shard elects its own leader.
+func (shard *Shard) LeaderElectionID(base string) string {
+	if shard == nil {
+		return base
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(strings.Join(shard.gateways, ",")))
+
+	return fmt.Sprintf("%08x.%s", hash.Sum32(), base)
+}
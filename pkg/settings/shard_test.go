@@ -0,0 +1,62 @@
+/*
+Copyright 2024 Jason Kölker.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package settings
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardServes(t *testing.T) {
+	var all *Shard
+
+	require.True(t, all.Serves("", net.ParseIP("192.0.2.1")))
+
+	shard, err := NewShard([]string{"198.51.100.1", "192.0.2.0/24", "site-b"})
+	require.NoError(t, err)
+
+	require.True(t, shard.Serves("", net.ParseIP("198.51.100.1")))
+	require.True(t, shard.Serves("", net.ParseIP("192.0.2.42")))
+	require.True(t, shard.Serves("site-b"))
+	require.False(t, shard.Serves("site-a", net.ParseIP("203.0.113.1")))
+	require.False(t, shard.Serves("", nil))
+
+	_, err = NewShard([]string{"Not_A_Gateway"})
+	require.ErrorIs(t, err, ErrInvalidGateway)
+}
+
+func TestShardLeaderElectionID(t *testing.T) {
+	var all *Shard
+
+	require.Equal(t, DefaultLeaderElectionID, all.LeaderElectionID(DefaultLeaderElectionID))
+
+	siteA, err := NewShard([]string{"192.0.2.1", "site-a"})
+	require.NoError(t, err)
+
+	reordered, err := NewShard([]string{"site-a", "192.0.2.1"})
+	require.NoError(t, err)
+
+	siteB, err := NewShard([]string{"198.51.100.1"})
+	require.NoError(t, err)
+
+	id := siteA.LeaderElectionID(DefaultLeaderElectionID)
+	require.Equal(t, id, reordered.LeaderElectionID(DefaultLeaderElectionID))
+	require.NotEqual(t, id, siteB.LeaderElectionID(DefaultLeaderElectionID))
+	require.NotEqual(t, DefaultLeaderElectionID, id)
+}